@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"cloud-scanner/config"
+	"cloud-scanner/logging"
+	"cloud-scanner/service"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"sort"
+	"strings"
+	"time"
+)
+
+// setIfUnset 命令行没有设置这个参数时，使用配置文件中的值
+func setIfUnset[T any](c *cli.Context, flagName string, dst *T, value *T) {
+	if value != nil && !c.IsSet(flagName) {
+		*dst = *value
+	}
+}
+
+// setDurationIfUnset 配置文件中的时间是 1s、500ms 这种写法，命令行没有设置时解析后使用
+func setDurationIfUnset(c *cli.Context, flagName string, dst *time.Duration, value *string) error {
+	if value == nil || c.IsSet(flagName) {
+		return nil
+	}
+	duration, err := time.ParseDuration(*value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q in config file: %w", flagName, *value, err)
+	}
+	*dst = duration
+	return nil
+}
+
+// loadConfig 读取配置文件和扫描配置，优先级从低到高为：
+// 默认值 < 配置文件 < --profile 选择的扫描配置 < 命令行参数
+func (app *application) loadConfig(c *cli.Context) error {
+	fileConfig := &config.FileConfig{}
+	if app.config.ConfigFile != "" {
+		var err error
+		fileConfig, err = config.LoadFile(app.config.ConfigFile)
+		if err != nil {
+			return err
+		}
+		app.logger.Infof("Load config file: %s", app.config.ConfigFile)
+	}
+
+	setIfUnset(c, "target", &app.config.Target, fileConfig.Target)
+	setIfUnset(c, "input", &app.config.InputFile, fileConfig.InputFile)
+	setIfUnset(c, "exclude", &app.config.Exclude, fileConfig.Exclude)
+	setIfUnset(c, "exclude-file", &app.config.ExcludeFile, fileConfig.ExcludeFile)
+	setIfUnset(c, "exclude-reserved", &app.config.ExcludeReserved, fileConfig.ExcludeReserved)
+	setIfUnset(c, "masscanWorkerCount", &app.config.MasscanWorkerCount, fileConfig.MasscanWorkerCount)
+	setIfUnset(c, "nmapWorkerCount", &app.config.NmapWorkerCount, fileConfig.NmapWorkerCount)
+	setIfUnset(c, "masscanRate", &app.config.MasscanRate, fileConfig.MasscanRate)
+	setIfUnset(c, "rate-per-24", &app.config.RatePerSubnet, fileConfig.RatePerSubnet)
+	app.config.ProviderRates = fileConfig.ProviderRates
+	setIfUnset(c, "backend", &app.config.DiscoveryBackend, fileConfig.Backend)
+	setIfUnset(c, "connect-concurrency", &app.config.ConnectConcurrency, fileConfig.ConnectConcurrency)
+	setIfUnset(c, "connect-retries", &app.config.ConnectRetries, fileConfig.ConnectRetries)
+	if err := setDurationIfUnset(c, "connect-timeout", &app.config.ConnectTimeout, fileConfig.ConnectTimeout); err != nil {
+		return err
+	}
+	setIfUnset(c, "masscan-batch", &app.config.MasscanBatchSize, fileConfig.MasscanBatchSize)
+	setIfUnset(c, "tarpit-threshold", &app.config.TarpitThreshold, fileConfig.TarpitThreshold)
+	setIfUnset(c, "tarpit-probes", &app.config.TarpitProbes, fileConfig.TarpitProbes)
+	setIfUnset(c, "tarpit-sample", &app.config.TarpitSample, fileConfig.TarpitSample)
+	setIfUnset(c, "ports", &app.config.Ports, fileConfig.Ports)
+	setIfUnset(c, "nmap-services", &app.config.NmapServicesFile, fileConfig.NmapServicesFile)
+	setIfUnset(c, "fingerprint", &app.config.Fingerprint, fileConfig.Fingerprint)
+	setIfUnset(c, "service-probes", &app.config.ServiceProbesFile, fileConfig.ServiceProbesFile)
+	if err := setDurationIfUnset(c, "fingerprint-timeout", &app.config.FingerprintTimeout, fileConfig.FingerprintTimeout); err != nil {
+		return err
+	}
+	setIfUnset(c, "nmap-timing", &app.config.NmapTiming, fileConfig.NmapTiming)
+	setIfUnset(c, "version-intensity", &app.config.VersionIntensity, fileConfig.VersionIntensity)
+	if err := setDurationIfUnset(c, "masscan-timeout", &app.config.MasscanTimeout, fileConfig.MasscanTimeout); err != nil {
+		return err
+	}
+	if err := setDurationIfUnset(c, "nmap-timeout", &app.config.NmapTimeout, fileConfig.NmapTimeout); err != nil {
+		return err
+	}
+	setIfUnset(c, "retries", &app.config.Retries, fileConfig.Retries)
+	if err := setDurationIfUnset(c, "retry-backoff", &app.config.RetryBackoff, fileConfig.RetryBackoff); err != nil {
+		return err
+	}
+	setIfUnset(c, "output", &app.config.OutputFile, fileConfig.OutputFile)
+	setIfUnset(c, "output-format", &app.config.OutputFormat, fileConfig.OutputFormat)
+	setIfUnset(c, "masscan-output", &app.config.MasscanOutputFile, fileConfig.MasscanOutputFile)
+	setIfUnset(c, "failed-output", &app.config.FailedOutputFile, fileConfig.FailedOutputFile)
+	setIfUnset(c, "baseline", &app.config.Baseline, fileConfig.Baseline)
+	setIfUnset(c, "diff-output", &app.config.DiffOutputFile, fileConfig.DiffOutputFile)
+	setIfUnset(c, "database", &app.config.Database, fileConfig.Database)
+	setIfUnset(c, "state", &app.config.StateFile, fileConfig.StateFile)
+	setIfUnset(c, "profile", &app.config.Profile, fileConfig.Profile)
+	if fileConfig.MasscanArgs != nil && !c.IsSet("masscan-args") {
+		app.config.MasscanExtraArgs = fileConfig.MasscanArgs
+	}
+	if fileConfig.NmapArgs != nil && !c.IsSet("nmap-args") {
+		app.config.NmapExtraArgs = fileConfig.NmapArgs
+	}
+	if c.IsSet("inventory") {
+		app.config.Inventory = c.StringSlice("inventory")
+	} else if fileConfig.Inventory != nil {
+		app.config.Inventory = fileConfig.Inventory
+	}
+	// 命令行上的元数据覆盖配置文件中同名的 key
+	app.config.Labels = fileConfig.Labels
+	if c.IsSet("label") {
+		labels, err := service.ParseLabels(c.StringSlice("label"))
+		if err != nil {
+			return err
+		}
+		if app.config.Labels == nil {
+			app.config.Labels = make(map[string]string, len(labels))
+		}
+		for key, value := range labels {
+			app.config.Labels[key] = value
+		}
+	}
+	if c.IsSet("report") {
+		app.config.ReportFiles = c.StringSlice("report")
+	} else if fileConfig.Reports != nil {
+		app.config.ReportFiles = fileConfig.Reports
+	}
+
+	if fileConfig.Alerts != nil {
+		app.config.Alerts = *fileConfig.Alerts
+	}
+	// 命令行上的告警规则和 webhook 追加在配置文件的后面，--alert-ports 和 --alert-service 是两条独立的规则
+	if c.IsSet("alert-ports") {
+		app.config.Alerts.Rules = append(app.config.Alerts.Rules, config.AlertRule{Name: "alert-ports", Ports: c.String("alert-ports")})
+	}
+	if c.IsSet("alert-service") {
+		app.config.Alerts.Rules = append(app.config.Alerts.Rules, config.AlertRule{Name: "alert-service", Service: c.String("alert-service")})
+	}
+	for _, spec := range c.StringSlice("alert-webhook") {
+		app.config.Alerts.Webhooks = append(app.config.Alerts.Webhooks, service.ParseWebhookSpec(spec))
+	}
+
+	// 配置文件打开了 debug 的话，需要重新初始化日志
+	if fileConfig.Debug != nil && !c.IsSet("debug") && *fileConfig.Debug != app.config.Debug {
+		app.config.Debug = *fileConfig.Debug
+		app.logger = logging.NewLogger(app.config.Debug)
+	}
+
+	app.profiles = fileConfig.Profiles
+	if app.config.Profile != "" {
+		profile, ok := config.GetProfile(app.config.Profile, fileConfig.Profiles)
+		if !ok {
+			names := config.ProfileNames()
+			for name := range fileConfig.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown profile %q, available profiles: %s", app.config.Profile, strings.Join(names, ", "))
+		}
+		app.applyProfile(c, profile)
+		app.logger.Infof("Use scan profile: %s", app.config.Profile)
+	}
+
+	// 命令行上的额外参数是一个字符串，按空白切分
+	if c.IsSet("masscan-args") {
+		app.config.MasscanExtraArgs = strings.Fields(c.String("masscan-args"))
+	}
+	if c.IsSet("nmap-args") {
+		app.config.NmapExtraArgs = strings.Fields(c.String("nmap-args"))
+	}
+
+	for _, filename := range app.config.ReportFiles {
+		if _, ok := service.ReportFormatFromFilename(filename); !ok {
+			return fmt.Errorf("cannot guess report format of %s, use .html or .md", filename)
+		}
+	}
+	return nil
+}
+
+// applyProfile 使用扫描配置中设置了的字段，命令行参数仍然优先
+func (app *application) applyProfile(c *cli.Context, profile config.ScanProfile) {
+	if profile.Ports != "" && !c.IsSet("ports") {
+		app.config.Ports = profile.Ports
+	}
+	if profile.Rate != 0 && !c.IsSet("masscanRate") {
+		app.config.MasscanRate = profile.Rate
+	}
+	setIfUnset(c, "nmap-timing", &app.config.NmapTiming, profile.NmapTiming)
+	setIfUnset(c, "version-intensity", &app.config.VersionIntensity, profile.VersionIntensity)
+	if profile.MasscanArgs != nil && !c.IsSet("masscan-args") {
+		app.config.MasscanExtraArgs = profile.MasscanArgs
+	}
+	if profile.NmapArgs != nil && !c.IsSet("nmap-args") {
+		app.config.NmapExtraArgs = profile.NmapArgs
+	}
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"bytes"
+	"cloud-scanner/service"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"strings"
+)
+
+// diff 子命令支持的输出格式
+const (
+	diffFormatText = "text"
+	diffFormatJSON = "json"
+)
+
+// diffCommand 对比两次扫描的结果
+func (app *application) diffCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "diff",
+		Usage:     "Compare two scan results and report new hosts, opened and closed ports and changed services",
+		ArgsUsage: "<baseline> <current>",
+		Description: "Each argument is a result file in any output format, or a database DSN such as sqlite://./scan.db.\n" +
+			"Append #<scan_id> to a DSN to pick a scan, otherwise the latest scan is used.\n" +
+			"When both arguments are the same database, the latest scan is compared with the one before it.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format: text or json",
+				Value: diffFormatText,
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Usage:   "Output filename, stdout if not set",
+				Aliases: []string{"o"},
+			},
+		},
+		Action: app.diffAction,
+	}
+}
+
+func (app *application) diffAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("diff needs exactly 2 arguments: <baseline> <current>")
+	}
+	format := c.String("format")
+	if format != diffFormatText && format != diffFormatJSON {
+		return fmt.Errorf("unknown diff format: %s", format)
+	}
+	baselineSource, currentSource := c.Args().Get(0), c.Args().Get(1)
+
+	// 先读取当前的结果，基线和它是同一个数据库时，基线默认使用它之前的那次扫描
+	current, err := service.LoadResults(app.logger, currentSource, "")
+	if err != nil {
+		return err
+	}
+	currentScanID := ""
+	if len(current) > 0 {
+		currentScanID = current[0].ScanID
+	}
+	baseline, err := service.LoadResults(app.logger, baselineSource, currentScanID)
+	if err != nil {
+		return err
+	}
+
+	diff := service.DiffResults(baseline, current, nil)
+	diff.Baseline = service.RedactSource(baselineSource)
+	diff.Current = service.RedactSource(currentSource)
+
+	var output io.Writer = os.Stdout
+	if filename := c.String("output"); filename != "" {
+		fp, err := os.Create(filename)
+		if err != nil {
+			return fmt.Errorf("cannot open diff output file %s: %w", filename, err)
+		}
+		defer func(fp *os.File) {
+			_ = fp.Close()
+		}(fp)
+		output = fp
+	}
+	if format == diffFormatJSON {
+		return diff.WriteJSON(output)
+	}
+	return diff.WriteText(output)
+}
+
+// writeBaselineDiff 扫描结束之后对比基线，汇总写到日志中，完整的差异写到 JSON 文件中
+// 只对比这次扫描过的目标和端口，没有扫描的不会被当成端口关闭
+func (app *application) writeBaselineDiff(baseline []service.OutputRecord, ports *service.PortSpec) error {
+	current, err := service.LoadResults(app.logger, app.config.OutputFile, "")
+	if err != nil {
+		return err
+	}
+	state, err := service.LoadResumeState(app.logger, app.config.StateFile)
+	if err != nil {
+		return err
+	}
+
+	diff := service.DiffResults(baseline, current, func(host string, protocol string, port uint) bool {
+		return state.IsDone(host) && ports.Contains(protocol, port)
+	})
+	diff.Baseline = service.RedactSource(app.config.Baseline)
+	diff.Current = app.config.OutputFile
+
+	var text bytes.Buffer
+	_ = diff.WriteText(&text)
+	for _, line := range strings.Split(strings.TrimRight(text.String(), "\n"), "\n") {
+		if line != "" {
+			app.logger.Infof("%s", line)
+		}
+	}
+
+	fp, err := os.Create(app.config.DiffOutputFile)
+	if err != nil {
+		return fmt.Errorf("cannot open diff output file %s: %w", app.config.DiffOutputFile, err)
+	}
+	defer func(fp *os.File) {
+		_ = fp.Close()
+	}(fp)
+	if err := diff.WriteJSON(fp); err != nil {
+		return err
+	}
+	app.logger.Infof("Write baseline diff to file: %s", app.config.DiffOutputFile)
+	return nil
+}
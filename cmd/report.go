@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"cloud-scanner/service"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"time"
+)
+
+// 报告中端口排行的默认长度
+const defaultReportTopPorts = 20
+
+// reportCommand 把扫描结果生成 HTML 或者 Markdown 报告
+func (app *application) reportCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "report",
+		Usage:     "Render scan results into a self-contained HTML or Markdown report",
+		ArgsUsage: "<results>",
+		Description: "The argument is a result file in any output format, or a database DSN such as sqlite://./scan.db.\n" +
+			"Append #<scan_id> to a DSN to pick a scan, otherwise the latest scan is used.\n" +
+			"Scan parameters are only available when reading from a database.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "Report format: html or markdown, guessed from the output filename if not set",
+				DefaultText: service.ReportFormatHTML,
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Usage:   "Output filename, stdout if not set",
+				Aliases: []string{"o"},
+			},
+			&cli.StringFlag{
+				Name:  "title",
+				Usage: "Report title",
+				Value: "Scan report",
+			},
+			&cli.IntFlag{
+				Name:  "top",
+				Usage: "Number of ports in the top exposed ports table",
+				Value: defaultReportTopPorts,
+			},
+		},
+		Action: app.reportAction,
+	}
+}
+
+func (app *application) reportAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("report needs exactly 1 argument: <results>")
+	}
+	source := c.Args().Get(0)
+	filename := c.String("output")
+
+	format := c.String("format")
+	if format == "" {
+		format = service.ReportFormatHTML
+		if guessed, ok := service.ReportFormatFromFilename(filename); ok {
+			format = guessed
+		}
+	}
+	if format != service.ReportFormatHTML && format != service.ReportFormatMarkdown {
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+
+	records, err := service.LoadResults(app.logger, source, "")
+	if err != nil {
+		return err
+	}
+	scanID := ""
+	if len(records) > 0 {
+		scanID = records[0].ScanID
+	}
+	info, err := service.LoadScanInfo(source, scanID)
+	if err != nil {
+		return err
+	}
+
+	report := service.BuildReport(records, info, c.Int("top"))
+	report.Title = c.String("title")
+	report.Source = service.RedactSource(source)
+
+	var output io.Writer = os.Stdout
+	if filename != "" {
+		fp, err := os.Create(filename)
+		if err != nil {
+			return fmt.Errorf("cannot open report file %s: %w", filename, err)
+		}
+		defer func(fp *os.File) {
+			_ = fp.Close()
+		}(fp)
+		output = fp
+	}
+	return report.Write(output, format)
+}
+
+// writeScanReports 扫描结束之后根据 SaverEngine 写出的结果生成报告，格式由扩展名决定
+func (app *application) writeScanReports() error {
+	records, err := service.LoadResults(app.logger, app.config.OutputFile, "")
+	if err != nil {
+		return err
+	}
+	info := &service.ScanInfo{
+		ScanID:     app.config.ScanID,
+		StartedAt:  app.config.StartedAt,
+		FinishedAt: time.Now(),
+	}
+	// 敏感的参数不会被序列化，和写到数据库中的扫描参数一致
+	parameters, _ := json.Marshal(app.config)
+	_ = json.Unmarshal(parameters, &info.Parameters)
+
+	report := service.BuildReport(records, info, defaultReportTopPorts)
+	report.Source = app.config.OutputFile
+	for _, filename := range app.config.ReportFiles {
+		format, _ := service.ReportFormatFromFilename(filename)
+		if err := writeReportFile(report, filename, format); err != nil {
+			return err
+		}
+		app.logger.Infof("Write %s report to file: %s", format, filename)
+	}
+	return nil
+}
+
+func writeReportFile(report *service.ScanReport, filename string, format string) error {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open report file %s: %w", filename, err)
+	}
+	defer func(fp *os.File) {
+		_ = fp.Close()
+	}(fp)
+	return report.Write(fp, format)
+}
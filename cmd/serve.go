@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"cloud-scanner/server"
+	"github.com/urfave/cli/v2"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// serveCommand 启动 HTTP 服务，通过接口提交和查询扫描任务
+func (app *application) serveCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "serve",
+		Usage: "Run an HTTP API server to submit, list, stream and cancel scans",
+		Description: "Global flags and the config file set the parameters shared by all scans, such as rate, backends, database and alerts.\n" +
+			"Each request picks its targets, an optional profile and labels:\n" +
+			"  POST /api/v1/scans                {\"targets\": [\"1.2.3.0/24\"], \"profile\": \"quick-top-1000\", \"labels\": {\"owner\": \"web\"}}\n" +
+			"  GET  /api/v1/scans                list scans and their engine status\n" +
+			"  GET  /api/v1/scans/<id>           get a scan\n" +
+			"  GET  /api/v1/scans/<id>/results   stream results as JSON lines until the scan ends, ?follow=false to return saved results only\n" +
+			"  POST /api/v1/scans/<id>/cancel    cancel a queued or running scan\n" +
+			"Scans and their results are kept in the data dir, unfinished scans are resumed after restart.\n" +
+			"All running scans share --masscanRate, --rate-per-24 and provider_rates with both discovery backends, the rate of a profile only caps its own scans.\n" +
+			"Alerts are deduplicated across all scans with one alerts.dedup_file.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "listen",
+				Usage: "Address to listen on",
+				Value: "127.0.0.1:8080",
+			},
+			&cli.StringFlag{
+				Name:  "data-dir",
+				Usage: "Directory to keep scans, their results and progress",
+				Value: "cloud_scanner_data",
+			},
+			&cli.IntFlag{
+				Name:  "max-scans",
+				Usage: "Max number of scans running at the same time, others wait in the queue",
+				Value: 2,
+			},
+			&cli.StringFlag{
+				Name:    "token",
+				Usage:   "Require clients to send this bearer token in the Authorization header",
+				EnvVars: []string{"CLOUD_SCANNER_API_TOKEN"},
+			},
+		},
+		Action: app.serveAction,
+	}
+}
+
+func (app *application) serveAction(c *cli.Context) error {
+	// 全局参数和配置文件是所有扫描共用的参数
+	if err := app.loadConfig(c); err != nil {
+		return err
+	}
+
+	listen := c.String("listen")
+	token := c.String("token")
+	if host, _, err := net.SplitHostPort(listen); err == nil && token == "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			app.logger.Warnf("Listening on %s without --token, anyone who can reach it can start scans.", listen)
+		}
+	}
+
+	srv, err := server.New(server.Options{
+		Config:   app.config,
+		Profiles: app.profiles,
+		Logger:   app.logger,
+		DataDir:  c.String("data-dir"),
+		MaxScans: c.Int("max-scans"),
+		Token:    token,
+	})
+	if err != nil {
+		return err
+	}
+
+	// 收到 SIGINT/SIGTERM 之后打断正在运行的扫描，保存进度之后退出，重启后继续扫描
+	ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// 再按一次 Ctrl-C 可以强制退出
+		stop()
+	}()
+	return srv.Run(ctx, listen)
+}
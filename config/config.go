@@ -1,20 +1,153 @@
 package config
 
+import "time"
+
 type AppConfig struct {
 	Target    string
 	InputFile string
 
+	// 云厂商导出的资产清单，格式为 [provider:]file，地址的元数据会带到结果中
+	Inventory []string
+
+	// 所有目标共同的元数据，输入文件中每行的元数据和资产清单中的标签优先
+	Labels map[string]string
+
+	Exclude         string
+	ExcludeFile     string
+	ExcludeReserved bool
+
 	MasscanWorkerCount uint
 	NmapWorkerCount    uint
 	MasscanRate        uint
 
-	OutputFile string
+	// 每个 /24（IPv6 是 /64）以及每个云厂商地址段的速率上限，0 表示不限制
+	RatePerSubnet uint
+	ProviderRates []ProviderRate
+
+	// 发现开放端口的后端，masscan 或者 connect
+	// connect 后端的并发数、每个端口的超时时间和重试次数
+	DiscoveryBackend   string
+	ConnectConcurrency uint
+	ConnectTimeout     time.Duration
+	ConnectRetries     uint
+
+	// 一次 masscan 最多扫描的目标数量，1 表示每个目标单独启动一个 masscan
+	MasscanBatchSize uint
+
+	// 一个 host 的开放端口数量达到阈值时，连接几个随机的端口确认是不是所有端口都会响应
+	// 确认是 tarpit 之后只抽样一部分端口交给 nmap，阈值为 0 表示不检测
+	TarpitThreshold uint
+	TarpitProbes    uint
+	TarpitSample    uint
+
+	// nmap-services 的路径，top-N 端口按照其中的频率排序
+	NmapServicesFile string
+
+	// 识别服务的后端，nmap 或者 builtin
+	// builtin 后端使用的 nmap-service-probes 以及每个 Probe 最多等待的时间
+	Fingerprint        string
+	ServiceProbesFile  string
+	FingerprintTimeout time.Duration
+
+	// 端口范围，nmap 的 -T 和 --version-intensity 参数，小于 0 表示不传
+	Ports            string
+	NmapTiming       int
+	VersionIntensity int
+
+	// masscan 和 nmap 每次执行的超时时间，为 0 时不限制
+	// 失败之后的重试次数，以及第一次重试前等待的时间，之后每次翻倍
+	MasscanTimeout time.Duration
+	NmapTimeout    time.Duration
+	Retries        uint
+	RetryBackoff   time.Duration
+
+	// 额外传给 masscan 和 nmap 的参数
+	MasscanExtraArgs []string
+	NmapExtraArgs    []string
+
+	// 配置文件以及使用的扫描配置
+	ConfigFile string
+	Profile    string
+
+	OutputFile   string
+	OutputFormat string
+
+	// 单独保存 masscan 的原始结果，为空时不保存
+	MasscanOutputFile string
+
+	// 记录重试之后仍然失败的目标，可以作为 --input 重新扫描
+	FailedOutputFile string
+
+	// 扫描结束后对比的基线，可以是之前的结果文件或者数据库，以及差异的输出文件
+	// 数据库的 DSN 中可能有密码，同样不能保存
+	Baseline       string `json:"-"`
+	DiffOutputFile string
+
+	// 扫描结束后生成的报告，格式由扩展名决定：.html 或者 .md
+	ReportFiles []string
+
+	// 结果入库的数据库 DSN，为空时不入库
+	// DSN 中可能有密码，不能跟着扫描参数一起保存
+	Database string `json:"-"`
+
+	// 发现新的或者有风险的端口时发送告警，webhook 的 URL 中有 token，不能保存
+	Alerts AlertConfig `json:"-"`
 
 	Debug bool
+
+	// 输出扫描进度的间隔，为 0 时不输出
+	ProgressInterval time.Duration
+
+	// 记录扫描进度的状态文件，以及继续扫描时使用的状态文件
+	StateFile  string
+	ResumeFile string
+
+	// 本次扫描的 ID 和开始时间，启动时生成，会写到结果中
+	ScanID    string
+	StartedAt time.Time
 }
 
-var appConfig AppConfig
+// ProviderRate 一个云厂商的地址段以及发往这些地址的速率上限
+type ProviderRate struct {
+	Name  string   `yaml:"name" toml:"name"`
+	CIDRs []string `yaml:"cidrs" toml:"cidrs"`
+	Rate  uint     `yaml:"rate" toml:"rate"`
+}
+
+// AlertConfig 告警规则、接收告警的 webhook 以及批量发送、重试和去重的参数
+type AlertConfig struct {
+	Rules    []AlertRule    `yaml:"rules" toml:"rules"`
+	Webhooks []AlertWebhook `yaml:"webhooks" toml:"webhooks"`
+
+	// 攒够 batch_size 条或者距离上次发送超过 batch_interval 时发送一次
+	BatchSize     uint   `yaml:"batch_size" toml:"batch_size"`
+	BatchInterval string `yaml:"batch_interval" toml:"batch_interval"`
+
+	// 发送失败之后的重试次数
+	Retries uint `yaml:"retries" toml:"retries"`
+
+	// 同一个告警在 dedup_window 内只发送一次，dedup_file 不为空时跨扫描去重
+	DedupFile   string `yaml:"dedup_file" toml:"dedup_file"`
+	DedupWindow string `yaml:"dedup_window" toml:"dedup_window"`
+}
+
+// AlertRule 一条告警规则，设置了的条件都满足时才告警
+// ports 使用和 --ports 一样的格式，service、product 和 banner 是正则表达式
+// new_only 表示只对基线中没有的端口告警，需要同时设置 --baseline
+type AlertRule struct {
+	Name     string `yaml:"name" toml:"name"`
+	Severity string `yaml:"severity" toml:"severity"`
+	Ports    string `yaml:"ports" toml:"ports"`
+	Service  string `yaml:"service" toml:"service"`
+	Product  string `yaml:"product" toml:"product"`
+	Banner   string `yaml:"banner" toml:"banner"`
+	NewOnly  bool   `yaml:"new_only" toml:"new_only"`
+}
 
-func GetAppConfig() *AppConfig {
-	return &appConfig
+// AlertWebhook 接收告警的地址，type 是 generic、slack、feishu 或者 dingtalk
+// secret 用于飞书和钉钉的签名校验，generic 会用它签名请求体
+type AlertWebhook struct {
+	Type   string `yaml:"type" toml:"type"`
+	URL    string `yaml:"url" toml:"url"`
+	Secret string `yaml:"secret" toml:"secret"`
 }
@@ -6,6 +6,36 @@ const (
 	EngineInit    EngineStatus = 0
 	EngineRunning EngineStatus = 1
 	EngineStop    EngineStatus = 2
+
+	// EngineBusy worker 正在处理任务，EngineRunning 表示 worker 在等待任务
+	EngineBusy EngineStatus = 3
 )
 
+func (s EngineStatus) String() string {
+	switch s {
+	case EngineInit:
+		return "init"
+	case EngineRunning:
+		return "running"
+	case EngineStop:
+		return "stopped"
+	case EngineBusy:
+		return "busy"
+	}
+	return "unknown"
+}
+
+// MarshalText 在 JSON 中输出状态的名字而不是数字
+func (s EngineStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
 const TempDir string = "cloud_scanner_tmp"
+
+// 结果文件的输出格式
+const (
+	OutputFormatText  string = "txt"
+	OutputFormatJSONL string = "jsonl"
+	OutputFormatJSON  string = "json"
+	OutputFormatCSV   string = "csv"
+)
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileConfig 配置文件的内容，字段都是指针，用来区分没有设置和设置成零值
+type FileConfig struct {
+	Target          *string           `yaml:"target" toml:"target"`
+	InputFile       *string           `yaml:"input" toml:"input"`
+	Inventory       []string          `yaml:"inventory" toml:"inventory"`
+	Labels          map[string]string `yaml:"labels" toml:"labels"`
+	Exclude         *string           `yaml:"exclude" toml:"exclude"`
+	ExcludeFile     *string           `yaml:"exclude_file" toml:"exclude_file"`
+	ExcludeReserved *bool             `yaml:"exclude_reserved" toml:"exclude_reserved"`
+
+	MasscanWorkerCount *uint    `yaml:"masscan_worker_count" toml:"masscan_worker_count"`
+	NmapWorkerCount    *uint    `yaml:"nmap_worker_count" toml:"nmap_worker_count"`
+	MasscanRate        *uint    `yaml:"masscan_rate" toml:"masscan_rate"`
+	MasscanBatchSize   *uint    `yaml:"masscan_batch" toml:"masscan_batch"`
+	Backend            *string  `yaml:"backend" toml:"backend"`
+	ConnectConcurrency *uint    `yaml:"connect_concurrency" toml:"connect_concurrency"`
+	ConnectTimeout     *string  `yaml:"connect_timeout" toml:"connect_timeout"`
+	ConnectRetries     *uint    `yaml:"connect_retries" toml:"connect_retries"`
+	RatePerSubnet      *uint    `yaml:"rate_per_24" toml:"rate_per_24"`
+	TarpitThreshold    *uint    `yaml:"tarpit_threshold" toml:"tarpit_threshold"`
+	TarpitProbes       *uint    `yaml:"tarpit_probes" toml:"tarpit_probes"`
+	TarpitSample       *uint    `yaml:"tarpit_sample" toml:"tarpit_sample"`
+	Ports              *string  `yaml:"ports" toml:"ports"`
+	NmapServicesFile   *string  `yaml:"nmap_services" toml:"nmap_services"`
+	Fingerprint        *string  `yaml:"fingerprint" toml:"fingerprint"`
+	ServiceProbesFile  *string  `yaml:"service_probes" toml:"service_probes"`
+	FingerprintTimeout *string  `yaml:"fingerprint_timeout" toml:"fingerprint_timeout"`
+	NmapTiming         *int     `yaml:"nmap_timing" toml:"nmap_timing"`
+	VersionIntensity   *int     `yaml:"version_intensity" toml:"version_intensity"`
+	MasscanTimeout     *string  `yaml:"masscan_timeout" toml:"masscan_timeout"`
+	NmapTimeout        *string  `yaml:"nmap_timeout" toml:"nmap_timeout"`
+	Retries            *uint    `yaml:"retries" toml:"retries"`
+	RetryBackoff       *string  `yaml:"retry_backoff" toml:"retry_backoff"`
+	MasscanArgs        []string `yaml:"masscan_args" toml:"masscan_args"`
+	NmapArgs           []string `yaml:"nmap_args" toml:"nmap_args"`
+
+	OutputFile        *string  `yaml:"output" toml:"output"`
+	OutputFormat      *string  `yaml:"output_format" toml:"output_format"`
+	MasscanOutputFile *string  `yaml:"masscan_output" toml:"masscan_output"`
+	FailedOutputFile  *string  `yaml:"failed_output" toml:"failed_output"`
+	Baseline          *string  `yaml:"baseline" toml:"baseline"`
+	DiffOutputFile    *string  `yaml:"diff_output" toml:"diff_output"`
+	Reports           []string `yaml:"reports" toml:"reports"`
+	Database          *string  `yaml:"database" toml:"database"`
+	StateFile         *string  `yaml:"state" toml:"state"`
+
+	Debug *bool `yaml:"debug" toml:"debug"`
+
+	// 每个云厂商地址段的速率上限
+	ProviderRates []ProviderRate `yaml:"provider_rates" toml:"provider_rates"`
+
+	// 告警规则和接收告警的 webhook
+	Alerts *AlertConfig `yaml:"alerts" toml:"alerts"`
+
+	// 默认使用的扫描配置
+	Profile *string `yaml:"profile" toml:"profile"`
+
+	// 自定义的扫描配置
+	Profiles map[string]ScanProfile `yaml:"profiles" toml:"profiles"`
+}
+
+// LoadFile 读取配置文件，根据扩展名判断是 YAML 还是 TOML
+// 配置文件中出现未知的字段时报错，避免写错了字段名却没有发现
+func LoadFile(filename string) (*FileConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read config file %s failed: %w", filename, err)
+	}
+
+	var fileConfig FileConfig
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&fileConfig); err != nil {
+			return nil, fmt.Errorf("parse config file %s failed: %w", filename, err)
+		}
+	case ".toml":
+		metadata, err := toml.Decode(string(data), &fileConfig)
+		if err != nil {
+			return nil, fmt.Errorf("parse config file %s failed: %w", filename, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("parse config file %s failed: unknown fields %v", filename, undecoded)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file %s, must be .yaml, .yml or .toml", filename)
+	}
+	return &fileConfig, nil
+}
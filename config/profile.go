@@ -0,0 +1,90 @@
+package config
+
+// ScanProfile 一组预先定义好的扫描参数，通过 --profile 选择
+// 没有设置的字段保持原来的值
+type ScanProfile struct {
+	// 端口范围，格式和 --ports 一样
+	Ports string `yaml:"ports" toml:"ports"`
+
+	// masscan 的发包速率
+	Rate uint `yaml:"rate" toml:"rate"`
+
+	// nmap 的 -T 参数，0 到 5
+	NmapTiming *int `yaml:"nmap_timing" toml:"nmap_timing"`
+
+	// nmap 的 --version-intensity 参数，0 到 9
+	VersionIntensity *int `yaml:"version_intensity" toml:"version_intensity"`
+
+	// 额外传给 masscan 和 nmap 的参数
+	MasscanArgs []string `yaml:"masscan_args" toml:"masscan_args"`
+	NmapArgs    []string `yaml:"nmap_args" toml:"nmap_args"`
+}
+
+// Apply 把扫描配置中设置了的字段写到 appConfig 中
+func (p ScanProfile) Apply(appConfig *AppConfig) {
+	if p.Ports != "" {
+		appConfig.Ports = p.Ports
+	}
+	if p.Rate != 0 {
+		appConfig.MasscanRate = p.Rate
+	}
+	if p.NmapTiming != nil {
+		appConfig.NmapTiming = *p.NmapTiming
+	}
+	if p.VersionIntensity != nil {
+		appConfig.VersionIntensity = *p.VersionIntensity
+	}
+	if p.MasscanArgs != nil {
+		appConfig.MasscanExtraArgs = p.MasscanArgs
+	}
+	if p.NmapArgs != nil {
+		appConfig.NmapExtraArgs = p.NmapArgs
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+// builtinProfiles 内置的扫描配置，配置文件中同名的配置会覆盖内置的配置
+var builtinProfiles = map[string]ScanProfile{
+	// 最常见的 1000 个 TCP 端口，轻量的服务识别
+	"quick-top-1000": {
+		Ports:            "top-1000",
+		Rate:             5000,
+		NmapTiming:       intPtr(4),
+		VersionIntensity: intPtr(2),
+	},
+	// 全部 TCP 端口，完整的服务识别
+	"full-tcp": {
+		Ports:            "1-65535",
+		Rate:             2000,
+		NmapTiming:       intPtr(4),
+		VersionIntensity: intPtr(7),
+	},
+	// 常见的 UDP 端口
+	"udp-common": {
+		Ports:            "U:53,U:67,U:69,U:111,U:123,U:137,U:161,U:500,U:514,U:520,U:623,U:1434,U:1900,U:4500,U:5353,U:11211",
+		Rate:             1000,
+		NmapTiming:       intPtr(4),
+		VersionIntensity: intPtr(2),
+	},
+}
+
+// GetProfile 根据名字查找扫描配置，优先使用配置文件中定义的
+func GetProfile(name string, fileProfiles map[string]ScanProfile) (ScanProfile, bool) {
+	if profile, ok := fileProfiles[name]; ok {
+		return profile, true
+	}
+	profile, ok := builtinProfiles[name]
+	return profile, ok
+}
+
+// ProfileNames 返回所有内置的扫描配置名字
+func ProfileNames() []string {
+	names := make([]string, 0, len(builtinProfiles))
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	return names
+}
@@ -12,18 +12,9 @@ import (
 	"time"
 )
 
-var logger zap.Logger
-var sugarLogger zap.SugaredLogger
-
-func GetLogger() *zap.Logger {
-	return &logger
-}
-
-func GetSugar() *zap.SugaredLogger {
-	return &sugarLogger
-}
-
-func InitLogger(debug bool) {
+// NewLogger 创建命令行使用的日志，同时输出到标准输出和可执行文件旁边的 log.log
+// 作为库使用时由调用方传入自己的日志，不需要调用这个函数
+func NewLogger(debug bool) *zap.SugaredLogger {
 
 	// 获取可执行文件的路径，默认将日志文件放到可执行文件同级
 	// 如果有其他需求再修改这部分代码
@@ -66,8 +57,5 @@ func InitLogger(debug bool) {
 	syncer := zapcore.NewMultiWriteSyncer(zapcore.AddSync(lumberjackLogger), zapcore.AddSync(os.Stdout))
 	core := zapcore.NewCore(encoder, syncer, zapcore.DebugLevel)
 
-	l := zap.New(core, zap.AddCaller())
-
-	logger = *l
-	sugarLogger = *l.Sugar()
+	return zap.New(core, zap.AddCaller()).Sugar()
 }
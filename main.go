@@ -2,15 +2,13 @@ package main
 
 import (
 	"cloud-scanner/cmd"
-	"cloud-scanner/logging"
 	"os"
 )
 
 func main() {
 
+	// 错误已经由 RunApp 写到日志中了
 	if err := cmd.RunApp(); err != nil {
-		logger := logging.GetSugar()
-		logger.Errorf("Error when run app. Error: %+v", err)
 		os.Exit(1)
 	}
 
@@ -0,0 +1,69 @@
+package scanner
+
+import (
+	"cloud-scanner/config"
+	"cloud-scanner/config/constant"
+	"cloud-scanner/service"
+	"go.uber.org/zap"
+	"runtime"
+	"time"
+)
+
+// Options 构造 Scanner 的参数
+type Options struct {
+	// 扫描参数，一般从 DefaultConfig 开始修改
+	// Target、InputFile 和 Inventory 至少要设置一个，OutputFile、Database 等为空时不写对应的存储
+	Config config.AppConfig
+
+	// 日志，为 nil 时不输出日志
+	Logger *zap.SugaredLogger
+
+	// 发现开放端口的后端，为 nil 时根据 Config.DiscoveryBackend 创建 masscan 或者 connect 后端
+	Discovery service.DiscoveryBackend
+
+	// 识别服务的后端，为 nil 时根据 Config.Fingerprint 创建 nmap 或者 builtin 后端
+	Fingerprint service.FingerprintBackend
+
+	// masscan 的发包速率或者 connect 后端每秒的连接数，为 nil 时根据 Config 单独创建一个
+	// 同时运行多个扫描时传入同一个 RateBudget，--masscanRate、--rate-per-24 和 provider_rates 对所有扫描一起生效，
+	// 这时 Config 中的这几个参数不再起作用
+	RateBudget *service.RateBudget
+
+	// 告警的去重记录，为 nil 时根据 Config.Alerts 单独创建一个
+	// 同时运行多个扫描时传入同一个 AlertDedup，避免重复告警以及互相覆盖 dedup_file
+	AlertDedup *service.AlertDedup
+
+	// 额外的结果存储，和 Config 中配置的文件、数据库、告警一起写入
+	// Run 成功之后由 Scanner 负责关闭
+	Sinks []service.ResultSink
+}
+
+// DefaultConfig 返回和命令行参数默认值一样的扫描参数
+// 作为库使用时默认不输出扫描进度，需要时设置 ProgressInterval
+func DefaultConfig() config.AppConfig {
+	return config.AppConfig{
+		ExcludeReserved:    true,
+		MasscanWorkerCount: uint(runtime.NumCPU()),
+		NmapWorkerCount:    2 * uint(runtime.NumCPU()),
+		MasscanRate:        2000,
+		DiscoveryBackend:   service.BackendMasscan,
+		ConnectConcurrency: 500,
+		ConnectTimeout:     time.Second,
+		ConnectRetries:     1,
+		MasscanBatchSize:   1,
+		TarpitThreshold:    200,
+		TarpitProbes:       3,
+		TarpitSample:       10,
+		NmapServicesFile:   "/usr/share/nmap/nmap-services",
+		Fingerprint:        service.FingerprintNmap,
+		ServiceProbesFile:  "/usr/share/nmap/nmap-service-probes",
+		FingerprintTimeout: 2 * time.Second,
+		Ports:              "-",
+		NmapTiming:         5,
+		VersionIntensity:   -1,
+		NmapTimeout:        30 * time.Minute,
+		Retries:            1,
+		RetryBackoff:       10 * time.Second,
+		OutputFormat:       constant.OutputFormatText,
+	}
+}
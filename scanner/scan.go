@@ -0,0 +1,166 @@
+package scanner
+
+import (
+	"cloud-scanner/config/constant"
+	"cloud-scanner/service"
+	"sync"
+	"time"
+)
+
+// Scan 一次正在运行的扫描
+// 结果流必须一直读到关闭为止，否则 SaverEngine 会阻塞，整个扫描都会停下来
+type Scan struct {
+	scanner *Scanner
+	results chan service.OutputRecord
+	done    chan struct{}
+	summary *Summary
+
+	mainWg  sync.WaitGroup
+	builder *service.TaskBuilder
+	masscan *service.MasscanEngine
+	nmap    *service.NmapEngine
+	saver   *service.SaverEngine
+
+	stats        *service.ScanStats
+	checkpoint   *service.Checkpoint
+	masscanSaver *service.MasscanSaver
+	failures     *service.FailureRecorder
+}
+
+// Counters 扫描的计数
+type Counters struct {
+	TargetsQueued uint64 `json:"targets_queued"`
+	MasscanDone   uint64 `json:"masscan_done"`
+	MasscanFailed uint64 `json:"masscan_failed"`
+	OpenPorts     uint64 `json:"open_ports"`
+	Tarpits       uint64 `json:"tarpits"`
+	NmapQueued    uint64 `json:"nmap_queued"`
+	NmapDone      uint64 `json:"nmap_done"`
+	NmapFailed    uint64 `json:"nmap_failed"`
+	ResultsSaved  uint64 `json:"results_saved"`
+}
+
+// Status 扫描中各个引擎的状态，masscan 和 nmap 每个 worker 一个
+type Status struct {
+	ScanID  string                  `json:"scan_id"`
+	Builder constant.EngineStatus   `json:"builder"`
+	Masscan []constant.EngineStatus `json:"masscan"`
+	Nmap    []constant.EngineStatus `json:"nmap"`
+	Saver   constant.EngineStatus   `json:"saver"`
+	Done    bool                    `json:"done"`
+	Counters
+}
+
+// Summary 扫描结束后的汇总，列出扫描了什么，没有扫描什么
+type Summary struct {
+	ScanID     string    `json:"scan_id"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Counters
+
+	// 不在扫描范围内被跳过的地址
+	SkippedCount uint64                 `json:"skipped_count"`
+	Skipped      []service.SkippedRange `json:"skipped,omitempty"`
+
+	// 收到退出信号时读到的输入位置，为空表示所有的输入都处理完了
+	StoppedAt string `json:"stopped_at,omitempty"`
+
+	// 进了队列但是没有经过 masscan 扫描，以及没有经过 nmap 识别的目标
+	NotScanned       []service.SkippedRange `json:"not_scanned,omitempty"`
+	NotFingerprinted []service.SkippedRange `json:"not_fingerprinted,omitempty"`
+
+	// 重试之后仍然失败的任务数量，记录在 FailedOutputFile 中
+	FailedJobs int `json:"failed_jobs"`
+
+	// 扫描是否被 ctx 取消
+	Interrupted bool `json:"interrupted"`
+}
+
+// ID 返回扫描 ID
+func (s *Scan) ID() string {
+	return s.scanner.config.ScanID
+}
+
+// Results 返回结果流，每条结果都已经写到了所有的存储中，扫描结束后关闭
+func (s *Scan) Results() <-chan service.OutputRecord {
+	return s.results
+}
+
+// Done 扫描结束后关闭
+func (s *Scan) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait 等待扫描结束，返回汇总信息
+// 调用方需要在另一个协程中读取 Results()，或者在读完结果流之后再调用
+func (s *Scan) Wait() *Summary {
+	<-s.done
+	return s.summary
+}
+
+// Status 返回各个引擎当前的状态和计数
+func (s *Scan) Status() Status {
+	status := Status{
+		ScanID:   s.ID(),
+		Builder:  s.builder.GetStatus(),
+		Masscan:  s.masscan.GetStatus(),
+		Nmap:     s.nmap.GetStatus(),
+		Saver:    s.saver.GetStatus(),
+		Counters: s.counters(),
+	}
+	select {
+	case <-s.done:
+		status.Done = true
+	default:
+	}
+	return status
+}
+
+func (s *Scan) counters() Counters {
+	return Counters{
+		TargetsQueued: s.stats.TargetsQueued.Load(),
+		MasscanDone:   s.stats.MasscanDone.Load(),
+		MasscanFailed: s.stats.MasscanFailed.Load(),
+		OpenPorts:     s.stats.OpenPorts.Load(),
+		Tarpits:       s.stats.Tarpits.Load(),
+		NmapQueued:    s.stats.NmapQueued.Load(),
+		NmapDone:      s.stats.NmapDone.Load(),
+		NmapFailed:    s.stats.NmapFailed.Load(),
+		ResultsSaved:  s.stats.ResultsSaved.Load(),
+	}
+}
+
+// finish 所有引擎结束之后关闭文件，生成汇总
+func (s *Scan) finish(interrupted bool) {
+	logger := s.scanner.env.Logger
+	defer close(s.done)
+
+	if err := s.checkpoint.Close(); err != nil {
+		logger.Warnf("Error when closing state file, error: %+v", err)
+	}
+	if s.masscanSaver != nil {
+		if err := s.masscanSaver.Close(); err != nil {
+			logger.Warnf("Error when closing masscan output file, error: %+v", err)
+		}
+	}
+	if err := s.failures.Close(); err != nil {
+		logger.Warnf("Error when closing failed jobs file, error: %+v", err)
+	}
+
+	releaseTempDir()
+
+	s.summary = &Summary{
+		ScanID:           s.ID(),
+		StartedAt:        s.scanner.config.StartedAt,
+		FinishedAt:       time.Now(),
+		Counters:         s.counters(),
+		SkippedCount:     s.builder.SkippedCount(),
+		Skipped:          s.builder.Skipped(),
+		StoppedAt:        s.builder.StoppedAt(),
+		NotScanned:       s.stats.NotScanned(),
+		NotFingerprinted: s.stats.NotFingerprinted(),
+		FailedJobs:       s.failures.Count(),
+		Interrupted:      interrupted,
+	}
+	logger.Debugf("Scan %s finished.", s.ID())
+}
@@ -0,0 +1,398 @@
+// Package scanner 把 masscan/nmap 扫描流程封装成可以嵌入其他 Go 程序的库
+//
+//	s, err := scanner.New(scanner.Options{Config: cfg, Logger: logger})
+//	scan, err := s.Run(ctx)
+//	for record := range scan.Results() {
+//		...
+//	}
+//	summary := scan.Wait()
+//
+// 所有的状态都在 Scanner 中，同一个进程中可以同时运行多个扫描
+package scanner
+
+import (
+	"cloud-scanner/config"
+	"cloud-scanner/config/constant"
+	"cloud-scanner/service"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 结果流的缓冲区大小，调用方读得慢的时候 SaverEngine 会在这里等待
+const resultsBuffer = 64
+
+// Scanner 一次扫描，由 Options 构造，只能运行一次
+type Scanner struct {
+	opts   Options
+	config config.AppConfig
+	env    *service.Env
+
+	filter      *service.TargetFilter
+	ports       *service.PortSpec
+	resumeState *service.ResumeState
+	baseline    []service.OutputRecord
+
+	started atomic.Bool
+}
+
+// CheckConfig 检查扫描参数的取值范围，New 会调用它，应用扫描配置之后的参数也需要检查
+func CheckConfig(appConfig *config.AppConfig) error {
+	if appConfig.MasscanBatchSize == 0 {
+		return fmt.Errorf("masscan batch size must be at least 1")
+	}
+	// 阈值不为 0 时抽样数量为 0 的话，tarpit host 的端口都不会交给 nmap
+	if appConfig.TarpitThreshold > 0 && appConfig.TarpitSample == 0 {
+		return fmt.Errorf("tarpit sample must be at least 1")
+	}
+	if appConfig.NmapTiming < 0 || appConfig.NmapTiming > 5 {
+		return fmt.Errorf("nmap timing must be between 0 and 5, got %d", appConfig.NmapTiming)
+	}
+	if appConfig.VersionIntensity > 9 {
+		return fmt.Errorf("version intensity must be between 0 and 9, got %d", appConfig.VersionIntensity)
+	}
+	return nil
+}
+
+// New 检查参数并读取扫描前需要的数据：排除列表、端口范围、继续扫描的进度和基线
+// 参数有问题时直接返回错误，不要扫到一半才发现
+func New(opts Options) (*Scanner, error) {
+	s := &Scanner{opts: opts, config: opts.Config}
+	s.env = service.NewEnv(&s.config, opts.Logger)
+	appConfig, logger := &s.config, s.env.Logger
+
+	// 检查参数是否有冲突
+	if appConfig.InputFile != "" && appConfig.Target != "" {
+		return nil, fmt.Errorf("the 'target' and 'input' parameters cannot be set at the same time")
+	}
+	if appConfig.InputFile == "" && appConfig.Target == "" && len(appConfig.Inventory) == 0 {
+		return nil, fmt.Errorf("the 'target', 'input' and 'inventory' cannot be empty at the same time")
+	}
+	if appConfig.OutputFile != "" {
+		switch appConfig.OutputFormat {
+		case constant.OutputFormatText, constant.OutputFormatJSONL, constant.OutputFormatJSON, constant.OutputFormatCSV:
+		default:
+			return nil, fmt.Errorf("unknown output format: %s", appConfig.OutputFormat)
+		}
+	}
+	if err := CheckConfig(appConfig); err != nil {
+		return nil, err
+	}
+
+	// 继续扫描时沿用之前的扫描 ID，数据库中的结果会合并到同一次扫描中
+	if appConfig.ResumeFile != "" {
+		resumeState, err := service.LoadResumeState(logger, appConfig.ResumeFile)
+		if err != nil {
+			logger.Errorf("Error when loading state file, error: %+v", err)
+			return nil, err
+		}
+		s.resumeState = resumeState
+		appConfig.ScanID = resumeState.ScanID
+		if appConfig.StateFile == "" {
+			appConfig.StateFile = appConfig.ResumeFile
+		}
+	}
+	if appConfig.ScanID == "" {
+		appConfig.ScanID = uuid.NewString()
+	}
+
+	// 排除列表有问题的话直接退出，不能扫到范围之外的地址
+	filter, err := service.NewTargetFilter(s.env)
+	if err != nil {
+		logger.Errorf("Error when loading exclude list, error: %+v", err)
+		return nil, err
+	}
+	s.filter = filter
+
+	// 端口范围写错了直接退出
+	ports, err := service.ParsePortSpec(appConfig.Ports, appConfig.NmapServicesFile)
+	if err != nil {
+		logger.Errorf("Error when parsing ports, error: %+v", err)
+		return nil, err
+	}
+	if n, err := ports.FallbackTopPorts(); n > 0 {
+		logger.Warnf("Cannot load nmap-services, use masscan --top-ports %d instead. error: %v", n, err)
+		logger.Warnf("Ports from masscan --top-ports are unknown, only explicitly listed ports are treated as scanned when comparing with the baseline.")
+	}
+	logger.Debugf("masscan port args: %v", ports.MasscanArgs())
+	s.ports = ports
+
+	// 基线读不出来的话直接退出，不要扫完了才发现没法对比
+	if appConfig.Baseline != "" {
+		s.baseline, err = service.LoadResults(logger, appConfig.Baseline, appConfig.ScanID)
+		if err != nil {
+			logger.Errorf("Error when loading baseline, error: %+v", err)
+			return nil, err
+		}
+		logger.Infof("Loaded %d baseline results from %s", len(s.baseline), service.RedactSource(appConfig.Baseline))
+	}
+	return s, nil
+}
+
+// Config 返回扫描实际使用的参数，包括生成的扫描 ID 和开始时间
+func (s *Scanner) Config() config.AppConfig {
+	return s.config
+}
+
+// Ports 返回解析后的端口范围
+func (s *Scanner) Ports() *service.PortSpec {
+	return s.ports
+}
+
+// Baseline 返回读取的基线结果，没有设置基线时为 nil
+func (s *Scanner) Baseline() []service.OutputRecord {
+	return s.baseline
+}
+
+// Run 启动所有的引擎开始扫描，不等待扫描结束
+// ctx 被取消后不再扫描新的目标，已经得到的结果仍然会写完，通过返回的 Scan 读取结果和等待结束
+func (s *Scanner) Run(ctx context.Context) (*Scan, error) {
+	if !s.started.CompareAndSwap(false, true) {
+		return nil, fmt.Errorf("scanner %s is already started", s.config.ScanID)
+	}
+	appConfig, logger := &s.config, s.env.Logger
+	appConfig.StartedAt = time.Now()
+	logger.Infof("Scan ID: %s", appConfig.ScanID)
+	// 数据库的 DSN 和 webhook 中有密码，按照 JSON 输出时会跳过这些字段
+	if data, err := json.Marshal(appConfig); err == nil {
+		logger.Debugf("appConfig: %s", data)
+	}
+	resume := s.resumeState != nil
+
+	// 启动失败时关闭已经打开的文件和连接
+	acquireTempDir(s.env)
+	closers := []func(){releaseTempDir}
+	fail := func(err error) (*Scan, error) {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+		return nil, err
+	}
+
+	// masscan 引擎的任务队列，可以设置的大一点，批量扫描时至少要能放下一批
+	masscanJobCap := 64
+	if batch := int(appConfig.MasscanBatchSize); batch > masscanJobCap {
+		masscanJobCap = batch
+	}
+	masscanJobChan := make(chan service.Target, masscanJobCap)
+	nmapJobChan := make(chan service.NmapJob, 64)
+	resultsChan := make(chan service.PortResult, 4)
+
+	// 发现开放端口的后端，所有 worker 共享同一个速率，masscan 和 connect 后端都从 RateBudget 中分配速率
+	// 扫描结束之后从共享的 RateBudget 中移除这个扫描的任务队列
+	detachRateBudget := func() {}
+	backend := s.opts.Discovery
+	if backend == nil {
+		rateBudget := s.opts.RateBudget
+		if rateBudget == nil {
+			var err error
+			if rateBudget, err = service.NewRateBudget(s.env, nil); err != nil {
+				logger.Errorf("Error when creating rate budget, error: %+v", err)
+				return fail(err)
+			}
+		}
+		switch appConfig.DiscoveryBackend {
+		case service.BackendMasscan:
+			backend = service.NewMasscanBackend(s.env, s.ports, rateBudget)
+		case service.BackendConnect:
+			var err error
+			backend, err = service.NewConnectBackend(s.env, s.ports, rateBudget)
+			if err != nil {
+				logger.Errorf("Error when creating connect backend, error: %+v", err)
+				return fail(err)
+			}
+		default:
+			return fail(fmt.Errorf("unknown backend: %s", appConfig.DiscoveryBackend))
+		}
+		detach := rateBudget.Attach(s.env, &masscanJobChan)
+		closers = append(closers, detach)
+		detachRateBudget = detach
+	}
+
+	// 识别服务的后端，使用 builtin 时不需要安装 nmap
+	fingerprintBackend := s.opts.Fingerprint
+	if fingerprintBackend == nil {
+		var err error
+		switch appConfig.Fingerprint {
+		case service.FingerprintNmap:
+			fingerprintBackend, err = service.NewNmapBackend(s.env)
+		case service.FingerprintBuiltin:
+			fingerprintBackend, err = service.NewBuiltinBackend(s.env, appConfig.ServiceProbesFile)
+		default:
+			err = fmt.Errorf("unknown fingerprint backend: %s", appConfig.Fingerprint)
+		}
+		if err != nil {
+			logger.Errorf("Error when creating fingerprint backend, error: %+v", err)
+			return fail(err)
+		}
+	}
+
+	// 记录扫描进度，所有引擎结束之后再关闭
+	checkpoint, err := service.NewCheckpoint(s.env, appConfig.StateFile, resume)
+	if err != nil {
+		logger.Errorf("Error when creating state file, error: %+v", err)
+		return fail(err)
+	}
+	closers = append(closers, func() { _ = checkpoint.Close() })
+	if appConfig.StateFile != "" {
+		logger.Infof("Scan progress is recorded in %s, use --resume to continue if interrupted.", appConfig.StateFile)
+	}
+
+	// 结果的存储后端，文件、数据库和告警都是可选的，最后一个是返回给调用方的结果流
+	// 交给 SaverEngine 之后由它负责关闭
+	sinks := make([]service.ResultSink, 0, 4+len(s.opts.Sinks))
+	closeSinks := func() {
+		for _, sink := range sinks {
+			_ = sink.Close()
+		}
+	}
+	closers = append(closers, closeSinks)
+	if appConfig.OutputFile != "" {
+		fileSink, err := service.NewFileSink(s.env, appConfig.OutputFile, appConfig.OutputFormat, s.resumeState)
+		if err != nil {
+			logger.Errorf("Error when creating output file, error: %+v", err)
+			return fail(err)
+		}
+		sinks = append(sinks, fileSink)
+	}
+	if appConfig.Database != "" {
+		databaseSink, err := service.NewDatabaseSink(s.env, appConfig.Database)
+		if err != nil {
+			logger.Errorf("Error when connecting to database, error: %+v", err)
+			return fail(err)
+		}
+		sinks = append(sinks, databaseSink)
+	}
+	alertSink, err := service.NewAlertSink(ctx, s.env, appConfig.Alerts, s.baseline, s.opts.AlertDedup)
+	if err != nil {
+		logger.Errorf("Error when creating alert sink, error: %+v", err)
+		return fail(err)
+	}
+	if alertSink != nil {
+		sinks = append(sinks, alertSink)
+		logger.Infof("Alerting is enabled with %d rules and %d webhooks.", len(appConfig.Alerts.Rules), len(appConfig.Alerts.Webhooks))
+	}
+
+	// 单独保存 masscan 的扫描结果
+	var masscanSaver *service.MasscanSaver
+	if appConfig.MasscanOutputFile != "" {
+		masscanSaver, err = service.NewMasscanSaver(s.env, appConfig.MasscanOutputFile, resume)
+		if err != nil {
+			logger.Errorf("Error when creating masscan saver, error: %+v", err)
+			return fail(err)
+		}
+	}
+
+	// 记录重试之后仍然失败的目标，没有设置文件时不记录
+	var failures *service.FailureRecorder
+	if appConfig.FailedOutputFile != "" {
+		failures = service.NewFailureRecorder(s.env, appConfig.FailedOutputFile, resume)
+	}
+
+	results := make(chan service.OutputRecord, resultsBuffer)
+	sinks = append(sinks, s.opts.Sinks...)
+	sinks = append(sinks, &streamSink{results: results})
+
+	scan := &Scan{
+		scanner:      s,
+		results:      results,
+		done:         make(chan struct{}),
+		stats:        service.NewScanStats(s.env),
+		checkpoint:   checkpoint,
+		masscanSaver: masscanSaver,
+		failures:     failures,
+	}
+
+	// 启动 saver engine
+	scan.saver = service.NewSaverEngine(s.env, &scan.mainWg, &resultsChan, sinks, scan.stats, checkpoint)
+	scan.mainWg.Add(1)
+	go scan.saver.Run()
+
+	// 启动 nmap engine
+	scan.nmap = service.NewNmapEngine(s.env, &scan.mainWg, &nmapJobChan, &resultsChan, scan.stats, checkpoint, fingerprintBackend, failures)
+	scan.mainWg.Add(1)
+	go scan.nmap.Run(ctx)
+
+	// 启动 masscan engine
+	scan.masscan = service.NewMasscanEngine(s.env, &scan.mainWg, &masscanJobChan, &nmapJobChan, masscanSaver, scan.stats, checkpoint, backend, service.NewTarpitDetector(s.env), failures)
+	scan.mainWg.Add(1)
+	go scan.masscan.Run(ctx)
+
+	// 启动 TaskBuilder
+	scan.builder = service.NewTaskBuilder(s.env, &scan.mainWg, &masscanJobChan, &nmapJobChan, s.filter, scan.stats, s.resumeState)
+	scan.mainWg.Add(1)
+	go scan.builder.Run(ctx)
+
+	// 输出扫描进度，所有引擎结束之后停止
+	progressCtx, stopProgress := context.WithCancel(context.Background())
+	var progressWg sync.WaitGroup
+	if appConfig.ProgressInterval > 0 {
+		reporter := service.NewProgressReporter(s.env, scan.builder, scan.masscan, scan.nmap, scan.stats, appConfig.ProgressInterval)
+		progressWg.Add(1)
+		go func() {
+			defer progressWg.Done()
+			reporter.Run(progressCtx)
+		}()
+	}
+
+	go func() {
+		scan.mainWg.Wait()
+		detachRateBudget()
+		stopProgress()
+		progressWg.Wait()
+		scan.finish(ctx.Err() != nil)
+	}()
+	return scan, nil
+}
+
+// 同一个进程中的扫描共用一个临时文件夹，最后一个结束的扫描负责删除
+var (
+	tempDirMu    sync.Mutex
+	tempDirUsers int
+)
+
+// acquireTempDir 如果临时文件夹不存在，就创建一个
+func acquireTempDir(env *service.Env) {
+	tempDirMu.Lock()
+	defer tempDirMu.Unlock()
+	tempDirUsers += 1
+
+	tmpDir := fmt.Sprintf("./%s/", constant.TempDir)
+	if _, err := os.Stat(tmpDir); os.IsNotExist(err) {
+		if err := os.Mkdir(tmpDir, os.ModePerm); err != nil && !os.IsExist(err) {
+			env.Logger.Warnf("create temp dir failed. error: %+v", err)
+		} else {
+			env.Logger.Infof("create temp dir.")
+		}
+	}
+}
+
+// releaseTempDir 没有扫描在用时删掉空的临时文件夹，里面还有文件说明开了 debug 或者有其他进程在用
+func releaseTempDir() {
+	tempDirMu.Lock()
+	defer tempDirMu.Unlock()
+	tempDirUsers -= 1
+	if tempDirUsers == 0 {
+		_ = os.Remove(fmt.Sprintf("./%s/", constant.TempDir))
+	}
+}
+
+// streamSink 把结果发到 Scan.Results() 中，SaverEngine 关闭它时关闭结果流
+type streamSink struct {
+	results chan service.OutputRecord
+}
+
+func (s *streamSink) Write(record *service.OutputRecord) error {
+	s.results <- *record
+	return nil
+}
+
+func (s *streamSink) Close() error {
+	close(s.results)
+	return nil
+}
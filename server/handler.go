@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// 接口的路径前缀
+const scansPath = "/api/v1/scans"
+
+// 提交扫描的请求体的最大长度
+const maxRequestBody = 1 << 20
+
+// ServeHTTP 接口的路由：
+//   - POST /api/v1/scans                提交扫描任务
+//   - GET  /api/v1/scans                列出所有的扫描任务和引擎状态
+//   - GET  /api/v1/scans/{id}           查询一个扫描任务
+//   - GET  /api/v1/scans/{id}/results   按行输出 JSON 格式的结果，扫描没有结束时会一直输出新的结果，?follow=false 只输出已有的结果
+//   - POST /api/v1/scans/{id}/cancel    取消扫描任务
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid token"))
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, scansPath)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+
+	switch {
+	case rest == "" || rest == "/":
+		switch r.Method {
+		case http.MethodGet:
+			s.handleList(w, r)
+		case http.MethodPost:
+			s.handleSubmit(w, r)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case len(parts) == 1:
+		s.withJob(w, r, parts[0], http.MethodGet, s.handleGet)
+	case len(parts) == 2 && parts[1] == "results":
+		s.withJob(w, r, parts[0], http.MethodGet, s.handleResults)
+	case len(parts) == 2 && parts[1] == "cancel":
+		s.withJob(w, r, parts[0], http.MethodPost, s.handleCancel)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+// authorized 检查 Authorization 头中的 Bearer token
+func (s *Server) authorized(r *http.Request) bool {
+	if s.opts.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) == 1
+}
+
+// withJob 检查请求方法并查找扫描任务
+func (s *Server) withJob(w http.ResponseWriter, r *http.Request, id string, method string, handler func(http.ResponseWriter, *http.Request, *job)) {
+	if r.Method != method {
+		methodNotAllowed(w, method)
+		return
+	}
+	j := s.get(id)
+	if j == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("scan %s not found", id))
+		return
+	}
+	handler(w, r, j)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, _ *http.Request) {
+	jobs := s.list()
+	views := make([]scanView, 0, len(jobs))
+	for _, j := range jobs {
+		views = append(views, j.view())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"scans": views})
+}
+
+func (s *Server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var request Request
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	j, err := s.submit(request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Location", scansPath+"/"+j.record.ID)
+	writeJSON(w, http.StatusAccepted, j.view())
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, _ *http.Request, j *job) {
+	writeJSON(w, http.StatusOK, j.view())
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, _ *http.Request, j *job) {
+	if err := s.cancel(j); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j.view())
+}
+
+// handleResults 读取任务目录中的结果文件，读到结尾之后等待新的结果，直到扫描结束或者请求断开
+func (s *Server) handleResults(w http.ResponseWriter, r *http.Request, j *job) {
+	follow := r.URL.Query().Get("follow") != "false"
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	var fp *os.File
+	defer func() {
+		if fp != nil {
+			_ = fp.Close()
+		}
+	}()
+	var reader *bufio.Reader
+	// 最后一行可能还没有写完，留到下一次读取
+	var partial []byte
+
+	for {
+		// 先取 channel 再读文件，读文件期间写入的结果不会漏掉
+		updated, running := j.watch()
+
+		if fp == nil {
+			var err error
+			fp, err = os.Open(j.path(resultsFilename))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				s.logger.Warnf("Error when opening results of scan %s, error: %+v", j.record.ID, err)
+				return
+			}
+			if fp != nil {
+				reader = bufio.NewReader(fp)
+			}
+		}
+		if reader != nil {
+			for {
+				line, err := reader.ReadBytes('\n')
+				partial = append(partial, line...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					s.logger.Warnf("Error when reading results of scan %s, error: %+v", j.record.ID, err)
+					return
+				}
+				if _, err := w.Write(partial); err != nil {
+					return
+				}
+				partial = partial[:0]
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if !running || !follow {
+			return
+		}
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
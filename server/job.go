@@ -0,0 +1,151 @@
+package server
+
+import (
+	"cloud-scanner/scanner"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 扫描任务的状态
+const (
+	StateQueued   = "queued"
+	StateRunning  = "running"
+	StateDone     = "done"
+	StateFailed   = "failed"
+	StateCanceled = "canceled"
+)
+
+// 每个扫描任务目录中的文件
+const (
+	recordFilename  = "scan.json"
+	resultsFilename = "results.jsonl"
+	stateFilename   = "state"
+	failedFilename  = "failed"
+)
+
+// Request 提交扫描任务的请求
+type Request struct {
+	// 扫描目标，格式和 --target 一样，每个元素一个目标
+	Targets []string `json:"targets"`
+
+	// 扫描配置的名字，为空时使用服务启动时的参数
+	Profile string `json:"profile,omitempty"`
+
+	// 附加到所有结果上的元数据，覆盖服务启动时设置的同名 key
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Record 扫描任务的记录，保存在任务目录的 scan.json 中，服务重启后从这里恢复
+type Record struct {
+	ID         string     `json:"id"`
+	State      string     `json:"state"`
+	Request    Request    `json:"request"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	// 扫描结束后的汇总，服务关闭时被打断的扫描也会记录，重启后继续扫描
+	Summary *scanner.Summary `json:"summary,omitempty"`
+}
+
+// finished 任务是否已经结束，不会再被调度
+func (r *Record) finished() bool {
+	return r.State == StateDone || r.State == StateFailed || r.State == StateCanceled
+}
+
+// job 一个扫描任务，record 和运行时的状态都由 mu 保护
+type job struct {
+	dir string
+
+	mu     sync.Mutex
+	record Record
+
+	// 运行中的扫描，cancel 用于取消扫描
+	scan   *scanner.Scan
+	cancel context.CancelFunc
+
+	// 用户要求取消，区别于服务关闭时打断扫描
+	canceled bool
+
+	// 有新的结果或者状态变化时关闭，然后换一个新的 channel
+	updated chan struct{}
+}
+
+func newJob(dir string, record Record) *job {
+	return &job{
+		dir:     dir,
+		record:  record,
+		updated: make(chan struct{}),
+	}
+}
+
+// loadJob 从任务目录中读取扫描任务的记录
+func loadJob(dir string) (*job, error) {
+	data, err := os.ReadFile(filepath.Join(dir, recordFilename))
+	if err != nil {
+		return nil, err
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %w", filepath.Join(dir, recordFilename), err)
+	}
+	if record.ID == "" {
+		return nil, fmt.Errorf("%s has no scan id", filepath.Join(dir, recordFilename))
+	}
+	return newJob(dir, record), nil
+}
+
+func (j *job) path(filename string) string {
+	return filepath.Join(j.dir, filename)
+}
+
+// save 保存任务的记录，先写临时文件再改名，服务中途退出时不会留下写了一半的文件
+// 调用方需要持有 mu
+func (j *job) save() error {
+	data, err := json.MarshalIndent(j.record, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := j.path(recordFilename)
+	if err := os.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// notify 唤醒所有等待新结果的请求，调用方需要持有 mu
+func (j *job) notify() {
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
+
+// watch 返回任务是否还会有新的结果，以及有新结果时会被关闭的 channel
+// 排队中的任务也算，扫描开始之后结果会继续输出
+func (j *job) watch() (<-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.updated, !j.record.finished()
+}
+
+// scanView 接口返回的扫描任务，运行中的任务带上各个引擎的状态
+type scanView struct {
+	Record
+	Status *scanner.Status `json:"status,omitempty"`
+}
+
+func (j *job) view() scanView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	view := scanView{Record: j.record}
+	if j.scan != nil {
+		status := j.scan.Status()
+		view.Status = &status
+	}
+	return view
+}
@@ -0,0 +1,482 @@
+// Package server 通过 HTTP 接口提交和查询扫描任务
+//
+// 扫描任务按照提交的顺序排队，最多同时运行 MaxScans 个扫描
+// 每个任务的记录、结果和扫描进度都保存在 DataDir 下的任务目录中，服务重启之后没有完成的扫描会继续扫描
+package server
+
+import (
+	"cloud-scanner/config"
+	"cloud-scanner/config/constant"
+	"cloud-scanner/scanner"
+	"cloud-scanner/service"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 服务关闭时等待请求结束的最长时间
+const shutdownTimeout = 10 * time.Second
+
+// Options 构造 Server 的参数
+type Options struct {
+	// 所有扫描共用的参数，目标、输出文件和状态文件由每个任务单独设置
+	Config config.AppConfig
+
+	// 配置文件中定义的扫描配置，和内置的扫描配置一起供请求选择
+	Profiles map[string]config.ScanProfile
+
+	// 日志，为 nil 时不输出日志
+	Logger *zap.SugaredLogger
+
+	// 保存扫描任务的目录
+	DataDir string
+
+	// 最多同时运行的扫描数量
+	MaxScans int
+
+	// 访问接口需要的 Bearer token，为空时不检查
+	Token string
+}
+
+// Server 扫描任务的调度器和 HTTP 接口
+type Server struct {
+	opts   Options
+	logger *zap.SugaredLogger
+
+	mu   sync.Mutex
+	jobs map[string]*job
+
+	// 等待调度的任务，按照提交的顺序排列
+	pending []*job
+	wakeup  chan struct{}
+
+	workers sync.WaitGroup
+
+	// 所有扫描共享的发包速率和告警去重记录
+	// 同时运行的扫描加起来不超过 --masscanRate 以及各个分组的上限，masscan 和 connect 后端都一样，同一个告警也只发送一次
+	rateBudget *service.RateBudget
+	alertDedup *service.AlertDedup
+}
+
+// New 创建数据目录并读取之前保存的扫描任务，没有完成的任务重新排队
+func New(opts Options) (*Server, error) {
+	if opts.MaxScans < 1 {
+		return nil, fmt.Errorf("max scans must be at least 1")
+	}
+	if opts.DataDir == "" {
+		return nil, fmt.Errorf("data dir cannot be empty")
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+	s := &Server{
+		opts:   opts,
+		logger: logger,
+		jobs:   make(map[string]*job),
+		wakeup: make(chan struct{}, 1),
+	}
+	// 扫描配置在扫描开始时才应用，启动时先检查一遍，不要等到扫描失败才发现
+	if err := scanner.CheckConfig(&opts.Config); err != nil {
+		return nil, err
+	}
+	names := config.ProfileNames()
+	for name := range opts.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		appConfig := opts.Config
+		profile, _ := config.GetProfile(name, opts.Profiles)
+		profile.Apply(&appConfig)
+		if err := scanner.CheckConfig(&appConfig); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+
+	env := service.NewEnv(&opts.Config, logger)
+	var err error
+	if s.rateBudget, err = service.NewRateBudget(env, nil); err != nil {
+		return nil, err
+	}
+	if s.alertDedup, err = service.NewAlertDedup(env, opts.Config.Alerts); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(opts.DataDir, 0755); err != nil {
+		return nil, fmt.Errorf("create data dir %s failed: %w", opts.DataDir, err)
+	}
+
+	entries, err := os.ReadDir(opts.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		j, err := loadJob(filepath.Join(opts.DataDir, entry.Name()))
+		if err != nil {
+			// 目录中没有记录的话跳过，不影响其他任务
+			logger.Warnf("Skip scan dir %s, error: %v", entry.Name(), err)
+			continue
+		}
+		s.jobs[j.record.ID] = j
+		if !j.record.finished() {
+			s.pending = append(s.pending, j)
+		}
+	}
+	// 重启之后按照原来提交的顺序继续扫描
+	sort.Slice(s.pending, func(a, b int) bool {
+		return s.pending[a].record.CreatedAt.Before(s.pending[b].record.CreatedAt)
+	})
+	for _, j := range s.pending {
+		if j.record.State == StateRunning {
+			// 服务异常退出时正在运行的扫描
+			j.record.State = StateQueued
+			if err := j.save(); err != nil {
+				logger.Warnf("Error when saving scan %s, error: %+v", j.record.ID, err)
+			}
+		}
+	}
+	logger.Infof("Loaded %d scans from %s, %d unfinished scans are queued.", len(s.jobs), opts.DataDir, len(s.pending))
+	return s, nil
+}
+
+// Run 启动调度器和 HTTP 服务，直到 ctx 被取消
+// ctx 取消后先打断正在运行的扫描，保存好进度之后再关闭 HTTP 服务，重启后这些扫描会继续
+func (s *Server) Run(ctx context.Context, addr string) error {
+	// 监听失败时也要停下 worker
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	for i := 0; i < s.opts.MaxScans; i++ {
+		s.workers.Add(1)
+		go s.worker(ctx)
+	}
+	s.signal()
+
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		// 服务关闭时结束正在输出结果的请求
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- httpServer.ListenAndServe()
+	}()
+	s.logger.Infof("Listening on %s, up to %d scans run at the same time.", addr, s.opts.MaxScans)
+
+	var err error
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+	}
+
+	if err != nil {
+		s.logger.Errorf("Error when serving HTTP, error: %+v", err)
+		stop()
+	}
+	s.logger.Infof("Stopping, waiting for running scans to save their progress.")
+	s.workers.Wait()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if shutdownErr := httpServer.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+// submit 检查请求并把扫描任务放到队列中
+func (s *Server) submit(request Request) (*job, error) {
+	if len(request.Targets) == 0 {
+		return nil, fmt.Errorf("targets cannot be empty")
+	}
+	for idx, target := range request.Targets {
+		target = strings.TrimSpace(target)
+		if _, err := service.ParseTargetExpr(target); err != nil {
+			return nil, fmt.Errorf("illegal target %q: %w", target, err)
+		}
+		request.Targets[idx] = target
+	}
+	if request.Profile != "" {
+		if _, ok := config.GetProfile(request.Profile, s.opts.Profiles); !ok {
+			return nil, fmt.Errorf("unknown profile %q", request.Profile)
+		}
+	}
+	for key := range request.Labels {
+		if key == "" {
+			return nil, fmt.Errorf("label key cannot be empty")
+		}
+	}
+
+	record := Record{
+		ID:        uuid.NewString(),
+		State:     StateQueued,
+		Request:   request,
+		CreatedAt: time.Now(),
+	}
+	dir := filepath.Join(s.opts.DataDir, record.ID)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	j := newJob(dir, record)
+	if err := j.save(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.jobs[record.ID] = j
+	s.pending = append(s.pending, j)
+	s.mu.Unlock()
+	s.signal()
+	s.logger.Infof("Scan %s is queued, targets: %s", record.ID, strings.Join(request.Targets, ","))
+	return j, nil
+}
+
+// cancel 取消扫描任务，排队中的任务直接取消，运行中的任务等扫描停下来之后变成 canceled
+func (s *Server) cancel(j *job) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.record.finished() {
+		return fmt.Errorf("scan %s is already %s", j.record.ID, j.record.State)
+	}
+	j.canceled = true
+	if j.cancel != nil {
+		j.cancel()
+		s.logger.Infof("Scan %s is being canceled.", j.record.ID)
+		return nil
+	}
+
+	// 还没有开始扫描，worker 取到它的时候会跳过
+	now := time.Now()
+	j.record.State = StateCanceled
+	j.record.FinishedAt = &now
+	j.notify()
+	s.logger.Infof("Scan %s is canceled before it started.", j.record.ID)
+	return j.save()
+}
+
+// get 根据 ID 查找扫描任务
+func (s *Server) get(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id]
+}
+
+// list 按照提交时间列出所有的扫描任务
+func (s *Server) list() []*job {
+	s.mu.Lock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].record.CreatedAt.Before(jobs[b].record.CreatedAt)
+	})
+	return jobs
+}
+
+// signal 通知 worker 有新的任务
+func (s *Server) signal() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// next 取出下一个排队中的任务，ctx 被取消时返回 nil
+func (s *Server) next(ctx context.Context) *job {
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		for len(s.pending) > 0 {
+			j := s.pending[0]
+			s.pending = s.pending[1:]
+			j.mu.Lock()
+			queued := j.record.State == StateQueued
+			j.mu.Unlock()
+			if queued {
+				// 队列中还有任务的话叫醒其他 worker
+				if len(s.pending) > 0 {
+					s.signal()
+				}
+				s.mu.Unlock()
+				return j
+			}
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-s.wakeup:
+		}
+	}
+	return nil
+}
+
+func (s *Server) worker(ctx context.Context) {
+	defer s.workers.Done()
+	for {
+		j := s.next(ctx)
+		if j == nil {
+			return
+		}
+		s.run(ctx, j)
+	}
+}
+
+// run 运行一个扫描任务，把结果流读完并保存汇总
+func (s *Server) run(ctx context.Context, j *job) {
+	id := j.record.ID
+	logger := s.logger.With("scan_id", id)
+
+	j.mu.Lock()
+	// 出队之后、开始之前被取消了
+	if j.record.State != StateQueued {
+		j.mu.Unlock()
+		return
+	}
+	appConfig := s.scanConfig(j)
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	j.cancel = cancel
+	j.mu.Unlock()
+
+	sc, err := scanner.New(scanner.Options{
+		Config:     appConfig,
+		Logger:     logger,
+		RateBudget: s.rateBudget,
+		AlertDedup: s.alertDedup,
+	})
+	var scan *scanner.Scan
+	if err == nil {
+		scan, err = sc.Run(scanCtx)
+	}
+	if err != nil {
+		logger.Errorf("Error when starting scan %s, error: %+v", id, err)
+		j.mu.Lock()
+		s.finish(j, StateFailed, err.Error(), nil)
+		j.mu.Unlock()
+		return
+	}
+
+	j.mu.Lock()
+	j.scan = scan
+	j.record.State = StateRunning
+	if j.record.StartedAt == nil {
+		startedAt := sc.Config().StartedAt
+		j.record.StartedAt = &startedAt
+	}
+	if err := j.save(); err != nil {
+		logger.Warnf("Error when saving scan %s, error: %+v", id, err)
+	}
+	j.notify()
+	j.mu.Unlock()
+	logger.Infof("Scan %s started.", id)
+
+	// 结果已经写到任务目录中了，这里只需要通知正在读取结果的请求
+	for range scan.Results() {
+		j.mu.Lock()
+		j.notify()
+		j.mu.Unlock()
+	}
+	summary := scan.Wait()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.scan = nil
+	j.cancel = nil
+	switch {
+	case !summary.Interrupted:
+		s.finish(j, StateDone, "", summary)
+		logger.Infof("Scan %s finished, %d results saved.", id, summary.ResultsSaved)
+	case j.canceled:
+		s.finish(j, StateCanceled, "", summary)
+		logger.Infof("Scan %s is canceled.", id)
+	default:
+		// 服务关闭时打断的扫描，重启之后从状态文件继续
+		j.record.State = StateQueued
+		j.record.Summary = summary
+		if err := j.save(); err != nil {
+			logger.Warnf("Error when saving scan %s, error: %+v", id, err)
+		}
+		j.notify()
+		logger.Infof("Scan %s is interrupted, it will be resumed after restart.", id)
+	}
+}
+
+// finish 记录任务的最终状态，调用方需要持有 mu
+func (s *Server) finish(j *job, state string, message string, summary *scanner.Summary) {
+	now := time.Now()
+	j.record.State = state
+	j.record.Error = message
+	j.record.FinishedAt = &now
+	if summary != nil {
+		j.record.Summary = summary
+	}
+	if err := j.save(); err != nil {
+		s.logger.Warnf("Error when saving scan %s, error: %+v", j.record.ID, err)
+	}
+	j.notify()
+}
+
+// scanConfig 在公共参数的基础上生成任务的扫描参数，调用方需要持有 mu
+// 结果、进度和失败记录都写在任务目录中，状态文件存在时从上次的进度继续扫描
+func (s *Server) scanConfig(j *job) config.AppConfig {
+	appConfig := s.opts.Config
+	request := j.record.Request
+
+	appConfig.ScanID = j.record.ID
+	appConfig.Target = strings.Join(request.Targets, ",")
+	appConfig.InputFile = ""
+	appConfig.Inventory = nil
+	appConfig.OutputFile = j.path(resultsFilename)
+	appConfig.OutputFormat = constant.OutputFormatJSONL
+	appConfig.StateFile = j.path(stateFilename)
+	appConfig.ResumeFile = ""
+	if _, err := os.Stat(appConfig.StateFile); err == nil {
+		appConfig.ResumeFile = appConfig.StateFile
+	}
+	appConfig.FailedOutputFile = j.path(failedFilename)
+	appConfig.MasscanOutputFile = ""
+	appConfig.Baseline = ""
+	appConfig.DiffOutputFile = ""
+	appConfig.ReportFiles = nil
+	// 扫描进度通过接口查询，多个扫描同时输出进度会混在一起
+	appConfig.ProgressInterval = 0
+
+	if request.Profile != "" {
+		profile, _ := config.GetProfile(request.Profile, s.opts.Profiles)
+		profile.Apply(&appConfig)
+		appConfig.Profile = request.Profile
+	}
+	if len(request.Labels) > 0 {
+		labels := make(map[string]string, len(appConfig.Labels)+len(request.Labels))
+		for key, value := range appConfig.Labels {
+			labels[key] = value
+		}
+		for key, value := range request.Labels {
+			labels[key] = value
+		}
+		appConfig.Labels = labels
+	}
+	return appConfig
+}
@@ -0,0 +1,505 @@
+package service
+
+import (
+	"cloud-scanner/config"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 告警批量发送和去重的默认参数
+const (
+	defaultAlertBatchSize     = 20
+	defaultAlertBatchInterval = 30 * time.Second
+	defaultAlertRetries       = 3
+	defaultAlertDedupWindow   = 24 * time.Hour
+	defaultAlertSeverity      = "warning"
+)
+
+// Alert 一条告警，一个端口命中一条规则
+type Alert struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	ScanID   string `json:"scan_id"`
+	Host     string `json:"host"`
+	Port     uint   `json:"port"`
+	Protocol string `json:"protocol"`
+	Service  string `json:"service,omitempty"`
+	Product  string `json:"product,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Banner   string `json:"banner,omitempty"`
+
+	// 设置了基线时，基线中没有这个端口
+	New bool `json:"new,omitempty"`
+
+	// 资产清单中的元数据
+	Labels map[string]string `json:"labels,omitempty"`
+
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// dedupKey 同一个端口上同一个服务版本命中同一条规则只告警一次，服务变了会重新告警
+func (a *Alert) dedupKey() string {
+	return fmt.Sprintf("%s|%s/%s/%d|%s|%s|%s", a.Rule, normalizeHost(a.Host), strings.ToLower(a.Protocol), a.Port, a.Service, a.Product, a.Version)
+}
+
+// String 一行给人看的描述，发送到聊天工具中
+func (a *Alert) String() string {
+	line := fmt.Sprintf("[%s] %s %s:%d/%s", a.Severity, a.Rule, a.Host, a.Port, a.Protocol)
+	if info := (ServiceInfo{Service: a.Service, Product: a.Product, Version: a.Version, Banner: a.Banner}).String(); info != "" {
+		line += " " + info
+	}
+	if a.New {
+		line += " (new)"
+	}
+	if len(a.Labels) > 0 {
+		line += " [" + FormatLabels(a.Labels) + "]"
+	}
+	return line
+}
+
+// alertRule 解析之后的告警规则
+type alertRule struct {
+	name     string
+	severity string
+	ports    *PortSpec
+	service  *regexp.Regexp
+	product  *regexp.Regexp
+	banner   *regexp.Regexp
+	newOnly  bool
+}
+
+// newAlertRule 解析告警规则，没有任何条件的规则会对所有端口告警，不允许这样配置
+func newAlertRule(index int, rule config.AlertRule, servicesFile string) (*alertRule, error) {
+	parsed := &alertRule{name: rule.Name, severity: rule.Severity, newOnly: rule.NewOnly}
+	if parsed.name == "" {
+		parsed.name = fmt.Sprintf("rule-%d", index+1)
+	}
+	if parsed.severity == "" {
+		parsed.severity = defaultAlertSeverity
+	}
+	if rule.Ports == "" && rule.Service == "" && rule.Product == "" && rule.Banner == "" && !rule.NewOnly {
+		return nil, fmt.Errorf("alert rule %s has no condition", parsed.name)
+	}
+
+	if rule.Ports != "" {
+		ports, err := ParsePortSpec(rule.Ports, servicesFile)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %s: %w", parsed.name, err)
+		}
+		// 没有 nmap-services 时不知道 top-N 是哪些端口，规则没办法判断
+		if n, err := ports.FallbackTopPorts(); n > 0 {
+			return nil, fmt.Errorf("alert rule %s: ports %q need nmap-services: %w", parsed.name, rule.Ports, err)
+		}
+		parsed.ports = ports
+	}
+	for _, pattern := range []struct {
+		name  string
+		value string
+		dst   **regexp.Regexp
+	}{
+		{"service", rule.Service, &parsed.service},
+		{"product", rule.Product, &parsed.product},
+		{"banner", rule.Banner, &parsed.banner},
+	} {
+		if pattern.value == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern.value)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %s: invalid %s pattern: %w", parsed.name, pattern.name, err)
+		}
+		*pattern.dst = re
+	}
+	return parsed, nil
+}
+
+// match 设置了的条件都满足时命中
+func (r *alertRule) match(result *PortResult, isNew bool) bool {
+	if r.newOnly && !isNew {
+		return false
+	}
+	if r.ports != nil && !r.ports.Contains(strings.ToLower(result.Protocol), result.Port) {
+		return false
+	}
+	if r.service != nil && !r.service.MatchString(result.Service) {
+		return false
+	}
+	if r.product != nil && !r.product.MatchString(strings.TrimSpace(result.Product+" "+result.Version)) {
+		return false
+	}
+	if r.banner != nil && !r.banner.MatchString(result.Banner) {
+		return false
+	}
+	return true
+}
+
+// alertTarget 一个 webhook 以及发送给它的告警
+// 每个 webhook 单独去重，一个 webhook 发送失败时不会影响其他已经发送成功的 webhook
+type alertTarget struct {
+	notifier notifier
+
+	// 去重记录中区分 webhook 的 ID，由类型和 URL 计算出来，不包含 URL 中的 token
+	id string
+
+	// 等待发送的告警
+	pending []Alert
+}
+
+// webhookDedupID 计算 webhook 在去重记录中的 ID
+func webhookDedupID(webhook config.AlertWebhook) string {
+	webhookType := webhook.Type
+	if webhookType == "" {
+		webhookType = WebhookGeneric
+	}
+	sum := sha256.Sum256([]byte(webhookType + "|" + webhook.URL))
+	return webhookType + ":" + hex.EncodeToString(sum[:8])
+}
+
+// alertSink 按照规则检查每条结果，命中的告警攒成一批之后发送给所有的 webhook
+type alertSink struct {
+	env *Env
+
+	// 扫描被取消后不再等待重试
+	ctx context.Context
+
+	rules   []*alertRule
+	targets []*alertTarget
+
+	batchSize     int
+	batchInterval time.Duration
+	retries       uint
+	retryBackoff  time.Duration
+
+	// 基线中的端口，用于 new_only 规则，没有设置基线时为 nil
+	baseline map[string]PortResult
+
+	// 每个 webhook 发送过的告警，可能和其他同时运行的扫描共享
+	dedup *AlertDedup
+
+	// 保护 targets 中的 pending
+	lock sync.Mutex
+
+	// 通知发送协程立即发送，以及 Close 时通知它退出
+	flushChan chan struct{}
+	doneChan  chan struct{}
+	waitGroup sync.WaitGroup
+}
+
+// NewAlertSink 根据告警配置创建一个告警后端，baseline 是 --baseline 读取的结果，可以为 nil
+// dedup 为 nil 时根据告警配置创建，没有配置规则和 webhook 时返回 nil，ctx 被取消后发送失败的告警不再重试
+func NewAlertSink(ctx context.Context, env *Env, alerts config.AlertConfig, baseline []OutputRecord, dedup *AlertDedup) (ResultSink, error) {
+	if len(alerts.Rules) == 0 && len(alerts.Webhooks) == 0 {
+		return nil, nil
+	}
+	if len(alerts.Rules) == 0 {
+		return nil, fmt.Errorf("alert webhooks are set but there is no alert rule")
+	}
+	if len(alerts.Webhooks) == 0 {
+		return nil, fmt.Errorf("alert rules are set but there is no alert webhook")
+	}
+
+	sink := &alertSink{
+		env:           env,
+		ctx:           ctx,
+		batchSize:     defaultAlertBatchSize,
+		batchInterval: defaultAlertBatchInterval,
+		retries:       defaultAlertRetries,
+		retryBackoff:  webhookRetryBackoff,
+		dedup:         dedup,
+		flushChan:     make(chan struct{}, 1),
+		doneChan:      make(chan struct{}),
+	}
+	if alerts.BatchSize > 0 {
+		sink.batchSize = int(alerts.BatchSize)
+	}
+	if alerts.Retries > 0 {
+		sink.retries = alerts.Retries
+	}
+	var err error
+	if alerts.BatchInterval != "" {
+		if sink.batchInterval, err = time.ParseDuration(alerts.BatchInterval); err != nil || sink.batchInterval <= 0 {
+			return nil, fmt.Errorf("invalid alert batch interval %q", alerts.BatchInterval)
+		}
+	}
+
+	needBaseline := false
+	for i, rule := range alerts.Rules {
+		parsed, err := newAlertRule(i, rule, env.Config.NmapServicesFile)
+		if err != nil {
+			return nil, err
+		}
+		needBaseline = needBaseline || parsed.newOnly
+		sink.rules = append(sink.rules, parsed)
+	}
+	if baseline != nil {
+		sink.baseline, _ = indexResults(baseline)
+	} else if needBaseline {
+		return nil, fmt.Errorf("alert rules with new_only need --baseline")
+	}
+
+	for _, webhook := range alerts.Webhooks {
+		n, err := newNotifier(webhook)
+		if err != nil {
+			return nil, err
+		}
+		sink.targets = append(sink.targets, &alertTarget{notifier: n, id: webhookDedupID(webhook)})
+	}
+
+	if sink.dedup == nil {
+		if sink.dedup, err = NewAlertDedup(env, alerts); err != nil {
+			return nil, err
+		}
+	}
+
+	sink.waitGroup.Add(1)
+	go sink.run()
+	return sink, nil
+}
+
+// Write 检查一条结果，命中的告警放到待发送的队列中
+func (s *alertSink) Write(record *OutputRecord) error {
+	// tarpit 上的端口不是真的开放
+	if record.State == StateTarpit {
+		return nil
+	}
+
+	isNew := false
+	if s.baseline != nil {
+		key := fmt.Sprintf("%s/%s/%d", normalizeHost(record.Host), strings.ToLower(record.Protocol), record.Port)
+		_, existed := s.baseline[key]
+		isNew = !existed
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, rule := range s.rules {
+		if !rule.match(&record.PortResult, isNew) {
+			continue
+		}
+		alert := Alert{
+			Rule:      rule.name,
+			Severity:  rule.severity,
+			ScanID:    record.ScanID,
+			Host:      record.Host,
+			Port:      record.Port,
+			Protocol:  record.Protocol,
+			Service:   record.Service,
+			Product:   record.Product,
+			Version:   record.Version,
+			Banner:    record.Banner,
+			New:       isNew,
+			Labels:    record.Labels,
+			Timestamp: record.Timestamp,
+		}
+		key := alert.dedupKey()
+		for _, target := range s.targets {
+			if !s.dedup.claim(target.id, key) {
+				s.env.Logger.Debugf("[AlertSink] Skip duplicate alert to %s: %s", target.notifier.Name(), alert.String())
+				continue
+			}
+			target.pending = append(target.pending, alert)
+		}
+	}
+	for _, target := range s.targets {
+		if len(target.pending) >= s.batchSize {
+			select {
+			case s.flushChan <- struct{}{}:
+			default:
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Close 发送剩下的告警，并保存去重记录
+func (s *alertSink) Close() error {
+	close(s.doneChan)
+	s.waitGroup.Wait()
+	return s.dedup.Save()
+}
+
+// run 攒够一批或者到了发送间隔时发送告警，退出前把剩下的都发出去
+func (s *alertSink) run() {
+	defer s.waitGroup.Done()
+	ticker := time.NewTicker(s.batchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.flushChan:
+			s.flush()
+		case <-s.doneChan:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush 把每个 webhook 的告警都发送出去
+func (s *alertSink) flush() {
+	for _, target := range s.targets {
+		s.flushTarget(target)
+	}
+}
+
+// flushTarget 每次最多取 batchSize 条告警发送给一个 webhook，直到它的队列为空
+func (s *alertSink) flushTarget(target *alertTarget) {
+	for {
+		s.lock.Lock()
+		count := len(target.pending)
+		if count > s.batchSize {
+			count = s.batchSize
+		}
+		batch := target.pending[:count:count]
+		target.pending = target.pending[count:]
+		s.lock.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		err := sendWithRetry(s.ctx, s.env.Logger, target.notifier, batch, s.retries, s.retryBackoff)
+		if err == nil {
+			s.env.Logger.Infof("[AlertSink] Sent %d alerts to %s.", len(batch), target.notifier.Name())
+			continue
+		}
+		s.env.Logger.Errorf("[AlertSink] Error when sending %d alerts to %s, error: %+v", len(batch), target.notifier.Name(), err)
+		// 没有发送成功的告警不记录到这个 webhook 的去重记录中，下次扫描时只会重新发给它
+		s.dedup.forget(target.id, batch)
+	}
+}
+
+// AlertDedup 每个 webhook 发送过的告警以及发送的时间，同一个告警在去重时间内只发送一次
+// 同时运行的多个扫描共享同一个 AlertDedup，才不会互相覆盖去重文件，也不会重复告警
+type AlertDedup struct {
+	env *Env
+
+	// 不为空时跨扫描保存
+	filename string
+	window   time.Duration
+
+	lock sync.Mutex
+	// 以 webhook 的 ID 为 key
+	sent map[string]map[string]time.Time
+}
+
+// NewAlertDedup 根据告警配置创建去重记录，并读取之前扫描发送过的告警，超过去重时间的忽略
+func NewAlertDedup(env *Env, alerts config.AlertConfig) (*AlertDedup, error) {
+	d := &AlertDedup{
+		env:      env,
+		filename: alerts.DedupFile,
+		window:   defaultAlertDedupWindow,
+		sent:     make(map[string]map[string]time.Time),
+	}
+	if alerts.DedupWindow != "" {
+		window, err := time.ParseDuration(alerts.DedupWindow)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid alert dedup window %q", alerts.DedupWindow)
+		}
+		d.window = window
+	}
+	if d.filename == "" {
+		return d, nil
+	}
+
+	data, err := os.ReadFile(d.filename)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read alert dedup file %s failed: %w", d.filename, err)
+	}
+	sent := make(map[string]map[string]time.Time)
+	if err := json.Unmarshal(data, &sent); err != nil {
+		// 之前的版本没有区分 webhook，记录的告警当成所有 webhook 都发送过
+		legacy := make(map[string]time.Time)
+		if json.Unmarshal(data, &legacy) != nil {
+			return nil, fmt.Errorf("parse alert dedup file %s failed: %w", d.filename, err)
+		}
+		for _, webhook := range alerts.Webhooks {
+			sent[webhookDedupID(webhook)] = legacy
+		}
+	}
+	count := 0
+	for id, webhookSent := range sent {
+		for key, sentAt := range webhookSent {
+			if time.Since(sentAt) < d.window {
+				d.webhookSent(id)[key] = sentAt
+				count += 1
+			}
+		}
+	}
+	env.Logger.Infof("Loaded %d sent alerts from %s", count, d.filename)
+	return d, nil
+}
+
+// webhookSent 返回一个 webhook 发送过的告警，调用前需要加锁
+func (d *AlertDedup) webhookSent(id string) map[string]time.Time {
+	sent, ok := d.sent[id]
+	if !ok {
+		sent = make(map[string]time.Time)
+		d.sent[id] = sent
+	}
+	return sent
+}
+
+// claim 记录一个告警将要发送给 webhook，去重时间内已经发送过时返回 false
+func (d *AlertDedup) claim(id string, key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	sent := d.webhookSent(id)
+	if sentAt, ok := sent[key]; ok && time.Since(sentAt) < d.window {
+		return false
+	}
+	sent[key] = time.Now()
+	return true
+}
+
+// forget 删除发送失败的告警的记录
+func (d *AlertDedup) forget(id string, alerts []Alert) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	sent := d.webhookSent(id)
+	for i := range alerts {
+		delete(sent, alerts[i].dedupKey())
+	}
+}
+
+// Save 保存发送过的告警，先写临时文件再改名，避免写到一半时被中断
+// 多个扫描共享时每个扫描结束都会保存一次，写文件时也要加锁
+func (d *AlertDedup) Save() error {
+	if d.filename == "" {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	sent := make(map[string]map[string]time.Time, len(d.sent))
+	for id, webhookSent := range d.sent {
+		valid := make(map[string]time.Time, len(webhookSent))
+		for key, sentAt := range webhookSent {
+			if time.Since(sentAt) < d.window {
+				valid[key] = sentAt
+			}
+		}
+		sent[id] = valid
+	}
+
+	data, err := json.MarshalIndent(sent, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := d.filename + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0666); err != nil {
+		return fmt.Errorf("write alert dedup file %s failed: %w", tmpFile, err)
+	}
+	return os.Rename(tmpFile, d.filename)
+}
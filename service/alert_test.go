@@ -0,0 +1,264 @@
+package service
+
+import (
+	"cloud-scanner/config"
+	"context"
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebhook 记录收到的每一批告警，前 failures 次请求返回 status
+type fakeWebhook struct {
+	lock     sync.Mutex
+	failures int
+	status   int
+	batches  [][]Alert
+	requests int
+}
+
+func (w *fakeWebhook) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.requests += 1
+	if w.requests <= w.failures {
+		writer.WriteHeader(w.status)
+		return
+	}
+	var payload struct {
+		Count  int     `json:"count"`
+		Alerts []Alert `json:"alerts"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&payload); err != nil || payload.Count != len(payload.Alerts) {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.batches = append(w.batches, payload.Alerts)
+}
+
+func (w *fakeWebhook) result() (int, [][]Alert) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.requests, w.batches
+}
+
+func startFakeWebhook(t *testing.T, failures int, status int) (*fakeWebhook, string) {
+	t.Helper()
+	webhook := &fakeWebhook{failures: failures, status: status}
+	server := httptest.NewServer(webhook)
+	t.Cleanup(server.Close)
+	return webhook, server.URL
+}
+
+func TestSendWithRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		status   int
+		retries  uint
+		requests int
+		ok       bool
+	}{
+		{"success", 0, 0, 3, 1, true},
+		{"retry server errors", 2, http.StatusInternalServerError, 3, 3, true},
+		{"retry rate limit", 1, http.StatusTooManyRequests, 1, 2, true},
+		{"give up after retries", 10, http.StatusServiceUnavailable, 2, 3, false},
+		{"client errors are not retried", 10, http.StatusBadRequest, 3, 1, false},
+	}
+	alerts := []Alert{{Rule: "test", ScanID: "scan", Host: "1.2.3.4", Port: 22, Protocol: "tcp"}}
+	for _, test := range tests {
+		webhook, url := startFakeWebhook(t, test.failures, test.status)
+		n, err := newNotifier(config.AlertWebhook{URL: url})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sendWithRetry(context.Background(), zap.NewNop().Sugar(), n, alerts, test.retries, time.Millisecond)
+		requests, _ := webhook.result()
+		if (err == nil) != test.ok || requests != test.requests {
+			t.Errorf("%s: sendWithRetry() = %v after %d requests, want ok %v after %d requests", test.name, err, requests, test.ok, test.requests)
+		}
+	}
+}
+
+func TestSendWithRetryCanceled(t *testing.T) {
+	webhook, url := startFakeWebhook(t, 10, http.StatusInternalServerError)
+	n, err := newNotifier(config.AlertWebhook{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err = sendWithRetry(ctx, zap.NewNop().Sugar(), n, []Alert{{ScanID: "scan"}}, 3, time.Hour)
+	if err == nil {
+		t.Fatalf("sendWithRetry should fail")
+	}
+	// 取消之后不再等待退避时间
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("sendWithRetry took %v after ctx was canceled", elapsed)
+	}
+	if requests, _ := webhook.result(); requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+}
+
+func newTestAlertSink(t *testing.T, alerts config.AlertConfig, dedup *AlertDedup) ResultSink {
+	t.Helper()
+	alerts.Rules = []config.AlertRule{{Name: "ssh", Service: "^ssh$"}}
+	if alerts.BatchInterval == "" {
+		alerts.BatchInterval = "1h"
+	}
+	sink, err := NewAlertSink(context.Background(), NewEnv(&config.AppConfig{}, nil), alerts, nil, dedup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func sshRecord(host string) *OutputRecord {
+	return &OutputRecord{ScanID: "scan", PortResult: PortResult{Host: host, Port: 22, Protocol: "tcp", State: "open", Service: "ssh"}}
+}
+
+func TestAlertSinkBatching(t *testing.T) {
+	webhook, url := startFakeWebhook(t, 0, 0)
+	sink := newTestAlertSink(t, config.AlertConfig{
+		Webhooks:  []config.AlertWebhook{{URL: url}},
+		BatchSize: 2,
+	}, nil)
+
+	hosts := []string{"1.2.3.1", "1.2.3.2", "1.2.3.3", "1.2.3.4", "1.2.3.5"}
+	for _, host := range hosts {
+		if err := sink.Write(sshRecord(host)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 同一个告警只发送一次，没有命中规则的结果不告警
+	_ = sink.Write(sshRecord("1.2.3.1"))
+	_ = sink.Write(&OutputRecord{PortResult: PortResult{Host: "1.2.3.1", Port: 80, Protocol: "tcp", Service: "http"}})
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, batches := webhook.result()
+	seen := make(map[string]int)
+	for _, batch := range batches {
+		if len(batch) == 0 || len(batch) > 2 {
+			t.Errorf("batch of %d alerts, want 1 or 2", len(batch))
+		}
+		for _, alert := range batch {
+			seen[alert.Host] += 1
+		}
+	}
+	if len(seen) != len(hosts) {
+		t.Errorf("got alerts of %v, want one for each of %v", seen, hosts)
+	}
+	for host, count := range seen {
+		if count != 1 {
+			t.Errorf("got %d alerts for %s, want 1", count, host)
+		}
+	}
+}
+
+func TestAlertSinkDedupPerWebhook(t *testing.T) {
+	dedupFile := filepath.Join(t.TempDir(), "dedup.json")
+	good, goodURL := startFakeWebhook(t, 0, 0)
+	// 第一次扫描时拒绝请求，不会重试
+	bad, badURL := startFakeWebhook(t, 1, http.StatusBadRequest)
+	alerts := config.AlertConfig{
+		Webhooks:  []config.AlertWebhook{{URL: goodURL}, {URL: badURL}},
+		DedupFile: dedupFile,
+	}
+
+	for i := 0; i < 2; i++ {
+		sink := newTestAlertSink(t, alerts, nil)
+		if err := sink.Write(sshRecord("1.2.3.4")); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 第二次扫描只重新发给之前失败的 webhook
+	if _, batches := good.result(); len(batches) != 1 {
+		t.Errorf("good webhook got %d batches, want 1", len(batches))
+	}
+	requests, batches := bad.result()
+	if requests != 2 || len(batches) != 1 {
+		t.Errorf("bad webhook got %d requests and %d batches, want 2 and 1", requests, len(batches))
+	}
+}
+
+func TestAlertSinkLegacyDedupFile(t *testing.T) {
+	dedupFile := filepath.Join(t.TempDir(), "dedup.json")
+	alert := Alert{Rule: "ssh", Host: "1.2.3.4", Port: 22, Protocol: "tcp", Service: "ssh"}
+	data, _ := json.Marshal(map[string]time.Time{alert.dedupKey(): time.Now()})
+	if err := os.WriteFile(dedupFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	webhook, url := startFakeWebhook(t, 0, 0)
+	sink := newTestAlertSink(t, config.AlertConfig{
+		Webhooks:  []config.AlertWebhook{{URL: url}},
+		DedupFile: dedupFile,
+	}, nil)
+	_ = sink.Write(sshRecord("1.2.3.4"))
+	_ = sink.Write(sshRecord("1.2.3.5"))
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, batches := webhook.result()
+	if len(batches) != 1 || len(batches[0]) != 1 || batches[0][0].Host != "1.2.3.5" {
+		t.Errorf("got %+v, want only the alert of 1.2.3.5", batches)
+	}
+}
+
+func TestAlertSinkSharedDedup(t *testing.T) {
+	webhook, url := startFakeWebhook(t, 0, 0)
+	alerts := config.AlertConfig{
+		Webhooks:  []config.AlertWebhook{{URL: url}},
+		DedupFile: filepath.Join(t.TempDir(), "dedup.json"),
+	}
+	dedup, err := NewAlertDedup(NewEnv(&config.AppConfig{}, nil), alerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同时运行的两个扫描发现了同一个端口，只告警一次
+	first, second := newTestAlertSink(t, alerts, dedup), newTestAlertSink(t, alerts, dedup)
+	_ = first.Write(sshRecord("1.2.3.4"))
+	_ = second.Write(sshRecord("1.2.3.4"))
+	_ = second.Write(sshRecord("1.2.3.5"))
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, batches := webhook.result()
+	count := 0
+	for _, batch := range batches {
+		count += len(batch)
+	}
+	if count != 2 {
+		t.Errorf("got %d alerts, want 2", count)
+	}
+
+	// 两个扫描的记录都保存在同一个去重文件中
+	loaded, err := NewAlertDedup(NewEnv(&config.AppConfig{}, nil), alerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := loaded.sent[webhookDedupID(alerts.Webhooks[0])]; len(sent) != 2 {
+		t.Errorf("dedup file has %d alerts, want 2", len(sent))
+	}
+}
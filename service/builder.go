@@ -1,99 +1,279 @@
 package service
 
 import (
-	"bufio"
 	"cloud-scanner/config/constant"
-	"io"
-	"net"
-	"os"
+	"context"
+	"fmt"
+	"net/netip"
 	"strings"
 	"sync"
 )
 
 // TaskBuilder 生产任务的引擎
 type TaskBuilder struct {
+	env *Env
 
-	// 引擎状态
-	Status constant.EngineStatus
+	// 引擎状态，读写时需要加锁
+	Status     constant.EngineStatus
+	statusLock sync.RWMutex
 
 	// 存放主线程的 wg
 	mainWaitGroup *sync.WaitGroup
 
-	// 生成好的 IP 任务放到这个 channel 中
-	masscanJobChan *chan string
+	// 生成好的目标放到这个 channel 中
+	masscanJobChan *chan Target
+
+	// 继续扫描时，masscan 已经完成的任务直接放到 nmap 的队列中
+	nmapJobChan *chan NmapJob
+
+	// 继续扫描时恢复出来的进度，不是继续扫描时为 nil
+	resumeState *ResumeState
+
+	// 继续扫描时跳过的已经完成的目标数量
+	resumedCount uint
+
+	// 成功添加的任务数量
+	successfulCount uint
+
+	// 解析失败的目标数量
+	invalidCount uint
+
+	// 过滤不在扫描范围内的地址
+	filter *TargetFilter
+
+	// 记录被跳过的地址
+	skipped skipRecorder
+
+	// 扫描的统计数据
+	stats *ScanStats
+
+	// 收到退出信号时读到的位置，为空表示所有的输入都处理完了
+	stoppedAt string
 }
 
 // NewTaskBuilder 构造一个新的 TaskBuilder
-func NewTaskBuilder(mainWg *sync.WaitGroup, masscanJobChan *chan string) *TaskBuilder {
+func NewTaskBuilder(env *Env, mainWg *sync.WaitGroup, masscanJobChan *chan Target, nmapJobChan *chan NmapJob, filter *TargetFilter, stats *ScanStats, resumeState *ResumeState) *TaskBuilder {
 	return &TaskBuilder{
+		env:            env,
 		mainWaitGroup:  mainWg,
 		Status:         constant.EngineInit,
 		masscanJobChan: masscanJobChan,
+		nmapJobChan:    nmapJobChan,
+		filter:         filter,
+		stats:          stats,
+		resumeState:    resumeState,
 	}
 }
 
-// Run 启动 TaskBuilder 引擎
-func (b *TaskBuilder) Run() {
+// Run 启动 TaskBuilder 引擎，ctx 被取消后不再生产新的任务
+func (b *TaskBuilder) Run(ctx context.Context) {
 	defer b.mainWaitGroup.Done()
-	b.worker()
+	b.worker(ctx)
 }
 
-func (b *TaskBuilder) worker() {
+func (b *TaskBuilder) worker(ctx context.Context) {
 	defer func() {
-		logger.Debugf("TaskBuilder defer() called.")
+		b.env.Logger.Debugf("TaskBuilder defer() called.")
 		close(*b.masscanJobChan)
-		b.Status = constant.EngineStop
+		b.setStatus(constant.EngineStop)
 	}()
 
-	b.Status = constant.EngineRunning
-	var successfulCount uint = 0
+	b.setStatus(constant.EngineRunning)
 
-	if appConfig.Target != "" {
-		// 把任务塞到队列里
-		targets := strings.Split(appConfig.Target, ",")
-		for _, target := range targets {
-			target = strings.TrimSpace(target)
-			*b.masscanJobChan <- target
-			successfulCount += 1
-		}
-		logger.Infof("%d jobs were successfully added.", successfulCount)
-	} else if appConfig.InputFile != "" {
-		// 读文件
-		fp, err := os.Open(appConfig.InputFile)
-		if err != nil {
-			logger.Errorf("Error when reading input file %s, error: %+v", appConfig.InputFile, err)
-			return
+	// 先把 masscan 完成了但是 nmap 没有完成的任务放回 nmap 的队列
+	// masscan 引擎要等 masscanJobChan 关闭之后才会关闭 nmapJobChan，所以这里可以安全的写入
+	if b.resumeState != nil {
+		jobs := b.resumeState.NmapJobs()
+		b.env.Logger.Infof("Resume: %d targets already finished, %d nmap jobs re-queued.", b.resumeState.FinishedCount(), len(jobs))
+		for _, job := range jobs {
+			select {
+			case *b.nmapJobChan <- job:
+				b.stats.NmapQueued.Add(1)
+			case <-ctx.Done():
+				return
+			}
 		}
-		defer func(fp *os.File) {
-			_ = fp.Close()
-		}(fp)
+	}
 
-		bufferReader := bufio.NewReader(fp)
+	if b.env.Config.Target != "" {
+		// 把任务塞到队列里
+		targets := strings.Split(b.env.Config.Target, ",")
+		for idx, target := range targets {
+			source := fmt.Sprintf("--target #%d", idx+1)
+			if !b.addTarget(ctx, source, target, nil) {
+				b.stoppedAt = source
+				break
+			}
+		}
+	} else if b.env.Config.InputFile != "" {
+		// 读文件或者标准输入，读到一行就加入队列，不用等输入结束
+		name := InputName(b.env.Config.InputFile)
+		lines := readInputLines(ctx, b.env.Config.InputFile)
+		lineNo := 0
+	readLoop:
 		for {
-			line, err := bufferReader.ReadString('\n')
-			if err == io.EOF {
+			var line inputLine
+			var opened bool
+			select {
+			case line, opened = <-lines:
+			case <-ctx.Done():
+				b.stoppedAt = fmt.Sprintf("%s:%d", name, lineNo+1)
+				break readLoop
+			}
+			if !opened {
 				break
-			} else if err != nil {
-				logger.Errorf("Error when reading input file %s, error: %+v", appConfig.InputFile, err)
-				continue
 			}
+			if line.Err != nil {
+				b.env.Logger.Errorf("Error when reading input %s, error: %+v", name, line.Err)
+				break
+			}
+			lineNo = line.No
 
-			line = strings.TrimSpace(line)
-			if net.ParseIP(line) == nil {
-				logger.Errorf("Illegal IP address found: %s, skip it.", line)
-				continue
+			// 去掉注释和空行
+			if text := strings.TrimSpace(stripInputComment(line.Text)); text != "" {
+				source := fmt.Sprintf("%s:%d", name, line.No)
+				raw, labels, err := ParseTargetLine(text)
+				if err != nil {
+					b.env.Logger.Errorf("%s: illegal target %q, skip it. error: %v", source, text, err)
+					b.invalidCount += 1
+					continue
+				}
+				if !b.addTarget(ctx, source, raw, mergeLabels(map[string]string{LabelInput: source}, labels)) {
+					b.stoppedAt = source
+					break
+				}
 			}
-			// TODO 略过内网IP
+		}
+	} else if len(b.env.Config.Inventory) == 0 {
+		// 输入有问题，结束
+		b.env.Logger.Error("appConfig.Target, appConfig.InputFile and appConfig.Inventory cannot be empty at the same time.")
+		return
+	}
 
-			// 把任务塞到队列里
-			*b.masscanJobChan <- line
-			successfulCount += 1
+	// 云厂商的资产清单可以和 --target、--input 一起使用
+	if b.stoppedAt == "" {
+		for _, spec := range b.env.Config.Inventory {
+			if !b.addInventory(ctx, spec) {
+				break
+			}
 		}
+	}
 
-		logger.Infof("%d jobs were successfully added.", successfulCount)
-	} else {
-		// 输入有问题，结束
-		logger.Error("appConfig.Target and appConfig.InputFile cannot be empty at the same time.")
+	b.env.Logger.Infof("%d jobs were successfully added, %d invalid targets, %d addresses skipped.", b.successfulCount, b.invalidCount, b.skipped.total)
+	if b.resumeState != nil {
+		b.env.Logger.Infof("Resume: %d targets were skipped because they were already scanned.", b.resumedCount)
+	}
+	if b.stoppedAt != "" {
+		b.env.Logger.Warnf("TaskBuilder was interrupted at %s, the rest of the input was not queued.", b.stoppedAt)
 	}
+}
+
+// StoppedAt 返回收到退出信号时处理到的输入位置，所有输入都处理完时返回空字符串
+func (b *TaskBuilder) StoppedAt() string {
+	return b.stoppedAt
+}
+
+// SkippedCount 返回被跳过的地址数量
+func (b *TaskBuilder) SkippedCount() uint64 {
+	return b.skipped.total
+}
+
+// Skipped 返回被跳过的地址段，需要在引擎结束后调用
+func (b *TaskBuilder) Skipped() []SkippedRange {
+	return b.skipped.ranges
+}
+
+// addInventory 读取一个资产清单，带着每个地址的元数据加入任务队列，ctx 被取消时返回 false
+func (b *TaskBuilder) addInventory(ctx context.Context, spec string) bool {
+	targets, err := LoadInventory(spec)
+	if err != nil {
+		b.env.Logger.Errorf("Error when loading inventory, error: %+v", err)
+		return true
+	}
+	_, filename := ParseInventorySpec(spec)
+	b.env.Logger.Infof("Loaded %d addresses from inventory %s", len(targets), filename)
+
+	for idx, target := range targets {
+		source := fmt.Sprintf("%s#%d", filename, idx+1)
+		if id := target.Labels[LabelInstanceID]; id != "" {
+			source += " (" + id + ")"
+		}
+		addr, err := validInventoryAddress(target.Address)
+		if err != nil {
+			b.env.Logger.Errorf("%s: illegal target, skip it. error: %v", source, err)
+			b.invalidCount += 1
+			continue
+		}
+		labels := mergeLabels(map[string]string{LabelInput: fmt.Sprintf("%s#%d", filename, idx+1)}, target.Labels)
+		if !b.addTarget(ctx, source, addr.String(), labels) {
+			b.stoppedAt = source
+			return false
+		}
+	}
+	return true
+}
+
+// addTarget 解析一个目标表达式，展开后把每个 IP 都塞到任务队列里
+// source 用来在日志中标明出错的位置，labels 是这个目标的元数据，和 --label 合并之后带到每个 IP 上
+// ctx 被取消时返回 false
+func (b *TaskBuilder) addTarget(ctx context.Context, source string, raw string, labels map[string]string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return true
+	}
+
+	expr, err := ParseTargetExpr(raw)
+	if err != nil {
+		b.env.Logger.Errorf("%s: illegal target %q, skip it. error: %v", source, raw, err)
+		b.invalidCount += 1
+		return true
+	}
+	// 一个表达式展开出来的所有 IP 共用同一份元数据，之后不会再修改
+	labels = mergeLabels(b.env.Config.Labels, labels)
+
+	err = expr.Expand(ctx, func(addr netip.Addr) bool {
+		// 不在扫描范围内的地址直接跳过，不会交给 masscan
+		if reason, skip := b.filter.Check(addr); skip {
+			b.skipped.add(addr, reason)
+			return true
+		}
+		// 继续扫描时跳过已经扫描过的目标
+		host := addr.String()
+		if b.resumeState != nil && b.resumeState.IsDone(host) {
+			b.resumedCount += 1
+			return true
+		}
+		select {
+		case *b.masscanJobChan <- Target{Host: host, Labels: labels}:
+			b.successfulCount += 1
+			b.stats.TargetsQueued.Add(1)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		b.env.Logger.Errorf("%s: failed to expand target %q, skip it. error: %v", source, raw, err)
+		b.invalidCount += 1
+	}
+	return true
+}
+
+func (b *TaskBuilder) setStatus(status constant.EngineStatus) {
+	b.statusLock.Lock()
+	defer b.statusLock.Unlock()
+	b.Status = status
+}
 
+// GetStatus 返回引擎状态
+func (b *TaskBuilder) GetStatus() constant.EngineStatus {
+	b.statusLock.RLock()
+	defer b.statusLock.RUnlock()
+	return b.Status
 }
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// 状态文件中的记录类型
+const (
+	checkpointScan        = "scan"
+	checkpointMasscanDone = "masscan_done"
+	checkpointNmapDone    = "nmap_done"
+)
+
+// checkpointEvent 状态文件中的一条记录，一行一个 JSON
+type checkpointEvent struct {
+	Type    string            `json:"type"`
+	Time    time.Time         `json:"time"`
+	ScanID  string            `json:"scan_id,omitempty"`
+	Target  string            `json:"target,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	JobUUID string            `json:"job_uuid,omitempty"`
+	Results []MasscanResult   `json:"results,omitempty"`
+	Tarpit  bool              `json:"tarpit,omitempty"`
+
+	// tarpit host 上没有抽到的端口，不交给 nmap
+	Unsampled []MasscanResult `json:"unsampled,omitempty"`
+}
+
+// pendingNmapJob 等待 saver 写完结果的 nmap 任务
+type pendingNmapJob struct {
+	target   string
+	expected int
+	saved    int
+	finished bool
+}
+
+// Checkpoint 记录扫描进度的状态文件，用于中断之后继续扫描
+//   - masscan 扫描完一个目标后，记录 masscan_done 以及 masscan 的结果
+//   - nmap 扫描完一个目标，并且 saver 把这个目标的结果都写完之后，记录 nmap_done
+type Checkpoint struct {
+	lock sync.Mutex
+	fp   *os.File
+	env  *Env
+
+	// 以 masscan 任务的 UUID 为 key，记录还没有保存完的 nmap 任务
+	pending map[string]*pendingNmapJob
+}
+
+// NewCheckpoint 打开状态文件，继续扫描时在后面追加，否则清空之前的内容
+// 同一个状态文件中不能混着上一次扫描的记录，不然继续扫描时会用错扫描 ID，还会跳过上一次扫过的目标
+// filename 为空时不记录进度，这样的扫描不能继续
+func NewCheckpoint(env *Env, filename string, resume bool) (*Checkpoint, error) {
+	c := &Checkpoint{
+		env:     env,
+		pending: make(map[string]*pendingNmapJob),
+	}
+	if filename == "" {
+		return c, nil
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	fp, err := os.OpenFile(filename, flag, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open state file %s: %w", filename, err)
+	}
+	c.fp = fp
+	if err := c.write(checkpointEvent{Type: checkpointScan, ScanID: env.Config.ScanID}); err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// write 写入一条记录，每条记录都是一次完整的 write 调用，进程崩溃时最多丢失最后一条
+func (c *Checkpoint) write(event checkpointEvent) error {
+	if c.fp == nil {
+		return nil
+	}
+	event.Time = time.Now()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = c.fp.Write(append(data, '\n'))
+	return err
+}
+
+// MasscanDone 记录一个目标已经完成了 masscan 扫描，tarpit host 分开记录抽样的端口和没有抽到的端口
+// 目标的元数据也要记录下来，继续扫描时重新放回 nmap 队列的任务需要它
+func (c *Checkpoint) MasscanDone(target Target, jobUUID string, results []MasscanResult, unsampled []MasscanResult, tarpit bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.write(checkpointEvent{
+		Type:      checkpointMasscanDone,
+		Target:    target.Host,
+		Labels:    target.Labels,
+		JobUUID:   jobUUID,
+		Results:   results,
+		Tarpit:    tarpit,
+		Unsampled: unsampled,
+	})
+	if err != nil {
+		c.env.Logger.Errorf("Error when writing state file, error: %+v", err)
+	}
+}
+
+// NmapFinished 由 nmap 引擎调用，表示这个任务已经产生了 count 条结果
+// 等 saver 把这些结果都写完之后才会记录 nmap_done
+func (c *Checkpoint) NmapFinished(target string, jobUUID string, count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	job := c.getPending(jobUUID)
+	job.target = target
+	job.expected = count
+	job.finished = true
+	c.tryFinish(jobUUID, job)
+}
+
+// ResultSaved 由 saver 调用，表示一条结果已经写到后端中了
+func (c *Checkpoint) ResultSaved(jobUUID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	job := c.getPending(jobUUID)
+	job.saved += 1
+	c.tryFinish(jobUUID, job)
+}
+
+func (c *Checkpoint) getPending(jobUUID string) *pendingNmapJob {
+	job, ok := c.pending[jobUUID]
+	if !ok {
+		job = &pendingNmapJob{}
+		c.pending[jobUUID] = job
+	}
+	return job
+}
+
+// tryFinish nmap 已经结束并且结果都保存完了，记录 nmap_done
+func (c *Checkpoint) tryFinish(jobUUID string, job *pendingNmapJob) {
+	if !job.finished || job.saved < job.expected {
+		return
+	}
+	delete(c.pending, jobUUID)
+	err := c.write(checkpointEvent{Type: checkpointNmapDone, Target: job.target, JobUUID: jobUUID})
+	if err != nil {
+		c.env.Logger.Errorf("Error when writing state file, error: %+v", err)
+	}
+}
+
+// Resumable 是否记录了进度，没有状态文件的扫描不能继续
+func (c *Checkpoint) Resumable() bool {
+	return c.fp != nil
+}
+
+// Close 关闭状态文件
+func (c *Checkpoint) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fp == nil {
+		return nil
+	}
+	return c.fp.Close()
+}
+
+// ResumeState 从状态文件中恢复出来的扫描进度
+type ResumeState struct {
+	// 之前扫描的 ID，继续扫描时沿用这个 ID
+	ScanID string
+
+	// 已经全部完成的目标
+	finished map[string]struct{}
+
+	// masscan 完成了但是 nmap 没有完成的任务，需要重新放到 nmap 的队列中
+	nmapJobs map[string]NmapJob
+}
+
+// LoadResumeState 读取状态文件，恢复扫描进度
+func LoadResumeState(logger *zap.SugaredLogger, filename string) (*ResumeState, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open state file %s: %w", filename, err)
+	}
+	defer func(fp *os.File) {
+		_ = fp.Close()
+	}(fp)
+
+	state := &ResumeState{
+		finished: make(map[string]struct{}),
+		nmapJobs: make(map[string]NmapJob),
+	}
+	reader := bufio.NewReader(fp)
+	lineNo := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read state file %s failed: %w", filename, err)
+		}
+		lineNo += 1
+
+		if len(line) > 0 {
+			var event checkpointEvent
+			if jsonErr := json.Unmarshal(line, &event); jsonErr != nil {
+				// 进程崩溃时最后一行可能只写了一半，忽略掉
+				logger.Warnf("%s:%d: broken state record, skip it. error: %v", filename, lineNo, jsonErr)
+			} else {
+				state.apply(event)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return state, nil
+}
+
+// apply 按顺序重放状态文件中的记录
+func (s *ResumeState) apply(event checkpointEvent) {
+	switch event.Type {
+	case checkpointScan:
+		// 第一次扫描的 ID，后面继续扫描时写入的 ID 和它是一样的
+		if s.ScanID == "" {
+			s.ScanID = event.ScanID
+		}
+	case checkpointMasscanDone:
+		// 没有开放端口的目标不需要 nmap，直接算完成
+		if len(event.Results) == 0 {
+			s.finished[event.Target] = struct{}{}
+			delete(s.nmapJobs, event.Target)
+			return
+		}
+		s.nmapJobs[event.Target] = NmapJob{
+			Target:    Target{Host: event.Target, Labels: event.Labels},
+			value:     event.Results,
+			UUID:      event.JobUUID,
+			tarpit:    event.Tarpit,
+			unsampled: event.Unsampled,
+		}
+	case checkpointNmapDone:
+		s.finished[event.Target] = struct{}{}
+		delete(s.nmapJobs, event.Target)
+	}
+}
+
+// IsDone 判断一个目标是否不需要再经过 masscan 扫描
+func (s *ResumeState) IsDone(target string) bool {
+	if _, ok := s.finished[target]; ok {
+		return true
+	}
+	_, ok := s.nmapJobs[target]
+	return ok
+}
+
+// FinishedCount 返回已经全部完成的目标数量
+func (s *ResumeState) FinishedCount() int {
+	return len(s.finished)
+}
+
+// requeuedFilter 返回判断一条结果是否属于要重新扫描的 nmap 任务的函数
+// 这些任务在中断之前可能已经写了一部分结果，没有 jobUUID 的结果（文本格式）按照目标判断
+func (s *ResumeState) requeuedFilter() func(jobUUID string, host string) bool {
+	uuids := make(map[string]struct{}, len(s.nmapJobs))
+	for _, job := range s.nmapJobs {
+		uuids[job.UUID] = struct{}{}
+	}
+	return func(jobUUID string, host string) bool {
+		if jobUUID == "" {
+			_, ok := s.nmapJobs[normalizeHost(host)]
+			return ok
+		}
+		_, ok := uuids[jobUUID]
+		return ok
+	}
+}
+
+// NmapJobs 返回需要重新放到 nmap 队列中的任务
+func (s *ResumeState) NmapJobs() []NmapJob {
+	jobs := make([]NmapJob, 0, len(s.nmapJobs))
+	for _, job := range s.nmapJobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
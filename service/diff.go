@@ -0,0 +1,270 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// ServiceInfo 一个端口上识别出来的服务，用于比较前后两次扫描
+type ServiceInfo struct {
+	Service string `json:"service"`
+	Product string `json:"product,omitempty"`
+	Version string `json:"version,omitempty"`
+	Banner  string `json:"banner,omitempty"`
+}
+
+func (s ServiceInfo) String() string {
+	parts := make([]string, 0, 3)
+	for _, part := range []string{s.Service, s.Product, s.Version} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	// 文本格式的结果只有 banner
+	if s.Product == "" && s.Banner != "" {
+		parts = append(parts, s.Banner)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ServiceChange 同一个端口前后两次识别出来的服务不一样
+type ServiceChange struct {
+	Host     string      `json:"host"`
+	Port     uint        `json:"port"`
+	Protocol string      `json:"protocol"`
+	Old      ServiceInfo `json:"old"`
+	New      ServiceInfo `json:"new"`
+}
+
+// ScanDiff 两次扫描结果的差异
+type ScanDiff struct {
+	Baseline string `json:"baseline"`
+	Current  string `json:"current"`
+
+	// 之前没有任何开放端口的 host，以及现在没有任何开放端口的 host
+	NewHosts  []string `json:"new_hosts"`
+	GoneHosts []string `json:"gone_hosts"`
+
+	// 新开放的端口和关闭的端口，tarpit 上的端口不是真的开放，只在 host 出现或者消失时体现
+	OpenedPorts []PortResult `json:"opened_ports"`
+	ClosedPorts []PortResult `json:"closed_ports"`
+
+	// 服务或者版本发生变化的端口
+	ChangedServices []ServiceChange `json:"changed_services"`
+}
+
+// DiffResults 比较两次扫描的结果
+// scanned 判断一个端口这次是否扫描过，没有扫描过的端口不会被当成关闭，为 nil 时认为都扫描过
+// 任意一次的状态是 filtered/tarpit 的端口不会出现在端口和服务的差异中，和告警一样跳过
+func DiffResults(baseline []OutputRecord, current []OutputRecord, scanned func(host string, protocol string, port uint) bool) *ScanDiff {
+	oldPorts, oldHosts := indexResults(baseline)
+	newPorts, newHosts := indexResults(current)
+
+	diff := &ScanDiff{
+		NewHosts:        make([]string, 0),
+		GoneHosts:       make([]string, 0),
+		OpenedPorts:     make([]PortResult, 0),
+		ClosedPorts:     make([]PortResult, 0),
+		ChangedServices: make([]ServiceChange, 0),
+	}
+	for host := range newHosts {
+		if _, ok := oldHosts[host]; !ok {
+			diff.NewHosts = append(diff.NewHosts, host)
+		}
+	}
+
+	for key, result := range newPorts {
+		if result.State == StateTarpit {
+			continue
+		}
+		old, ok := oldPorts[key]
+		if !ok {
+			diff.OpenedPorts = append(diff.OpenedPorts, result)
+			continue
+		}
+		// 其中一次只有 masscan 的结果时没有办法比较服务，tarpit 上抽样识别的服务也没有意义
+		if old.Service == "" || result.Service == "" || old.State == StateTarpit {
+			continue
+		}
+		oldInfo, newInfo := serviceInfo(old), serviceInfo(result)
+		// 文本格式的结果没有来源，也没有产品和版本，只能比较服务名和 banner
+		if old.Source == "" || result.Source == "" {
+			oldInfo.Product, oldInfo.Version = "", ""
+			newInfo.Product, newInfo.Version = "", ""
+		}
+		if oldInfo != newInfo {
+			diff.ChangedServices = append(diff.ChangedServices, ServiceChange{
+				Host:     result.Host,
+				Port:     result.Port,
+				Protocol: result.Protocol,
+				Old:      oldInfo,
+				New:      newInfo,
+			})
+		}
+	}
+	// 之前的端口都关闭了的 host 才算消失
+	stillOpen := make(map[string]struct{})
+	for key, result := range oldPorts {
+		if _, ok := newPorts[key]; ok || (scanned != nil && !scanned(result.Host, result.Protocol, result.Port)) {
+			stillOpen[result.Host] = struct{}{}
+			continue
+		}
+		if result.State == StateTarpit {
+			continue
+		}
+		diff.ClosedPorts = append(diff.ClosedPorts, result)
+	}
+	for host := range oldHosts {
+		if _, ok := newHosts[host]; !ok {
+			if _, ok := stillOpen[host]; !ok {
+				diff.GoneHosts = append(diff.GoneHosts, host)
+			}
+		}
+	}
+
+	sortHosts(diff.NewHosts)
+	sortHosts(diff.GoneHosts)
+	sortPortResults(diff.OpenedPorts)
+	sortPortResults(diff.ClosedPorts)
+	sort.Slice(diff.ChangedServices, func(i, j int) bool {
+		a, b := diff.ChangedServices[i], diff.ChangedServices[j]
+		return lessPort(a.Host, a.Protocol, a.Port, b.Host, b.Protocol, b.Port)
+	})
+	return diff
+}
+
+// indexResults 按照 host/protocol/port 索引结果，重复的结果以后面的为准
+func indexResults(records []OutputRecord) (map[string]PortResult, map[string]struct{}) {
+	ports := make(map[string]PortResult, len(records))
+	hosts := make(map[string]struct{})
+	for _, record := range records {
+		result := record.PortResult
+		result.Host = normalizeHost(result.Host)
+		result.Protocol = strings.ToLower(result.Protocol)
+		key := fmt.Sprintf("%s/%s/%d", result.Host, result.Protocol, result.Port)
+		// 继续扫描时 nmap 重新识别之后的结果会排在 masscan 的结果后面
+		if old, ok := ports[key]; ok && result.Service == "" && old.Service != "" {
+			continue
+		}
+		ports[key] = result
+		hosts[result.Host] = struct{}{}
+	}
+	return ports, hosts
+}
+
+func serviceInfo(result PortResult) ServiceInfo {
+	return ServiceInfo{
+		Service: result.Service,
+		Product: result.Product,
+		Version: result.Version,
+		Banner:  result.Banner,
+	}
+}
+
+// normalizeHost IPv6 地址的写法可能不一样，统一转换之后再比较
+func normalizeHost(host string) string {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// lessHost IP 按照地址排序，其他的按照字符串排序
+func lessHost(a string, b string) bool {
+	addrA, errA := netip.ParseAddr(a)
+	addrB, errB := netip.ParseAddr(b)
+	if errA == nil && errB == nil {
+		return addrA.Less(addrB)
+	}
+	if (errA == nil) != (errB == nil) {
+		return errA == nil
+	}
+	return a < b
+}
+
+func lessPort(hostA string, protocolA string, portA uint, hostB string, protocolB string, portB uint) bool {
+	if hostA != hostB {
+		return lessHost(hostA, hostB)
+	}
+	if protocolA != protocolB {
+		return protocolA < protocolB
+	}
+	return portA < portB
+}
+
+func sortHosts(hosts []string) {
+	sort.Slice(hosts, func(i, j int) bool {
+		return lessHost(hosts[i], hosts[j])
+	})
+}
+
+func sortPortResults(results []PortResult) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		return lessPort(a.Host, a.Protocol, a.Port, b.Host, b.Protocol, b.Port)
+	})
+}
+
+// Summary 一行的汇总信息
+func (d *ScanDiff) Summary() string {
+	return fmt.Sprintf("%d new hosts, %d gone hosts, %d opened ports, %d closed ports, %d changed services",
+		len(d.NewHosts), len(d.GoneHosts), len(d.OpenedPorts), len(d.ClosedPorts), len(d.ChangedServices))
+}
+
+// WriteText 输出给人看的格式
+func (d *ScanDiff) WriteText(w io.Writer) error {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("Scan diff: %s -> %s\n", d.Baseline, d.Current))
+	builder.WriteString(d.Summary() + "\n")
+
+	writeSection := func(title string, count int, line func(i int) string) {
+		if count == 0 {
+			return
+		}
+		builder.WriteString(fmt.Sprintf("\n%s (%d):\n", title, count))
+		for i := 0; i < count; i++ {
+			builder.WriteString("  " + line(i) + "\n")
+		}
+	}
+	portLine := func(result PortResult) string {
+		line := fmt.Sprintf("%s %s/%d", result.Host, result.Protocol, result.Port)
+		if info := serviceInfo(result).String(); info != "" {
+			line += " " + info
+		}
+		if result.State != "" && result.State != "open" {
+			line += " [" + result.State + "]"
+		}
+		return line
+	}
+
+	writeSection("New hosts", len(d.NewHosts), func(i int) string {
+		return d.NewHosts[i]
+	})
+	writeSection("Gone hosts", len(d.GoneHosts), func(i int) string {
+		return d.GoneHosts[i]
+	})
+	writeSection("Opened ports", len(d.OpenedPorts), func(i int) string {
+		return portLine(d.OpenedPorts[i])
+	})
+	writeSection("Closed ports", len(d.ClosedPorts), func(i int) string {
+		return portLine(d.ClosedPorts[i])
+	})
+	writeSection("Changed services", len(d.ChangedServices), func(i int) string {
+		change := d.ChangedServices[i]
+		return fmt.Sprintf("%s %s/%d %s -> %s", change.Host, change.Protocol, change.Port, change.Old, change.New)
+	})
+
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+// WriteJSON 输出 JSON 格式
+func (d *ScanDiff) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d)
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func diffRecord(host string, protocol string, port uint, service string, product string, version string) OutputRecord {
+	return OutputRecord{PortResult: PortResult{
+		Host: host, Protocol: protocol, Port: port, State: "open",
+		Service: service, Product: product, Version: version, Source: ResultSourceNmap,
+	}}
+}
+
+func tarpitRecord(host string, port uint) OutputRecord {
+	return OutputRecord{PortResult: PortResult{
+		Host: host, Protocol: "tcp", Port: port, State: StateTarpit, Source: ResultSourceMasscan,
+	}}
+}
+
+func TestDiffResults(t *testing.T) {
+	ssh := diffRecord("1.2.3.4", "tcp", 22, "ssh", "OpenSSH", "8.9")
+	http := diffRecord("1.2.3.4", "tcp", 80, "http", "nginx", "1.24.0")
+
+	tests := []struct {
+		name     string
+		baseline []OutputRecord
+		current  []OutputRecord
+		scanned  func(host string, protocol string, port uint) bool
+		want     ScanDiff
+	}{
+		{
+			name:     "same results",
+			baseline: []OutputRecord{ssh, http},
+			current:  []OutputRecord{http, ssh},
+			want:     ScanDiff{},
+		},
+		{
+			name:     "new host and opened port",
+			baseline: []OutputRecord{ssh},
+			current:  []OutputRecord{ssh, http, diffRecord("10.0.0.1", "udp", 53, "", "", "")},
+			want: ScanDiff{
+				NewHosts:    []string{"10.0.0.1"},
+				OpenedPorts: []PortResult{http.PortResult, diffRecord("10.0.0.1", "udp", 53, "", "", "").PortResult},
+			},
+		},
+		{
+			name:     "gone host and closed ports",
+			baseline: []OutputRecord{ssh, http, diffRecord("5.6.7.8", "tcp", 443, "https", "", "")},
+			current:  []OutputRecord{ssh},
+			want: ScanDiff{
+				GoneHosts:   []string{"5.6.7.8"},
+				ClosedPorts: []PortResult{http.PortResult, diffRecord("5.6.7.8", "tcp", 443, "https", "", "").PortResult},
+			},
+		},
+		{
+			name:     "ports that were not scanned are not closed",
+			baseline: []OutputRecord{ssh, http, diffRecord("5.6.7.8", "tcp", 443, "https", "", "")},
+			current:  []OutputRecord{ssh},
+			scanned: func(host string, protocol string, port uint) bool {
+				return port != 443 && port != 80
+			},
+			want: ScanDiff{},
+		},
+		{
+			name:     "changed version",
+			baseline: []OutputRecord{ssh},
+			current:  []OutputRecord{diffRecord("1.2.3.4", "tcp", 22, "ssh", "OpenSSH", "9.5p1")},
+			want: ScanDiff{
+				ChangedServices: []ServiceChange{{
+					Host: "1.2.3.4", Port: 22, Protocol: "tcp",
+					Old: ServiceInfo{Service: "ssh", Product: "OpenSSH", Version: "8.9"},
+					New: ServiceInfo{Service: "ssh", Product: "OpenSSH", Version: "9.5p1"},
+				}},
+			},
+		},
+		{
+			name:     "masscan only results are not compared",
+			baseline: []OutputRecord{ssh},
+			current:  []OutputRecord{diffRecord("1.2.3.4", "tcp", 22, "", "", "")},
+			want:     ScanDiff{},
+		},
+		{
+			name:     "text results only compare service and banner",
+			baseline: []OutputRecord{ssh},
+			current: []OutputRecord{{PortResult: PortResult{
+				Host: "1.2.3.4", Protocol: "TCP", Port: 22, Service: "ssh", Banner: "OpenSSH 9.5p1",
+			}}},
+			want: ScanDiff{
+				ChangedServices: []ServiceChange{{
+					Host: "1.2.3.4", Port: 22, Protocol: "tcp",
+					Old: ServiceInfo{Service: "ssh"},
+					New: ServiceInfo{Service: "ssh", Banner: "OpenSSH 9.5p1"},
+				}},
+			},
+		},
+		{
+			name:     "resumed nmap result replaces masscan result",
+			baseline: []OutputRecord{ssh},
+			current:  []OutputRecord{diffRecord("1.2.3.4", "tcp", 22, "", "", ""), ssh, diffRecord("1.2.3.4", "tcp", 22, "", "", "")},
+			want:     ScanDiff{},
+		},
+		{
+			name:     "tarpit ports are not diffed",
+			baseline: []OutputRecord{ssh, diffRecord("5.6.7.8", "tcp", 443, "https", "", ""), tarpitRecord("9.9.9.9", 80)},
+			current: []OutputRecord{
+				tarpitRecord("1.2.3.4", 22), tarpitRecord("1.2.3.4", 8080),
+				diffRecord("5.6.7.8", "tcp", 443, "https", "", ""), tarpitRecord("5.6.7.8", 8443),
+				tarpitRecord("10.0.0.1", 80),
+			},
+			want: ScanDiff{
+				NewHosts:  []string{"10.0.0.1"},
+				GoneHosts: []string{"9.9.9.9"},
+			},
+		},
+		{
+			name:     "IPv6 hosts are normalized",
+			baseline: []OutputRecord{diffRecord("2001:db8::1", "tcp", 22, "ssh", "", "")},
+			current: []OutputRecord{
+				diffRecord("2001:0db8:0000::0001", "tcp", 22, "ssh", "", ""),
+				diffRecord("::ffff:1.2.3.4", "tcp", 22, "ssh", "", ""),
+			},
+			want: ScanDiff{
+				NewHosts:    []string{"1.2.3.4"},
+				OpenedPorts: []PortResult{diffRecord("1.2.3.4", "tcp", 22, "ssh", "", "").PortResult},
+			},
+		},
+	}
+	for _, test := range tests {
+		diff := DiffResults(test.baseline, test.current, test.scanned)
+		want := test.want
+		for _, list := range []*[]string{&want.NewHosts, &want.GoneHosts} {
+			if *list == nil {
+				*list = []string{}
+			}
+		}
+		for _, list := range []*[]PortResult{&want.OpenedPorts, &want.ClosedPorts} {
+			if *list == nil {
+				*list = []PortResult{}
+			}
+		}
+		if want.ChangedServices == nil {
+			want.ChangedServices = []ServiceChange{}
+		}
+		if !reflect.DeepEqual(*diff, want) {
+			t.Errorf("%s: DiffResults() =\n%+v\nwant\n%+v", test.name, *diff, want)
+		}
+	}
+}
+
+func TestDiffResultsSorted(t *testing.T) {
+	current := []OutputRecord{
+		diffRecord("10.0.0.2", "tcp", 80, "", "", ""),
+		diffRecord("9.0.0.1", "udp", 53, "", "", ""),
+		diffRecord("10.0.0.2", "tcp", 22, "", "", ""),
+		diffRecord("9.0.0.1", "tcp", 8080, "", "", ""),
+		diffRecord("example.com", "tcp", 80, "", "", ""),
+	}
+	diff := DiffResults(nil, current, nil)
+
+	// IP 按照地址排序而不是字符串，主机名排在 IP 后面
+	if want := []string{"9.0.0.1", "10.0.0.2", "example.com"}; !reflect.DeepEqual(diff.NewHosts, want) {
+		t.Errorf("NewHosts = %v, want %v", diff.NewHosts, want)
+	}
+	var ports []string
+	for _, r := range diff.OpenedPorts {
+		ports = append(ports, fmt.Sprintf("%s/%s/%d", r.Host, r.Protocol, r.Port))
+	}
+	want := []string{"9.0.0.1/tcp/8080", "9.0.0.1/udp/53", "10.0.0.2/tcp/22", "10.0.0.2/tcp/80", "example.com/tcp/80"}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("OpenedPorts = %v, want %v", ports, want)
+	}
+}
+
+func TestScanDiffWriteText(t *testing.T) {
+	diff := DiffResults(
+		[]OutputRecord{diffRecord("1.2.3.4", "tcp", 22, "ssh", "OpenSSH", "8.9")},
+		[]OutputRecord{diffRecord("1.2.3.4", "tcp", 22, "ssh", "OpenSSH", "9.5p1"), diffRecord("1.2.3.4", "tcp", 80, "", "", "")},
+		nil,
+	)
+	diff.Baseline, diff.Current = "old.jsonl", "new.jsonl"
+
+	var buffer bytes.Buffer
+	if err := diff.WriteText(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	want := `Scan diff: old.jsonl -> new.jsonl
+0 new hosts, 0 gone hosts, 1 opened ports, 0 closed ports, 1 changed services
+
+Opened ports (1):
+  1.2.3.4 tcp/80
+
+Changed services (1):
+  1.2.3.4 tcp/22 ssh OpenSSH 8.9 -> ssh OpenSSH 9.5p1
+`
+	if buffer.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", buffer.String(), want)
+	}
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 支持的端口发现后端
+const (
+	BackendMasscan = "masscan"
+	BackendConnect = "connect"
+)
+
+// DiscoveryBackend 发现开放端口的后端，MasscanEngine 的 worker 把一批目标交给它扫描
+// 返回的结果会按 host 拆分成 nmap 任务，所以后端不需要关心后面的流程
+type DiscoveryBackend interface {
+	// Name 后端的名字，用于日志和统计
+	Name() string
+
+	// Scan 扫描一批目标，返回所有开放的端口，ctx 被取消时需要尽快返回
+	Scan(ctx context.Context, tag string, batch []string) ([]MasscanResult, error)
+}
+
+// connectBackend 使用 TCP connect 发现开放端口，不需要 raw socket 权限
+// 所有 worker 共享并发数，每秒发起的连接数和 masscan 一样从 RateBudget 中分配
+type connectBackend struct {
+	env     *Env
+	ports   []uint16
+	timeout time.Duration
+	retries uint
+
+	// 限制同时进行的连接数
+	semaphore chan struct{}
+
+	// 每扫描一批目标分配一次速率，--rate-per-24 和 provider_rates 同样生效
+	rateBudget *RateBudget
+}
+
+// NewConnectBackend 创建 TCP connect 后端，只支持 TCP 端口，所有 worker 共享同一个 rateBudget
+func NewConnectBackend(env *Env, ports *PortSpec, rateBudget *RateBudget) (DiscoveryBackend, error) {
+	if len(ports.udp) > 0 {
+		return nil, fmt.Errorf("connect backend cannot scan UDP ports")
+	}
+	if ports.masscanTopPorts > 0 {
+		return nil, fmt.Errorf("connect backend needs nmap-services to resolve top-%d", ports.masscanTopPorts)
+	}
+	appConfig := env.Config
+	if appConfig.ConnectConcurrency == 0 {
+		return nil, fmt.Errorf("connect concurrency must be at least 1")
+	}
+	if appConfig.ConnectTimeout <= 0 {
+		return nil, fmt.Errorf("connect timeout must be greater than 0")
+	}
+
+	backend := &connectBackend{
+		env:        env,
+		timeout:    appConfig.ConnectTimeout,
+		retries:    appConfig.ConnectRetries,
+		semaphore:  make(chan struct{}, appConfig.ConnectConcurrency),
+		rateBudget: rateBudget,
+	}
+	for _, r := range ports.tcp {
+		for port := uint32(r.start); port <= uint32(r.end); port++ {
+			backend.ports = append(backend.ports, uint16(port))
+		}
+	}
+	return backend, nil
+}
+
+func (b *connectBackend) Name() string {
+	return BackendConnect
+}
+
+func (b *connectBackend) Scan(ctx context.Context, tag string, batch []string) ([]MasscanResult, error) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	results := make([]MasscanResult, 0)
+
+	// 分配速率，和 masscan 一样，其他扫描占用了太多速率时会在这里等待
+	grant, err := b.rateBudget.Acquire(ctx, batch, b.env.Config.MasscanRate)
+	if err != nil {
+		return nil, err
+	}
+	defer b.rateBudget.Release(grant)
+	limiter := newRateLimiter(grant.Rate)
+	b.env.Logger.Debugf("%s connect scan %s, %d ports each, rate %d connections per second", tag, describeBatch(batch), len(b.ports), grant.Rate)
+
+	// 按端口轮流连接每个目标，连接均匀的分布到这批目标上，和 RateBudget 计算分组速率的方式一致
+probe:
+	for _, port := range b.ports {
+		for _, host := range batch {
+			select {
+			case b.semaphore <- struct{}{}:
+			case <-ctx.Done():
+				break probe
+			}
+			wg.Add(1)
+			go func(host string, port uint16) {
+				defer func() {
+					<-b.semaphore
+					wg.Done()
+				}()
+				if b.probe(ctx, limiter, host, port) {
+					lock.Lock()
+					results = append(results, MasscanResult{
+						Host:      host,
+						Port:      uint(port),
+						Protocol:  ProtocolTCP,
+						Timestamp: time.Now(),
+					})
+					lock.Unlock()
+				}
+			}(host, port)
+		}
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Host != results[j].Host {
+			return results[i].Host < results[j].Host
+		}
+		return results[i].Port < results[j].Port
+	})
+	return results, nil
+}
+
+// probe 尝试连接一个端口，超时或者出错时重试，连接被拒绝说明端口是关闭的，不需要重试
+func (b *connectBackend) probe(ctx context.Context, limiter *rateLimiter, host string, port uint16) bool {
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	dialer := net.Dialer{Timeout: b.timeout}
+	for attempt := uint(0); attempt <= b.retries; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return false
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			_ = conn.Close()
+			return true
+		}
+		if ctx.Err() != nil || errors.Is(err, syscall.ECONNREFUSED) {
+			return false
+		}
+	}
+	return false
+}
+
+// rateLimiter 把请求均匀的分布到每一秒中，一批目标的所有连接共享
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter 创建一个每秒最多 rate 次的限速器，rate 为 0 时不限速
+func newRateLimiter(rate uint) *rateLimiter {
+	limiter := &rateLimiter{}
+	if rate > 0 {
+		limiter.interval = time.Second / time.Duration(rate)
+	}
+	return limiter
+}
+
+// Wait 等到可以发起下一次请求，ctx 被取消时返回错误
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return ctx.Err()
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	slot := l.next
+	l.next = l.next.Add(l.interval)
+	l.lock.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"cloud-scanner/config"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenLoopback 在本地监听一个随机端口，测试结束时关闭
+func listenLoopback(t *testing.T) uint16 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// closedLoopbackPort 返回一个刚刚关闭的本地端口，连接会被拒绝
+func closedLoopbackPort(t *testing.T) uint16 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	_ = listener.Close()
+	return port
+}
+
+func newTestConnectBackend(t *testing.T, ports string) DiscoveryBackend {
+	t.Helper()
+	spec, err := ParsePortSpec(ports, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := config.AppConfig{
+		ConnectConcurrency: 4,
+		ConnectTimeout:     time.Second,
+		ConnectRetries:     1,
+		MasscanRate:        1000,
+	}
+	env := NewEnv(&appConfig, nil)
+	budget, err := NewRateBudget(env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewConnectBackend(env, spec, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestConnectBackendScan(t *testing.T) {
+	open1, open2 := listenLoopback(t), listenLoopback(t)
+	closed := closedLoopbackPort(t)
+	backend := newTestConnectBackend(t, fmt.Sprintf("%d,%d,%d", open1, open2, closed))
+
+	results, err := backend.Scan(context.Background(), "[test]", []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint{uint(open1), uint(open2)}
+	if want[0] > want[1] {
+		want[0], want[1] = want[1], want[0]
+	}
+	if len(results) != len(want) {
+		t.Fatalf("Scan() = %+v, want ports %v", results, want)
+	}
+	for i, r := range results {
+		if r.Host != "127.0.0.1" || r.Port != want[i] || r.Protocol != ProtocolTCP {
+			t.Errorf("result %d = %+v, want 127.0.0.1 tcp/%d", i, r, want[i])
+		}
+	}
+}
+
+func TestConnectBackendCanceled(t *testing.T) {
+	backend := newTestConnectBackend(t, fmt.Sprintf("%d", listenLoopback(t)))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := backend.Scan(ctx, "[test]", []string{"127.0.0.1"}); err == nil {
+		t.Errorf("Scan with a canceled ctx should return an error")
+	}
+}
+
+func TestNewConnectBackendInvalid(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	tests := []struct {
+		ports     string
+		appConfig config.AppConfig
+	}{
+		{"U:53", config.AppConfig{ConnectConcurrency: 1, ConnectTimeout: time.Second}},
+		{"top-100", config.AppConfig{ConnectConcurrency: 1, ConnectTimeout: time.Second}},
+		{"80", config.AppConfig{ConnectConcurrency: 0, ConnectTimeout: time.Second}},
+		{"80", config.AppConfig{ConnectConcurrency: 1, ConnectTimeout: 0}},
+	}
+	for _, test := range tests {
+		spec, err := ParsePortSpec(test.ports, missing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appConfig := test.appConfig
+		if _, err := NewConnectBackend(NewEnv(&appConfig, nil), spec, nil); err == nil {
+			t.Errorf("NewConnectBackend(%q, %+v) should fail", test.ports, test.appConfig)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(100)
+	started := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 第一次不用等，后面每次间隔 10ms
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Errorf("6 requests at 100/s took %v, want at least 50ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newRateLimiter(1).Wait(ctx); err == nil {
+		t.Errorf("Wait with a canceled ctx should return an error")
+	}
+}
+
+func TestConnectBackendRatePerSubnet(t *testing.T) {
+	ports := make([]string, 0, 6)
+	for i := 0; i < 6; i++ {
+		ports = append(ports, fmt.Sprintf("%d", closedLoopbackPort(t)))
+	}
+	spec, err := ParsePortSpec(strings.Join(ports, ","), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := config.AppConfig{
+		ConnectConcurrency: 4,
+		ConnectTimeout:     time.Second,
+		MasscanRate:        1000,
+		RatePerSubnet:      20,
+	}
+	env := NewEnv(&appConfig, nil)
+	budget, err := NewRateBudget(env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewConnectBackend(env, spec, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 127.0.0.1 所在的 /24 每秒最多 20 个连接，6 个连接至少要 250ms
+	started := time.Now()
+	if _, err := backend.Scan(context.Background(), "[test]", []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Errorf("6 connections at 20/s to one /24 took %v, want at least 250ms", elapsed)
+	}
+}
+
+func TestConnectBackendSharedRateBudget(t *testing.T) {
+	ports := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		ports = append(ports, fmt.Sprintf("%d", closedLoopbackPort(t)))
+	}
+	spec, err := ParsePortSpec(strings.Join(ports, ","), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := config.AppConfig{MasscanRate: 20}
+	budget, err := NewRateBudget(NewEnv(&shared, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个扫描各自的速率是 1000，但是共享的速率只有每秒 20 个连接，8 个连接至少要 300ms
+	var wg sync.WaitGroup
+	started := time.Now()
+	for i := 0; i < 2; i++ {
+		appConfig := config.AppConfig{ConnectConcurrency: 4, ConnectTimeout: time.Second, MasscanRate: 1000, MasscanWorkerCount: 1}
+		env := NewEnv(&appConfig, nil)
+		queue := make(chan Target)
+		defer budget.Attach(env, &queue)()
+		backend, err := NewConnectBackend(env, spec, budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := backend.Scan(context.Background(), "[test]", []string{"127.0.0.1"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(started); elapsed < 300*time.Millisecond {
+		t.Errorf("8 connections of two scans sharing 20/s took %v, want at least 300ms", elapsed)
+	}
+}
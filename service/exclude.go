@@ -0,0 +1,190 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// reservedPrefixes 保留地址段，打开 --exclude-reserved 时这些地址不会交给 masscan
+var reservedPrefixes = []struct {
+	cidr   string
+	reason string
+}{
+	{"0.0.0.0/8", "reserved: this network"},
+	{"10.0.0.0/8", "reserved: RFC1918 private"},
+	{"100.64.0.0/10", "reserved: CGNAT shared address space"},
+	{"127.0.0.0/8", "reserved: loopback"},
+	{"169.254.0.0/16", "reserved: link-local"},
+	{"172.16.0.0/12", "reserved: RFC1918 private"},
+	{"192.0.0.0/24", "reserved: IETF protocol assignments"},
+	{"192.0.2.0/24", "reserved: documentation (TEST-NET-1)"},
+	{"192.88.99.0/24", "reserved: 6to4 relay anycast"},
+	{"192.168.0.0/16", "reserved: RFC1918 private"},
+	{"198.18.0.0/15", "reserved: benchmarking"},
+	{"198.51.100.0/24", "reserved: documentation (TEST-NET-2)"},
+	{"203.0.113.0/24", "reserved: documentation (TEST-NET-3)"},
+	{"224.0.0.0/4", "reserved: multicast"},
+	{"240.0.0.0/4", "reserved: future use"},
+	{"::/128", "reserved: unspecified"},
+	{"::1/128", "reserved: loopback"},
+	{"::ffff:0:0/96", "reserved: IPv4-mapped"},
+	{"64:ff9b:1::/48", "reserved: local-use IPv4/IPv6 translation"},
+	{"100::/64", "reserved: discard-only"},
+	{"2001::/23", "reserved: IETF protocol assignments"},
+	{"2001:db8::/32", "reserved: documentation"},
+	{"fc00::/7", "reserved: unique local"},
+	{"fe80::/10", "reserved: link-local"},
+	{"ff00::/8", "reserved: multicast"},
+}
+
+// excludeRange 一段需要排除的地址
+type excludeRange struct {
+	start  netip.Addr
+	end    netip.Addr
+	reason string
+}
+
+// contains 判断地址是否在这段范围里
+func (r *excludeRange) contains(addr netip.Addr) bool {
+	return addr.BitLen() == r.start.BitLen() && !addr.Less(r.start) && !r.end.Less(addr)
+}
+
+// TargetFilter 过滤掉不在扫描范围内的地址
+type TargetFilter struct {
+	ranges []excludeRange
+}
+
+// NewTargetFilter 根据配置创建一个 TargetFilter
+func NewTargetFilter(env *Env) (*TargetFilter, error) {
+	filter := &TargetFilter{}
+	appConfig := env.Config
+
+	if appConfig.Exclude != "" {
+		for idx, item := range strings.Split(appConfig.Exclude, ",") {
+			if err := filter.add(item, "excluded by --exclude"); err != nil {
+				return nil, fmt.Errorf("--exclude #%d: %w", idx+1, err)
+			}
+		}
+	}
+
+	if appConfig.ExcludeFile != "" {
+		if err := filter.loadFile(appConfig.ExcludeFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if appConfig.ExcludeReserved {
+		for _, item := range reservedPrefixes {
+			prefix := netip.MustParsePrefix(item.cidr)
+			start, end := prefixBounds(prefix)
+			filter.ranges = append(filter.ranges, excludeRange{start: start, end: end, reason: item.reason})
+		}
+	}
+
+	return filter, nil
+}
+
+// loadFile 从文件中读取排除列表，一行一个 IP 或 CIDR，支持 # 注释
+func (f *TargetFilter) loadFile(filename string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("open exclude file %s failed: %w", filename, err)
+	}
+	defer func(fp *os.File) {
+		_ = fp.Close()
+	}(fp)
+
+	reader := bufio.NewReader(fp)
+	lineNo := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read exclude file %s failed: %w", filename, err)
+		}
+		lineNo += 1
+
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			if err := f.add(line, "excluded by --exclude-file"); err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, lineNo, err)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// add 添加一条排除规则，只接受 IP、CIDR 和 IP 段
+func (f *TargetFilter) add(raw string, reason string) error {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	expr, err := ParseTargetExpr(raw)
+	if err != nil {
+		return fmt.Errorf("illegal exclude %q: %w", raw, err)
+	}
+	if expr.kind != targetKindRange {
+		return fmt.Errorf("illegal exclude %q: only IP, CIDR and IP range are allowed", raw)
+	}
+	f.ranges = append(f.ranges, excludeRange{
+		start:  expr.start,
+		end:    expr.end,
+		reason: fmt.Sprintf("%s %s", reason, raw),
+	})
+	return nil
+}
+
+// Check 检查地址是否需要跳过，需要跳过时返回原因
+func (f *TargetFilter) Check(addr netip.Addr) (string, bool) {
+	for i := range f.ranges {
+		if f.ranges[i].contains(addr) {
+			return f.ranges[i].reason, true
+		}
+	}
+	return "", false
+}
+
+// SkippedRange 一段因为同样的原因被跳过的连续地址
+type SkippedRange struct {
+	Start  netip.Addr `json:"start"`
+	End    netip.Addr `json:"end"`
+	Count  uint64     `json:"count"`
+	Reason string     `json:"reason"`
+}
+
+func (r SkippedRange) String() string {
+	if r.Start == r.End {
+		return fmt.Sprintf("%s (%s)", r.Start, r.Reason)
+	}
+	return fmt.Sprintf("%s-%s, %d addresses (%s)", r.Start, r.End, r.Count, r.Reason)
+}
+
+// skipRecorder 记录被跳过的地址
+// 连续的地址会合并成一段，避免排除一个大网段时把内存撑爆
+type skipRecorder struct {
+	ranges []SkippedRange
+	total  uint64
+}
+
+// add 记录一个被跳过的地址
+func (r *skipRecorder) add(addr netip.Addr, reason string) {
+	r.total += 1
+	if n := len(r.ranges); n > 0 {
+		last := &r.ranges[n-1]
+		if last.Reason == reason && last.End.Next() == addr {
+			last.End = addr
+			last.Count += 1
+			return
+		}
+	}
+	r.ranges = append(r.ranges, SkippedRange{Start: addr, End: addr, Count: 1, Reason: reason})
+}
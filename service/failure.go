@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 失败任务所在的阶段
+const (
+	StageMasscan = "masscan"
+	StageNmap    = "nmap"
+)
+
+// 子进程超时被结束之后，最多再等待这么久让它关闭输出
+const processWaitDelay = 5 * time.Second
+
+// 失败记录中最多保留的 stderr 长度
+const maxFailureStderr = 512
+
+// ProcessError masscan/nmap 子进程执行失败，保留退出码和输出用于失败记录
+type ProcessError struct {
+	Name     string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Err      error
+}
+
+// newProcessError 根据 cmd.Run 的错误创建 ProcessError，没有正常退出时退出码为 -1
+func newProcessError(name string, err error, stdout string, stderr string) *ProcessError {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	return &ProcessError{Name: name, ExitCode: exitCode, Stdout: stdout, Stderr: stderr, Err: err}
+}
+
+func (e *ProcessError) Error() string {
+	return fmt.Sprintf("exec %s failed: %v\nstdout: %s\nstderr: %s", e.Name, e.Err, e.Stdout, e.Stderr)
+}
+
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
+
+// runWithRetry 执行一个阶段的任务，每次尝试都有单独的超时，失败之后按指数退避重试
+// 返回尝试的次数和最后一次的错误，ctx 被取消时不再重试
+func (env *Env) runWithRetry(ctx context.Context, tag string, stage string, timeout time.Duration, fn func(ctx context.Context) error) (int, error) {
+	backoff := env.Config.RetryBackoff
+	attempts := 0
+	for {
+		attempts += 1
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err := fn(attemptCtx)
+		timedOut := errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return attempts, err
+		}
+		if timedOut {
+			err = fmt.Errorf("%s timed out after %s: %w", stage, timeout, err)
+		}
+		if uint(attempts) > env.Config.Retries {
+			return attempts, err
+		}
+
+		env.Logger.Warnf("%s %s attempt %d failed, retry in %s. error: %v", tag, stage, attempts, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, err
+		}
+		backoff *= 2
+	}
+}
+
+// FailureRecorder 记录重试之后仍然失败的目标
+// 每行一个目标和它的元数据，失败的阶段、退出码和 stderr 写在 # 后面的注释中，这个文件可以直接作为 --input 重新扫描
+type FailureRecorder struct {
+	lock     sync.Mutex
+	filename string
+	fp       *os.File
+	count    int
+
+	env *Env
+}
+
+// NewFailureRecorder 创建失败记录，文件在第一次失败时才会创建，继续扫描时在原来的文件后面追加
+// 不是继续扫描时删除上一次留下的文件，避免把旧的失败记录当成这次的
+func NewFailureRecorder(env *Env, filename string, resume bool) *FailureRecorder {
+	if !resume {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			env.Logger.Warnf("Error when removing old failed jobs file %s, error: %+v", filename, err)
+		}
+	}
+	return &FailureRecorder{filename: filename, env: env}
+}
+
+// Record 记录一个失败的目标，目标的元数据写成 key=value，重新扫描时会带上
+// 目标来自哪个输入文件的哪一行只写在注释中，重新扫描时记录的是这个文件
+func (r *FailureRecorder) Record(target Target, stage string, attempts int, err error) {
+	if r == nil {
+		return
+	}
+
+	labels := make(map[string]string, len(target.Labels))
+	for key, value := range target.Labels {
+		labels[key] = value
+	}
+	fields := []string{
+		"stage=" + stage,
+		"attempts=" + strconv.Itoa(attempts),
+	}
+	if source, ok := labels[LabelInput]; ok {
+		delete(labels, LabelInput)
+		fields = append(fields, LabelInput+"="+strconv.Quote(source))
+	}
+	// 子进程的错误信息后面跟着完整的输出，这里只保留第一行
+	message, _, _ := strings.Cut(err.Error(), "\n")
+	fields = append(fields, "error="+strconv.Quote(message))
+	var processErr *ProcessError
+	if errors.As(err, &processErr) {
+		fields = append(fields, "exit_code="+strconv.Itoa(processErr.ExitCode))
+		stderr := strings.TrimSpace(processErr.Stderr)
+		if len(stderr) > maxFailureStderr {
+			stderr = stderr[:maxFailureStderr] + "..."
+		}
+		fields = append(fields, "stderr="+strconv.Quote(stderr))
+	}
+	line := fmt.Sprintf("%s # %s\n", FormatTargetLine(target.Host, labels), strings.Join(fields, " "))
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.fp == nil {
+		fp, err := os.OpenFile(r.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			r.env.Logger.Errorf("Cannot open failed jobs file %s, error: %+v", r.filename, err)
+			return
+		}
+		r.fp = fp
+	}
+	if _, err := r.fp.WriteString(line); err != nil {
+		r.env.Logger.Errorf("Error when writing failed jobs file, error: %+v", err)
+		return
+	}
+	r.count += 1
+}
+
+// Count 返回这次扫描记录的失败目标数量
+func (r *FailureRecorder) Count() int {
+	if r == nil {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.count
+}
+
+// Close 关闭失败记录文件
+func (r *FailureRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.fp == nil {
+		return nil
+	}
+	return r.fp.Close()
+}
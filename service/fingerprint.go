@@ -0,0 +1,345 @@
+package service
+
+import (
+	"bytes"
+	"cloud-scanner/config/constant"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 支持的服务识别后端
+const (
+	FingerprintNmap    = "nmap"
+	FingerprintBuiltin = "builtin"
+)
+
+// builtin 后端收到第一段响应之后，再等待这么久没有新数据就认为响应结束了
+const probeIdleWait = 300 * time.Millisecond
+
+// 一个 host 上同时识别的端口数量
+const builtinPortConcurrency = 8
+
+// FingerprintBackend 识别服务的后端，NmapEngine 的 worker 把一个 host 上的开放端口交给它识别
+// 没有识别出来的端口不需要返回，NmapEngine 会把 masscan 的结果保存下来
+type FingerprintBackend interface {
+	// Name 后端的名字，会作为结果的来源
+	Name() string
+
+	// Fingerprint 识别一个 host 上的开放端口，ctx 被取消时需要尽快返回
+	Fingerprint(ctx context.Context, tag string, task NmapJob) ([]PortResult, error)
+}
+
+// nmapBackend 调用 nmap -sV 识别服务
+type nmapBackend struct {
+	env *Env
+}
+
+// NewNmapBackend 创建 nmap 后端，nmap 不在 PATH 中时返回错误
+func NewNmapBackend(env *Env) (FingerprintBackend, error) {
+	if _, err := exec.LookPath("nmap"); err != nil {
+		return nil, fmt.Errorf("nmap not found, install it or use --fingerprint builtin: %w", err)
+	}
+	return &nmapBackend{env: env}, nil
+}
+
+func (b *nmapBackend) Name() string {
+	return ResultSourceNmap
+}
+
+func (b *nmapBackend) Fingerprint(ctx context.Context, tag string, task NmapJob) ([]PortResult, error) {
+	host := task.value[0].Host
+
+	// 生成临时文件名字，同时输出 XML 和 greppable 格式，XML 解析失败时用 greppable 兜底
+	tmpXMLFile := fmt.Sprintf("./%s/nmap_%s.xml", constant.TempDir, task.UUID)
+	tmpGrepFile := fmt.Sprintf("./%s/nmap_%s.gnmap", constant.TempDir, task.UUID)
+	defer b.env.removeTempFile(tag, tmpXMLFile)
+	defer b.env.removeTempFile(tag, tmpGrepFile)
+
+	// 构造 nmap cmd
+	args := []string{host, fmt.Sprintf("-T%d", b.env.Config.NmapTiming), "-sV"}
+	if b.env.Config.VersionIntensity >= 0 {
+		args = append(args, "--version-intensity", strconv.Itoa(b.env.Config.VersionIntensity))
+	}
+	args = append(args, b.env.Config.NmapExtraArgs...)
+	// 按照 masscan 结果中的协议构造端口参数，UDP 端口使用 -sU
+	args = append(args, nmapPortArgs(task.value)...)
+	args = append(args, "-oX", tmpXMLFile, "-oG", tmpGrepFile)
+	cmd := exec.CommandContext(ctx, "nmap", args...)
+	setProcessGroup(cmd)
+	b.env.Logger.Debugf("%s cmd: %s", tag, cmd.String())
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = processWaitDelay
+	err := cmd.Run()
+	strOut, strErr := string(stdout.Bytes()), string(stderr.Bytes())
+	if err != nil {
+		return nil, newProcessError("nmap", err, strOut, strErr)
+	}
+	if b.env.Config.Debug {
+		b.env.Logger.Debugf("%s stdout: %s\nstderr: %s", tag, strOut, strErr)
+	}
+
+	// 解析 nmap 扫描结果，解析失败时只记录日志，端口会作为没有识别的结果保存
+	results, err := parseNmapOutput(b.env.Logger, tmpXMLFile, tmpGrepFile)
+	if err != nil {
+		b.env.Logger.Errorf("%s Error when parsing nmap result of %s, error: %+v", tag, host, err)
+	}
+	return results, nil
+}
+
+// parseNmapOutput 解析 nmap 的输出，优先使用 XML，失败时再解析 greppable 格式
+func parseNmapOutput(logger *zap.SugaredLogger, xmlFile string, grepFile string) ([]PortResult, error) {
+	fp, err := os.Open(xmlFile)
+	if err == nil {
+		results, err := parseNmapXML(fp)
+		_ = fp.Close()
+		if err == nil {
+			return results, nil
+		}
+		logger.Warnf("Error when parsing nmap xml file %s, fallback to greppable output. error: %+v", xmlFile, err)
+	}
+
+	fp, err = os.Open(grepFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func(fp *os.File) {
+		_ = fp.Close()
+	}(fp)
+	return parseNmapGreppable(fp)
+}
+
+// builtinBackend 不依赖 nmap，直接使用 nmap-service-probes 中的 Probe 和规则识别服务
+type builtinBackend struct {
+	env       *Env
+	probes    *ServiceProbes
+	intensity int
+	timeout   time.Duration
+}
+
+// NewBuiltinBackend 读取 nmap-service-probes 创建 builtin 后端
+func NewBuiltinBackend(env *Env, filename string) (FingerprintBackend, error) {
+	probes, err := LoadServiceProbes(filename)
+	if err != nil {
+		return nil, err
+	}
+	rules := 0
+	for _, probe := range probes.probes {
+		rules += len(probe.matches)
+	}
+	env.Logger.Infof("Loaded %d probes and %d match rules from %s, %d rules skipped because of unsupported regex.", len(probes.probes), rules, filename, probes.skipped)
+
+	intensity := env.Config.VersionIntensity
+	if intensity < 0 {
+		// 和 nmap 的默认值一样
+		intensity = 7
+	}
+	return &builtinBackend{
+		env:       env,
+		probes:    probes,
+		intensity: intensity,
+		timeout:   env.Config.FingerprintTimeout,
+	}, nil
+}
+
+func (b *builtinBackend) Name() string {
+	return FingerprintBuiltin
+}
+
+func (b *builtinBackend) Fingerprint(ctx context.Context, tag string, task NmapJob) ([]PortResult, error) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, builtinPortConcurrency)
+	results := make([]PortResult, 0, len(task.value))
+
+	for _, mr := range task.value {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(mr MasscanResult) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			result := b.fingerprintPort(ctx, mr.Host, uint16(mr.Port), mr.Protocol)
+			if result == nil {
+				return
+			}
+			lock.Lock()
+			results = append(results, *result)
+			lock.Unlock()
+		}(mr)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Port < results[j].Port
+	})
+	b.env.Logger.Debugf("%s builtin fingerprint of %s: %d/%d ports identified", tag, task.Target, len(results), len(task.value))
+	return results, nil
+}
+
+// fingerprintPort 识别一个端口，没有识别出来时返回 nil
+// 先用明文识别，识别出来是 SSL 或者是常见的 SSL 端口时，再通过 TLS 识别一次
+func (b *builtinBackend) fingerprintPort(ctx context.Context, host string, port uint16, protocol string) *PortResult {
+	if b.probes.excluded(protocol, port) {
+		return nil
+	}
+
+	match := b.probePort(ctx, host, port, protocol, false)
+	tunnel := ""
+	if protocol == ProtocolTCP && ctx.Err() == nil {
+		if (match != nil && match.service == "ssl") || ((match == nil || match.soft) && b.probes.isSSLPort(port)) {
+			if sslMatch := b.probePort(ctx, host, port, protocol, true); sslMatch != nil {
+				match, tunnel = sslMatch, "ssl"
+			}
+		}
+	}
+	if match == nil {
+		return nil
+	}
+
+	confidence := 10
+	if match.soft {
+		confidence = 8
+	}
+	extraInfo := match.info
+	if match.hostname != "" {
+		if extraInfo != "" {
+			extraInfo += "; "
+		}
+		extraInfo += "Host: " + match.hostname
+	}
+	return &PortResult{
+		Host:       host,
+		Port:       uint(port),
+		Protocol:   protocol,
+		State:      "open",
+		Service:    match.service,
+		Product:    match.product,
+		Version:    match.version,
+		ExtraInfo:  extraInfo,
+		Banner:     formatBanner(match.product, match.version, extraInfo),
+		CPE:        match.cpe,
+		OSType:     match.ostype,
+		Confidence: confidence,
+		Tunnel:     tunnel,
+	}
+}
+
+// probePort 按顺序发送 Probe，硬匹配之后立刻返回，只有软匹配时返回第一个软匹配
+func (b *builtinBackend) probePort(ctx context.Context, host string, port uint16, protocol string, ssl bool) *serviceMatchResult {
+	var soft *serviceMatchResult
+	for _, probe := range b.probes.candidates(protocol, port, ssl, b.intensity) {
+		if ctx.Err() != nil {
+			return nil
+		}
+		// UDP 的空 Probe 不会有响应
+		if protocol == ProtocolUDP && len(probe.payload) == 0 {
+			continue
+		}
+		response, err := b.send(ctx, host, port, protocol, probe, ssl)
+		if err != nil {
+			b.env.Logger.Debugf("probe %s of %s:%d failed: %v", probe.name, host, port, err)
+		}
+		if len(response) == 0 {
+			continue
+		}
+		match := probe.match(latin1(string(response)))
+		if match == nil {
+			continue
+		}
+		if !match.soft {
+			return match
+		}
+		if soft == nil {
+			soft = match
+		}
+	}
+	return soft
+}
+
+// send 建立一个新的连接发送 Probe，读取响应直到连接关闭、超时或者一段时间没有新的数据
+// 出错时返回已经读到的数据
+func (b *builtinBackend) send(ctx context.Context, host string, port uint16, protocol string, probe *serviceProbe, ssl bool) ([]byte, error) {
+	wait := probe.totalWait
+	if b.timeout > 0 && b.timeout < wait {
+		wait = b.timeout
+	}
+	deadline := time.Now().Add(wait)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if ssl {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{InsecureSkipVerify: true}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, protocol, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	// ctx 被取消时关闭连接，让下面的读写立刻返回
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if len(probe.payload) > 0 {
+		_ = conn.SetWriteDeadline(deadline)
+		if _, err := conn.Write(probe.payload); err != nil {
+			return nil, err
+		}
+	}
+
+	var response bytes.Buffer
+	buffer := make([]byte, 4096)
+	readDeadline := deadline
+	for response.Len() < 64*1024 {
+		_ = conn.SetReadDeadline(readDeadline)
+		n, err := conn.Read(buffer)
+		response.Write(buffer[:n])
+		if err != nil {
+			if ne, ok := err.(net.Error); (ok && ne.Timeout()) || err == io.EOF {
+				return response.Bytes(), nil
+			}
+			return response.Bytes(), err
+		}
+		// UDP 一个响应就是一个包
+		if protocol == ProtocolUDP {
+			break
+		}
+		if idle := time.Now().Add(probeIdleWait); idle.Before(deadline) {
+			readDeadline = idle
+		}
+	}
+	return response.Bytes(), nil
+}
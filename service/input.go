@@ -0,0 +1,275 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StdinInput 作为输入文件名时表示从标准输入读取目标
+const StdinInput = "-"
+
+// 压缩格式的魔数，按照内容判断而不是扩展名，管道中的数据也能识别
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ctx 被取消时，每隔这么久尝试一次打开命名管道的写入端，直到阻塞的 open 返回
+const fifoUnblockInterval = 50 * time.Millisecond
+
+// compressedInputExts 压缩输入文件的扩展名，生成输出文件名时会先去掉
+var compressedInputExts = []string{".gz", ".zst", ".zstd"}
+
+// InputName 返回输入在日志和输出文件名中使用的名字，标准输入为 stdin
+func InputName(filename string) string {
+	if filename == StdinInput {
+		return "stdin"
+	}
+	return filename
+}
+
+// TrimCompressedExt 去掉输入文件名中压缩格式的扩展名，targets.txt.gz 返回 targets.txt
+func TrimCompressedExt(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, ext := range compressedInputExts {
+		if strings.HasSuffix(lower, ext) && len(filename) > len(ext) {
+			return filename[:len(filename)-len(ext)]
+		}
+	}
+	return filename
+}
+
+// inputLine 输入中的一行，读取出错时 Err 不为空
+type inputLine struct {
+	No   int
+	Text string
+	Err  error
+}
+
+// readInputLines 在单独的 goroutine 中打开输入并逐行读取，读到一行就交给 TaskBuilder，不用等整个输入读完
+// 标准输入和命名管道可能很久都没有数据，打开 FIFO 时也会一直阻塞到有写入方，
+// 放在单独的 goroutine 中 TaskBuilder 才能在等待时响应退出信号，读完或者出错之后关闭 channel
+func readInputLines(ctx context.Context, filename string) <-chan inputLine {
+	lines := make(chan inputLine)
+	go func() {
+		defer close(lines)
+		send := func(line inputLine) bool {
+			select {
+			case lines <- line:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		reader, err := openInput(ctx, filename)
+		if err != nil {
+			send(inputLine{Err: err})
+			return
+		}
+		defer func(reader io.ReadCloser) {
+			_ = reader.Close()
+		}(reader)
+		// ctx 被取消时关闭输入文件，阻塞在 Read 中的命名管道会立即返回，这个 goroutine 才能退出
+		stop := context.AfterFunc(ctx, reader.interrupt)
+		defer stop()
+
+		bufferReader := bufio.NewReader(reader)
+		lineNo := 0
+		for {
+			text, err := bufferReader.ReadString('\n')
+			if err != nil && err != io.EOF {
+				send(inputLine{No: lineNo + 1, Err: err})
+				return
+			}
+			lineNo += 1
+			// 文件最后一行可能没有换行符，也要处理
+			if text != "" && !send(inputLine{No: lineNo, Text: text}) {
+				return
+			}
+			if err == io.EOF {
+				return
+			}
+		}
+	}()
+	return lines
+}
+
+// openInput 打开输入文件，- 表示标准输入，gzip 和 zstd 压缩的内容会自动解压
+// 命名管道和普通文件一样打开，没有写入方时会阻塞，直到 ctx 被取消
+func openInput(ctx context.Context, filename string) (*inputReader, error) {
+	var fp *os.File
+	if filename == StdinInput {
+		fp = os.Stdin
+	} else {
+		var err error
+		if fp, err = openFile(ctx, filename); err != nil {
+			return nil, err
+		}
+	}
+	closeFile := func() error {
+		// 标准输入不由我们关闭
+		if fp == os.Stdin {
+			return nil
+		}
+		return fp.Close()
+	}
+
+	bufferReader := bufio.NewReader(fp)
+	// 内容少于 4 个字节时 Peek 会返回 EOF，这时候当做没有压缩
+	magic, err := bufferReader.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		_ = closeFile()
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzipReader, err := gzip.NewReader(bufferReader)
+		if err != nil {
+			_ = closeFile()
+			return nil, fmt.Errorf("open gzip input %s failed: %w", InputName(filename), err)
+		}
+		return &inputReader{Reader: gzipReader, file: fp, close: func() error {
+			_ = gzipReader.Close()
+			return closeFile()
+		}}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		reader, err := newZstdReader(ctx, bufferReader)
+		if err != nil {
+			_ = closeFile()
+			return nil, fmt.Errorf("open zstd input %s failed: %w", InputName(filename), err)
+		}
+		return &inputReader{Reader: reader, file: fp, close: func() error {
+			_ = reader.Close()
+			return closeFile()
+		}}, nil
+	}
+	return &inputReader{Reader: bufferReader, file: fp, close: closeFile}, nil
+}
+
+// openFile 打开输入文件，命名管道在没有写入方时 open 会一直阻塞
+// ctx 被取消时以非阻塞的方式打开一次写入端，让阻塞的 open 返回
+func openFile(ctx context.Context, filename string) (*os.File, error) {
+	info, err := os.Stat(filename)
+	if err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		return os.Open(filename)
+	}
+
+	opened := make(chan struct{})
+	defer close(opened)
+	stop := context.AfterFunc(ctx, func() {
+		// 没有读取方时非阻塞地打开写入端会失败，open 可能还没有开始，重试直到它返回
+		for {
+			if writer, err := os.OpenFile(filename, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+				_ = writer.Close()
+			}
+			select {
+			case <-opened:
+				return
+			case <-time.After(fifoUnblockInterval):
+			}
+		}
+	})
+	defer stop()
+
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		_ = fp.Close()
+		return nil, ctx.Err()
+	}
+	return fp, nil
+}
+
+// inputReader 关闭时同时关闭解压器和底层的文件
+type inputReader struct {
+	io.Reader
+	file  *os.File
+	close func() error
+}
+
+func (r *inputReader) Close() error {
+	return r.close()
+}
+
+// interrupt 只关闭底层的文件，让阻塞的 Read 返回，可以和 Read 同时调用
+// 标准输入是阻塞模式的，关闭它也不能打断 Read，不过只有命令行会读取标准输入，退出时进程也结束了
+func (r *inputReader) interrupt() {
+	if r.file != nil && r.file != os.Stdin {
+		_ = r.file.Close()
+	}
+}
+
+// zstdReader 调用 zstd 命令解压，标准库中没有 zstd 的实现
+type zstdReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+
+	waitOnce sync.Once
+	waitErr  error
+}
+
+func newZstdReader(ctx context.Context, input io.Reader) (*zstdReader, error) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return nil, fmt.Errorf("zstd compressed input needs the zstd command: %w", err)
+	}
+	r := &zstdReader{}
+	r.cmd = exec.CommandContext(ctx, "zstd", "-d", "-c", "-q")
+	setProcessGroup(r.cmd)
+	r.cmd.Stdin = input
+	r.cmd.Stderr = &r.stderr
+	r.cmd.WaitDelay = processWaitDelay
+	stdout, err := r.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r.stdout = stdout
+	if err := r.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Read 读到结尾时检查 zstd 的退出状态，损坏或者不完整的数据不会被当做正常结束
+func (r *zstdReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if errors.Is(err, io.EOF) {
+		if waitErr := r.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Close 提前结束时杀掉 zstd
+func (r *zstdReader) Close() error {
+	if r.cmd.ProcessState == nil {
+		_ = r.cmd.Process.Kill()
+	}
+	_ = r.wait()
+	return nil
+}
+
+func (r *zstdReader) wait() error {
+	r.waitOnce.Do(func() {
+		if err := r.cmd.Wait(); err != nil {
+			r.waitErr = newProcessError("zstd", err, "", strings.TrimSpace(r.stderr.String()))
+		}
+	})
+	return r.waitErr
+}
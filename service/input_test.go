@@ -0,0 +1,81 @@
+//go:build !windows
+
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitClosed 等待 readInputLines 关闭 channel，超时说明读取的 goroutine 还阻塞着
+func waitClosed(t *testing.T, lines <-chan inputLine) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, opened := <-lines:
+			if !opened {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("input reader was not stopped after ctx was canceled")
+		}
+	}
+}
+
+func TestReadInputLines(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "targets.txt")
+	if err := os.WriteFile(filename, []byte("1.2.3.4\n\n5.6.7.8 env=prod"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var got []inputLine
+	for line := range readInputLines(context.Background(), filename) {
+		got = append(got, line)
+	}
+	if len(got) != 3 || got[0].Text != "1.2.3.4\n" || got[2].No != 3 || got[2].Text != "5.6.7.8 env=prod" {
+		t.Errorf("readInputLines() = %+v", got)
+	}
+}
+
+func TestReadInputLinesFIFOCanceled(t *testing.T) {
+	dir := t.TempDir()
+
+	// 没有写入方，阻塞在 open 中
+	waiting := filepath.Join(dir, "waiting")
+	if err := syscall.Mkfifo(waiting, 0600); err != nil {
+		t.Skipf("mkfifo is not supported: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	lines := readInputLines(ctx, waiting)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	waitClosed(t, lines)
+
+	// 写入方一直不关闭，阻塞在 Read 中
+	reading := filepath.Join(dir, "reading")
+	if err := syscall.Mkfifo(reading, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	lines = readInputLines(ctx, reading)
+	writer, err := os.OpenFile(reading, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = writer.Close()
+	}()
+	if _, err := writer.WriteString("1.2.3.4\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line := <-lines; line.Text != "1.2.3.4\n" {
+		t.Fatalf("got %+v, want the first line", line)
+	}
+	cancel()
+	waitClosed(t, lines)
+}
@@ -0,0 +1,398 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 支持的云厂商资产清单格式
+const (
+	InventoryAWS    = "aws"
+	InventoryAliyun = "aliyun"
+	InventoryGCP    = "gcp"
+	InventoryAzure  = "azure"
+)
+
+// 资产元数据的字段名，标签以 tag: 开头
+const (
+	LabelProvider   = "provider"
+	LabelAccount    = "account"
+	LabelRegion     = "region"
+	LabelInstanceID = "instance_id"
+	LabelName       = "name"
+	labelTagPrefix  = "tag:"
+)
+
+// InventoryTarget 资产清单中的一个公网地址以及它所属资产的元数据
+type InventoryTarget struct {
+	Address string
+	Labels  map[string]string
+}
+
+// inventoryParser 解析一种云厂商命令行导出的 JSON
+type inventoryParser func(data []byte) ([]InventoryTarget, error)
+
+var inventoryParsers = map[string]inventoryParser{
+	InventoryAWS:    parseAWSInventory,
+	InventoryAliyun: parseAliyunInventory,
+	InventoryGCP:    parseGCPInventory,
+	InventoryAzure:  parseAzureInventory,
+}
+
+// ParseInventorySpec 解析 --inventory 的参数，格式为 [provider:]file，没有指定时根据文件内容识别
+func ParseInventorySpec(spec string) (provider string, filename string) {
+	for name := range inventoryParsers {
+		if value, ok := strings.CutPrefix(spec, name+":"); ok {
+			return name, value
+		}
+	}
+	return "", spec
+}
+
+// LoadInventory 读取一个资产清单文件，返回其中所有的公网地址
+func LoadInventory(spec string) ([]InventoryTarget, error) {
+	provider, filename := ParseInventorySpec(spec)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read inventory file %s: %w", filename, err)
+	}
+	if provider == "" {
+		if provider = detectInventory(data); provider == "" {
+			return nil, fmt.Errorf("cannot detect inventory format of %s, use <aws|aliyun|gcp|azure>:%s", filename, filename)
+		}
+	}
+
+	targets, err := inventoryParsers[provider](data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s inventory %s failed: %w", provider, filename, err)
+	}
+	for _, target := range targets {
+		target.Labels[LabelProvider] = provider
+	}
+	return targets, nil
+}
+
+// detectInventory 根据 JSON 的结构判断是哪个云厂商导出的
+func detectInventory(data []byte) string {
+	var document any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return ""
+	}
+	switch v := document.(type) {
+	case map[string]any:
+		if _, ok := v["Reservations"]; ok {
+			return InventoryAWS
+		}
+		if _, ok := v["Addresses"]; ok {
+			return InventoryAWS
+		}
+		if instances, ok := v["Instances"].(map[string]any); ok {
+			if _, ok := instances["Instance"]; ok {
+				return InventoryAliyun
+			}
+		}
+	case []any:
+		if len(v) == 0 {
+			return ""
+		}
+		item, _ := v[0].(map[string]any)
+		if _, ok := item["networkInterfaces"]; ok {
+			return InventoryGCP
+		}
+		if _, ok := item["publicIPAllocationMethod"]; ok {
+			return InventoryAzure
+		}
+	}
+	return ""
+}
+
+// newInventoryTargets 给资产的每个公网地址生成一个目标，空的和重复的地址跳过
+func newInventoryTargets(labels map[string]string, addresses ...string) []InventoryTarget {
+	targets := make([]InventoryTarget, 0, len(addresses))
+	seen := make(map[string]struct{}, len(addresses))
+	for _, address := range addresses {
+		if address == "" {
+			continue
+		}
+		if _, ok := seen[address]; ok {
+			continue
+		}
+		seen[address] = struct{}{}
+		copied := make(map[string]string, len(labels)+1)
+		for key, value := range labels {
+			if value != "" {
+				copied[key] = value
+			}
+		}
+		targets = append(targets, InventoryTarget{Address: address, Labels: copied})
+	}
+	return targets
+}
+
+// zoneToRegion 可用区去掉最后的字母就是地域，us-east-1a -> us-east-1，us-central1-a -> us-central1
+func zoneToRegion(zone string) string {
+	zone = strings.TrimRight(zone, "abcdefghijklmnopqrstuvwxyz")
+	return strings.TrimSuffix(zone, "-")
+}
+
+type awsTag struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+// awsLabels 把 AWS 的标签加到元数据中，Name 标签同时作为资产的名字
+func awsLabels(labels map[string]string, tags []awsTag) {
+	for _, tag := range tags {
+		labels[labelTagPrefix+tag.Key] = tag.Value
+		if tag.Key == "Name" {
+			labels[LabelName] = tag.Value
+		}
+	}
+}
+
+// parseAWSInventory 解析 aws ec2 describe-instances 或者 describe-addresses 的输出
+func parseAWSInventory(data []byte) ([]InventoryTarget, error) {
+	var document struct {
+		Reservations []struct {
+			OwnerId   string `json:"OwnerId"`
+			Instances []struct {
+				InstanceId      string `json:"InstanceId"`
+				PublicIpAddress string `json:"PublicIpAddress"`
+				Placement       struct {
+					AvailabilityZone string `json:"AvailabilityZone"`
+				} `json:"Placement"`
+				Tags              []awsTag `json:"Tags"`
+				NetworkInterfaces []struct {
+					Association struct {
+						PublicIp string `json:"PublicIp"`
+					} `json:"Association"`
+					Ipv6Addresses []struct {
+						Ipv6Address string `json:"Ipv6Address"`
+					} `json:"Ipv6Addresses"`
+				} `json:"NetworkInterfaces"`
+			} `json:"Instances"`
+		} `json:"Reservations"`
+		Addresses []struct {
+			PublicIp                string   `json:"PublicIp"`
+			AllocationId            string   `json:"AllocationId"`
+			InstanceId              string   `json:"InstanceId"`
+			NetworkInterfaceOwnerId string   `json:"NetworkInterfaceOwnerId"`
+			NetworkBorderGroup      string   `json:"NetworkBorderGroup"`
+			Tags                    []awsTag `json:"Tags"`
+		} `json:"Addresses"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	targets := make([]InventoryTarget, 0)
+	for _, reservation := range document.Reservations {
+		for _, instance := range reservation.Instances {
+			labels := map[string]string{
+				LabelAccount:    reservation.OwnerId,
+				LabelRegion:     zoneToRegion(instance.Placement.AvailabilityZone),
+				LabelInstanceID: instance.InstanceId,
+			}
+			awsLabels(labels, instance.Tags)
+			addresses := []string{instance.PublicIpAddress}
+			for _, nic := range instance.NetworkInterfaces {
+				addresses = append(addresses, nic.Association.PublicIp)
+				for _, ipv6 := range nic.Ipv6Addresses {
+					addresses = append(addresses, ipv6.Ipv6Address)
+				}
+			}
+			targets = append(targets, newInventoryTargets(labels, addresses...)...)
+		}
+	}
+	// 没有绑定到实例上的 EIP 使用分配 ID
+	for _, address := range document.Addresses {
+		instanceID := address.InstanceId
+		if instanceID == "" {
+			instanceID = address.AllocationId
+		}
+		labels := map[string]string{
+			LabelAccount:    address.NetworkInterfaceOwnerId,
+			LabelRegion:     address.NetworkBorderGroup,
+			LabelInstanceID: instanceID,
+		}
+		awsLabels(labels, address.Tags)
+		targets = append(targets, newInventoryTargets(labels, address.PublicIp)...)
+	}
+	return targets, nil
+}
+
+// parseAliyunInventory 解析 aliyun ecs DescribeInstances 的输出
+func parseAliyunInventory(data []byte) ([]InventoryTarget, error) {
+	var document struct {
+		Instances struct {
+			Instance []struct {
+				InstanceId      string `json:"InstanceId"`
+				InstanceName    string `json:"InstanceName"`
+				RegionId        string `json:"RegionId"`
+				ResourceGroupId string `json:"ResourceGroupId"`
+				PublicIpAddress struct {
+					IpAddress []string `json:"IpAddress"`
+				} `json:"PublicIpAddress"`
+				EipAddress struct {
+					IpAddress string `json:"IpAddress"`
+				} `json:"EipAddress"`
+				NetworkInterfaces struct {
+					NetworkInterface []struct {
+						Ipv6Sets struct {
+							Ipv6Set []struct {
+								Ipv6Address string `json:"Ipv6Address"`
+							} `json:"Ipv6Set"`
+						} `json:"Ipv6Sets"`
+					} `json:"NetworkInterface"`
+				} `json:"NetworkInterfaces"`
+				Tags struct {
+					Tag []struct {
+						TagKey   string `json:"TagKey"`
+						TagValue string `json:"TagValue"`
+					} `json:"Tag"`
+				} `json:"Tags"`
+			} `json:"Instance"`
+		} `json:"Instances"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	targets := make([]InventoryTarget, 0)
+	for _, instance := range document.Instances.Instance {
+		// DescribeInstances 的结果中没有账号 ID，用资源组代替
+		labels := map[string]string{
+			LabelAccount:    instance.ResourceGroupId,
+			LabelRegion:     instance.RegionId,
+			LabelInstanceID: instance.InstanceId,
+			LabelName:       instance.InstanceName,
+		}
+		for _, tag := range instance.Tags.Tag {
+			labels[labelTagPrefix+tag.TagKey] = tag.TagValue
+		}
+		addresses := append([]string{}, instance.PublicIpAddress.IpAddress...)
+		addresses = append(addresses, instance.EipAddress.IpAddress)
+		for _, nic := range instance.NetworkInterfaces.NetworkInterface {
+			for _, ipv6 := range nic.Ipv6Sets.Ipv6Set {
+				addresses = append(addresses, ipv6.Ipv6Address)
+			}
+		}
+		targets = append(targets, newInventoryTargets(labels, addresses...)...)
+	}
+	return targets, nil
+}
+
+// parseGCPInventory 解析 gcloud compute instances list --format=json 的输出
+func parseGCPInventory(data []byte) ([]InventoryTarget, error) {
+	var instances []struct {
+		ID                string            `json:"id"`
+		Name              string            `json:"name"`
+		Zone              string            `json:"zone"`
+		SelfLink          string            `json:"selfLink"`
+		Labels            map[string]string `json:"labels"`
+		NetworkInterfaces []struct {
+			AccessConfigs []struct {
+				NatIP string `json:"natIP"`
+			} `json:"accessConfigs"`
+			Ipv6AccessConfigs []struct {
+				ExternalIpv6 string `json:"externalIpv6"`
+			} `json:"ipv6AccessConfigs"`
+		} `json:"networkInterfaces"`
+	}
+	if err := json.Unmarshal(data, &instances); err != nil {
+		return nil, err
+	}
+
+	targets := make([]InventoryTarget, 0)
+	for _, instance := range instances {
+		// zone 和 selfLink 都是完整的 URL：.../projects/<project>/zones/<zone>/...
+		zone := instance.Zone[strings.LastIndex(instance.Zone, "/")+1:]
+		project := ""
+		if _, rest, ok := strings.Cut(instance.SelfLink, "/projects/"); ok {
+			project, _, _ = strings.Cut(rest, "/")
+		}
+		labels := map[string]string{
+			LabelAccount:    project,
+			LabelRegion:     zoneToRegion(zone),
+			LabelInstanceID: instance.ID,
+			LabelName:       instance.Name,
+		}
+		for key, value := range instance.Labels {
+			labels[labelTagPrefix+key] = value
+		}
+		addresses := make([]string, 0)
+		for _, nic := range instance.NetworkInterfaces {
+			for _, access := range nic.AccessConfigs {
+				addresses = append(addresses, access.NatIP)
+			}
+			for _, access := range nic.Ipv6AccessConfigs {
+				addresses = append(addresses, access.ExternalIpv6)
+			}
+		}
+		targets = append(targets, newInventoryTargets(labels, addresses...)...)
+	}
+	return targets, nil
+}
+
+// parseAzureInventory 解析 az network public-ip list 的输出
+func parseAzureInventory(data []byte) ([]InventoryTarget, error) {
+	var addresses []struct {
+		ID            string            `json:"id"`
+		Name          string            `json:"name"`
+		Location      string            `json:"location"`
+		IPAddress     string            `json:"ipAddress"`
+		ResourceGroup string            `json:"resourceGroup"`
+		Tags          map[string]string `json:"tags"`
+	}
+	if err := json.Unmarshal(data, &addresses); err != nil {
+		return nil, err
+	}
+
+	targets := make([]InventoryTarget, 0)
+	for _, address := range addresses {
+		// id 的格式：/subscriptions/<subscription>/resourceGroups/<group>/providers/...
+		subscription := ""
+		if _, rest, ok := strings.Cut(address.ID, "/subscriptions/"); ok {
+			subscription, _, _ = strings.Cut(rest, "/")
+		}
+		labels := map[string]string{
+			LabelAccount:     subscription,
+			LabelRegion:      address.Location,
+			LabelInstanceID:  address.ID,
+			LabelName:        address.Name,
+			"resource_group": address.ResourceGroup,
+		}
+		for key, value := range address.Tags {
+			labels[labelTagPrefix+key] = value
+		}
+		targets = append(targets, newInventoryTargets(labels, address.IPAddress)...)
+	}
+	return targets, nil
+}
+
+// FormatLabels 把元数据格式化成 key=value 的形式，按照 key 排序
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+labels[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+// validInventoryAddress 资产清单中的地址只能是单个 IP
+func validInventoryAddress(address string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid address %q", address)
+	}
+	return addr.Unmap(), nil
+}
@@ -4,46 +4,81 @@ import (
 	"bufio"
 	"bytes"
 	"cloud-scanner/config/constant"
+	"context"
 	"fmt"
 	"github.com/google/uuid"
+	"go.uber.org/zap"
 	"io"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// 批量扫描时，队列里暂时没有新目标的情况下最多等待这么久就开始扫描
+const masscanBatchWait = 200 * time.Millisecond
+
 type MasscanEngine struct {
-	// 引擎状态
-	Status []constant.EngineStatus
+	env *Env
+
+	// 引擎状态，每个 worker 一个，读写时需要加锁
+	Status     []constant.EngineStatus
+	statusLock sync.RWMutex
 
 	// 存放主线程的 wg
 	mainWaitGroup *sync.WaitGroup
 
 	// 接受扫描任务的队列
-	masscanJobChan *chan string
+	masscanJobChan *chan Target
 
 	// 存放扫描结果的队列
 	nmapJobChan *chan NmapJob
+
+	// 单独保存 masscan 结果，没有配置时为 nil
+	saver *MasscanSaver
+
+	// 扫描的统计数据
+	stats *ScanStats
+
+	// 记录扫描进度
+	checkpoint *Checkpoint
+
+	// 发现开放端口的后端
+	backend DiscoveryBackend
+
+	// 识别 tarpit host，不检测时为 nil
+	tarpit *TarpitDetector
+
+	// 记录重试之后仍然失败的目标
+	failures *FailureRecorder
 }
 
 // NewMasscanEngine 创建新的 MasscanEngine
-func NewMasscanEngine(mainWaitGroup *sync.WaitGroup, masscanJobChan *chan string, nmapJobChan *chan NmapJob) *MasscanEngine {
-	status := make([]constant.EngineStatus, appConfig.MasscanWorkerCount)
+func NewMasscanEngine(env *Env, mainWaitGroup *sync.WaitGroup, masscanJobChan *chan Target, nmapJobChan *chan NmapJob, saver *MasscanSaver, stats *ScanStats, checkpoint *Checkpoint, backend DiscoveryBackend, tarpit *TarpitDetector, failures *FailureRecorder) *MasscanEngine {
+	status := make([]constant.EngineStatus, env.Config.MasscanWorkerCount)
 	for i := range status {
 		status[i] = constant.EngineInit
 	}
 	return &MasscanEngine{
+		env:            env,
 		mainWaitGroup:  mainWaitGroup,
 		Status:         status,
 		masscanJobChan: masscanJobChan,
 		nmapJobChan:    nmapJobChan,
+		saver:          saver,
+		stats:          stats,
+		checkpoint:     checkpoint,
+		backend:        backend,
+		tarpit:         tarpit,
+		failures:       failures,
 	}
 }
 
-// Run 启动 Masscan Engine
-func (engine *MasscanEngine) Run() {
+// Run 启动 Masscan Engine，ctx 被取消后会结束正在运行的 masscan 进程
+func (engine *MasscanEngine) Run(ctx context.Context) {
 
 	defer func() {
 		engine.mainWaitGroup.Done()
@@ -53,107 +88,362 @@ func (engine *MasscanEngine) Run() {
 	// 引擎自己控制自己协程组的 waitGroup
 	var waitGroup sync.WaitGroup
 	var i uint = 0
-	for ; i < appConfig.MasscanWorkerCount; i++ {
+	for ; i < engine.env.Config.MasscanWorkerCount; i++ {
 		waitGroup.Add(1)
-		go engine.worker(i, &waitGroup)
+		go engine.worker(ctx, i, &waitGroup)
 	}
 
 	// 等待所有的 worker 运行完成
 	waitGroup.Wait()
-	logger.Infof("MasscanEngine exit.")
+	engine.env.Logger.Infof("MasscanEngine exit.")
 }
 
-func (engine *MasscanEngine) worker(idx uint, wg *sync.WaitGroup) {
+func (engine *MasscanEngine) worker(ctx context.Context, idx uint, wg *sync.WaitGroup) {
 	// 从 masscanChan 中获取任务，当 chan 关闭了之后，就结束 worker
 	defer func() {
+		engine.setStatus(idx, constant.EngineStop)
 		wg.Done()
 	}()
-	logger.Debugf("[MasscanEngine-%d] worker start.", idx)
+	engine.setStatus(idx, constant.EngineRunning)
+	engine.env.Logger.Debugf("[MasscanEngine-%d] worker start.", idx)
 
 	for {
-		task, opened := <-*engine.masscanJobChan
-		// logger.Debugf("[ME-%d] task:%+v, opened:%+v", idx, task, opened)
-		if !opened {
+		batch, opened := engine.nextBatch()
+		if len(batch) == 0 && !opened {
 			break
 		}
 
-		logger.Infof("[MasscanEngine-%d] Get ip: %s", idx, task)
-
-		// tmpOutFile 放到单独的文件夹中
-		randomUUID := uuid.NewString()
-		tmpOutFile := fmt.Sprintf("./%s/masscan_%s", constant.TempDir, randomUUID)
-		cmd := exec.Command(
-			"masscan", task, fmt.Sprintf("--rate=%d", appConfig.MasscanRate), "-p-", "-oL", tmpOutFile,
-		)
-		logger.Debugf("[MasscanEngine-%d] CMD: %s", idx, cmd.String())
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		if err := cmd.Run(); err != nil {
-			logger.Errorf("[MasscanEngine-%d] Error when exec cmd, error: %+v, stdout: %+v, stderr: %+v", idx, err, string(stdout.Bytes()), string(stderr.Bytes()))
+		// 收到退出信号之后不再扫描新的目标，只记录队列中剩下的目标
+		if ctx.Err() != nil {
+			for _, task := range batch {
+				engine.stats.AddNotScanned(task.Host, "cancelled before masscan")
+			}
 			continue
 		}
 
-		if appConfig.Debug {
-			logger.Debugf("[MasscanEngine-%d] stdout: %s", idx, string(stdout.Bytes()))
-			logger.Debugf("[MasscanEngine-%d] stderr: %s", idx, string(stderr.Bytes()))
-		}
-
-		// 读取 masscan 的输出，解析出端口信息
-		// #masscan
-		// open tcp 80 1.1.1.1 1701436172
-		// # end
-		fp, _ := os.Open(tmpOutFile)
-		reader := bufio.NewReader(fp)
-		tmpResult := make([]MasscanResult, 0)
-		for {
-			line, err := reader.ReadString('\n')
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				logger.Warnf("[MasscanEngine-%d] Error when reading masscan temp result file %s, err: %+v", idx, tmpOutFile, err)
-				continue
-			}
-			line = strings.TrimSpace(line)
+		engine.env.Logger.Infof("[MasscanEngine-%d] Get ip: %s", idx, describeBatch(targetHosts(batch)))
+		engine.setStatus(idx, constant.EngineBusy)
+		engine.scan(ctx, idx, batch)
+		engine.setStatus(idx, constant.EngineRunning)
+	}
 
-			// 跳过空行或者井号开头的行
-			if line == "" || strings.HasPrefix(line, "#") {
-				continue
-			}
+	engine.env.Logger.Debugf("[MasscanEngine-%d] worker stop.", idx)
+}
+
+// nextBatch 从队列中取出最多 MasscanBatchSize 个目标
+// 队列里暂时没有新的目标时，最多等待 masscanBatchWait，不会为了凑满一批一直等下去
+// 第二个返回值为 false 表示队列已经关闭了
+func (engine *MasscanEngine) nextBatch() ([]Target, bool) {
+	task, opened := <-*engine.masscanJobChan
+	if !opened {
+		return nil, false
+	}
+	batch := []Target{task}
+	if engine.env.Config.MasscanBatchSize <= 1 {
+		return batch, true
+	}
 
-			// 按照空格切分，取出数据
-			lineParts := strings.Split(line, " ")
-			if len(lineParts) < 5 {
-				logger.Warnf("[MasscanEngine-%d] Error when split line: %s", idx, line)
-				continue
+	timer := time.NewTimer(masscanBatchWait)
+	defer timer.Stop()
+	for uint(len(batch)) < engine.env.Config.MasscanBatchSize {
+		select {
+		case task, opened := <-*engine.masscanJobChan:
+			if !opened {
+				return batch, false
 			}
+			batch = append(batch, task)
+		case <-timer.C:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+// scan 使用发现后端扫描一批目标，按 host 拆分结果，每个目标生成一个 nmap 任务
+// 后端只需要地址，元数据留在引擎中，拆分结果之后再带到 nmap 任务上
+func (engine *MasscanEngine) scan(ctx context.Context, idx uint, batch []Target) {
+	tag := fmt.Sprintf("[MasscanEngine-%d]", idx)
+	name := engine.backend.Name()
+	hosts := targetHosts(batch)
 
-			port, _ := strconv.ParseUint(lineParts[2], 10, 32)
-			r := MasscanResult{
-				Host:     lineParts[3],
-				Protocol: lineParts[1],
-				Port:     uint(port),
+	var results []MasscanResult
+	attempts, err := engine.env.runWithRetry(ctx, tag, name, engine.env.Config.MasscanTimeout, func(ctx context.Context) error {
+		var err error
+		results, err = engine.backend.Scan(ctx, tag, hosts)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			engine.env.Logger.Warnf("%s %s of %s was interrupted.", tag, name, describeBatch(hosts))
+			for _, host := range hosts {
+				engine.stats.AddNotScanned(host, name+" interrupted")
 			}
-			tmpResult = append(tmpResult, r)
+			return
+		}
+		engine.env.Logger.Errorf("%s Error when scanning %s with %s after %d attempts, error: %+v", tag, describeBatch(hosts), name, attempts, err)
+		engine.stats.MasscanFailed.Add(uint64(len(batch)))
+		for _, target := range batch {
+			engine.stats.AddNotScanned(target.Host, name+" failed")
+			engine.failures.Record(target, StageMasscan, attempts, err)
 		}
+		return
+	}
+	engine.stats.MasscanDone.Add(uint64(len(batch)))
+	engine.stats.OpenPorts.Add(uint64(len(results)))
 
-		// TODO 这里未来加个选项，判断是否单独保存 masscan 的结构化扫描结果
-		// 构造 nmap job
-		nmapJob := NmapJob{
-			value: tmpResult,
-			UUID:  randomUUID,
+	// 按 host 拆分结果，masscan 输出的 IPv6 地址写法可能和目标不一样，统一转换之后再比较
+	// 只有一个目标时所有的结果都属于它
+	byHost := make(map[string][]MasscanResult, len(batch))
+	if len(batch) == 1 {
+		byHost[batch[0].Host] = results
+		results = nil
+	}
+	for _, r := range results {
+		key := r.Host
+		if addr, err := netip.ParseAddr(r.Host); err == nil {
+			key = addr.Unmap().String()
 		}
-		// 添加到下一个任务队列中
-		*engine.nmapJobChan <- nmapJob
-		logger.Debugf("[MasscanEngine-%d] Put task %+v to nmap channel", idx, nmapJob)
+		byHost[key] = append(byHost[key], r)
+	}
 
-		// 如果开了 debug 选项，则不删除中间文件
-		if !appConfig.Debug {
-			if err := os.Remove(tmpOutFile); err != nil {
-				logger.Warnf("[MasscanEngine-%d] Error when delete masscan output file. filename: %s, error: %+v", idx, tmpOutFile, err)
-			}
+	for _, task := range batch {
+		taskResults := byHost[task.Host]
+		delete(byHost, task.Host)
+		if taskResults == nil {
+			taskResults = make([]MasscanResult, 0)
+		}
+		engine.emit(ctx, tag, task, taskResults)
+	}
+	for host, hostResults := range byHost {
+		engine.env.Logger.Warnf("%s %s reported %d ports of %s which is not in this batch, ignore them.", tag, name, len(hostResults), host)
+	}
+}
+
+// emit 保存一个目标的 masscan 结果，记录进度，并且生成 nmap 任务
+func (engine *MasscanEngine) emit(ctx context.Context, tag string, task Target, results []MasscanResult) {
+	jobUUID := uuid.NewString()
+
+	// 单独保存 masscan 的结构化扫描结果，tarpit host 也保存全部的原始结果
+	if engine.saver != nil {
+		if err := engine.saver.Save(jobUUID, results); err != nil {
+			engine.env.Logger.Errorf("%s Error when saving masscan result, error: %+v", tag, err)
 		}
 	}
 
-	logger.Debugf("[MasscanEngine-%d] worker stop.", idx)
+	// 所有端口都会响应的 host 只把抽样的端口交给 nmap，其他端口由 nmap 引擎直接保存
+	results, unsampled, tarpit := engine.tarpit.Check(ctx, tag, task.Host, results)
+	if tarpit {
+		engine.stats.Tarpits.Add(1)
+	}
+
+	// 记录进度，中断后继续扫描时不需要再跑 masscan 了
+	engine.checkpoint.MasscanDone(task, jobUUID, results, unsampled, tarpit)
+
+	// 构造 nmap job
+	nmapJob := NmapJob{
+		Target:    task,
+		value:     results,
+		UUID:      jobUUID,
+		tarpit:    tarpit,
+		unsampled: unsampled,
+	}
+	// 添加到下一个任务队列中，nmap 引擎在退出前会一直消费这个队列，这里不会阻塞住
+	if len(results) > 0 {
+		engine.stats.NmapQueued.Add(1)
+	}
+	*engine.nmapJobChan <- nmapJob
+	if tarpit {
+		engine.env.Logger.Debugf("%s Put task of tarpit %s to nmap channel, %d sampled ports %+v, %d unsampled ports", tag, task.Host, len(results), results, len(unsampled))
+	} else {
+		engine.env.Logger.Debugf("%s Put task %+v to nmap channel", tag, nmapJob)
+	}
+}
+
+// targetHosts 取出一批目标的地址
+func targetHosts(batch []Target) []string {
+	hosts := make([]string, 0, len(batch))
+	for _, task := range batch {
+		hosts = append(hosts, task.Host)
+	}
+	return hosts
+}
+
+// describeBatch 在日志中描述一批目标
+func describeBatch(batch []string) string {
+	if len(batch) == 1 {
+		return batch[0]
+	}
+	return fmt.Sprintf("%d targets (%s ... %s)", len(batch), batch[0], batch[len(batch)-1])
+}
+
+// masscanBackend 调用 masscan 发现开放端口
+// 只有一个目标时直接写在命令行上，多个目标时通过 --includefile 传给 masscan
+type masscanBackend struct {
+	env        *Env
+	ports      *PortSpec
+	rateBudget *RateBudget
+}
+
+// NewMasscanBackend 创建 masscan 后端，所有 worker 共享同一个 rateBudget
+func NewMasscanBackend(env *Env, ports *PortSpec, rateBudget *RateBudget) DiscoveryBackend {
+	return &masscanBackend{env: env, ports: ports, rateBudget: rateBudget}
+}
+
+func (b *masscanBackend) Name() string {
+	return "masscan"
+}
+
+func (b *masscanBackend) Scan(ctx context.Context, tag string, batch []string) ([]MasscanResult, error) {
+	// tmpOutFile 放到单独的文件夹中
+	runUUID := uuid.NewString()
+	tmpOutFile := fmt.Sprintf("./%s/masscan_%s", constant.TempDir, runUUID)
+	defer b.env.removeTempFile(tag, tmpOutFile)
+
+	var args []string
+	if len(batch) == 1 {
+		args = append(args, batch[0])
+	} else {
+		tmpIncludeFile := fmt.Sprintf("./%s/masscan_%s.targets", constant.TempDir, runUUID)
+		defer b.env.removeTempFile(tag, tmpIncludeFile)
+		if err := writeIncludeFile(tmpIncludeFile, batch); err != nil {
+			return nil, fmt.Errorf("write masscan include file %s failed: %w", tmpIncludeFile, err)
+		}
+		args = append(args, "--includefile", tmpIncludeFile)
+	}
+
+	// 分配速率，其他 masscan 占用了太多速率时会在这里等待
+	grant, err := b.rateBudget.Acquire(ctx, batch, b.env.Config.MasscanRate)
+	if err != nil {
+		return nil, err
+	}
+	defer b.rateBudget.Release(grant)
+	b.env.Logger.Debugf("%s rate %d pps granted for %s", tag, grant.Rate, describeBatch(batch))
+
+	args = append(args, fmt.Sprintf("--rate=%d", grant.Rate))
+	args = append(args, b.ports.MasscanArgs()...)
+	args = append(args, b.env.Config.MasscanExtraArgs...)
+	args = append(args, "-oL", tmpOutFile)
+	cmd := exec.CommandContext(ctx, "masscan", args...)
+	setProcessGroup(cmd)
+	b.env.Logger.Debugf("%s CMD: %s", tag, cmd.String())
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = processWaitDelay
+	if err := cmd.Run(); err != nil {
+		return nil, newProcessError("masscan", err, string(stdout.Bytes()), string(stderr.Bytes()))
+	}
+
+	if b.env.Config.Debug {
+		b.env.Logger.Debugf("%s stdout: %s", tag, string(stdout.Bytes()))
+		b.env.Logger.Debugf("%s stderr: %s", tag, string(stderr.Bytes()))
+	}
+
+	results, err := parseMasscanList(b.env.Logger, tag, tmpOutFile)
+	if err != nil {
+		return nil, fmt.Errorf("open masscan temp result file %s failed: %w", tmpOutFile, err)
+	}
+	return results, nil
+}
+
+// parseMasscanList 读取 masscan 的 -oL 输出，解析出端口信息
+//
+//	#masscan
+//	open tcp 80 1.1.1.1 1701436172
+//	# end
+func parseMasscanList(logger *zap.SugaredLogger, tag string, filename string) ([]MasscanResult, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func(fp *os.File) {
+		_ = fp.Close()
+	}(fp)
+
+	reader := bufio.NewReader(fp)
+	results := make([]MasscanResult, 0)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logger.Warnf("%s Error when reading masscan temp result file %s, err: %+v", tag, filename, err)
+			break
+		}
+		line = strings.TrimSpace(line)
+
+		// 跳过空行或者井号开头的行
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// 按照空格切分，取出数据
+		lineParts := strings.Split(line, " ")
+		if len(lineParts) < 5 {
+			logger.Warnf("%s Error when split line: %s", tag, line)
+			continue
+		}
+
+		port, _ := strconv.ParseUint(lineParts[2], 10, 32)
+		timestamp, _ := strconv.ParseInt(lineParts[4], 10, 64)
+		results = append(results, MasscanResult{
+			Host:      lineParts[3],
+			Protocol:  lineParts[1],
+			Port:      uint(port),
+			Timestamp: time.Unix(timestamp, 0),
+		})
+	}
+	return results, nil
+}
+
+// writeIncludeFile 把一批目标写成 masscan 的 --includefile，连续的地址合并成一个 IP 段
+func writeIncludeFile(filename string, batch []string) error {
+	var builder strings.Builder
+	var start, end netip.Addr
+	flush := func() {
+		if !start.IsValid() {
+			return
+		}
+		if start == end {
+			builder.WriteString(start.String())
+		} else {
+			builder.WriteString(start.String() + "-" + end.String())
+		}
+		builder.WriteString("\n")
+	}
+	for _, task := range batch {
+		addr, err := netip.ParseAddr(task)
+		if err != nil {
+			return fmt.Errorf("illegal target %q: %w", task, err)
+		}
+		if start.IsValid() && end.Next() == addr {
+			end = addr
+			continue
+		}
+		flush()
+		start, end = addr, addr
+	}
+	flush()
+	return os.WriteFile(filename, []byte(builder.String()), 0644)
+}
+
+// setStatus 更新 worker 的状态
+func (engine *MasscanEngine) setStatus(idx uint, status constant.EngineStatus) {
+	engine.statusLock.Lock()
+	defer engine.statusLock.Unlock()
+	engine.Status[idx] = status
+}
+
+// CountStatus 统计处于某个状态的 worker 数量
+func (engine *MasscanEngine) CountStatus(status constant.EngineStatus) int {
+	engine.statusLock.RLock()
+	defer engine.statusLock.RUnlock()
+	return countStatus(engine.Status, status)
+}
+
+// GetStatus 返回所有 worker 的状态
+func (engine *MasscanEngine) GetStatus() []constant.EngineStatus {
+	engine.statusLock.RLock()
+	defer engine.statusLock.RUnlock()
+	return append([]constant.EngineStatus{}, engine.Status...)
 }
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// masscanRecord masscan 原始结果文件中的一条记录
+type masscanRecord struct {
+	ScanID  string `json:"scan_id"`
+	JobUUID string `json:"job_uuid"`
+	MasscanResult
+}
+
+// MasscanSaver 把 masscan 的原始发现结果单独保存下来，一行一个 JSON
+// 多个 masscan worker 会同时写入，所以需要加锁
+type MasscanSaver struct {
+	env    *Env
+	lock   sync.Mutex
+	fp     *os.File
+	writer *bufio.Writer
+}
+
+// NewMasscanSaver 创建一个新的 MasscanSaver，继续扫描时在原来的文件后面追加
+func NewMasscanSaver(env *Env, filename string, resume bool) (*MasscanSaver, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	fp, err := os.OpenFile(filename, flag, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open masscan output file %s: %w", filename, err)
+	}
+	return &MasscanSaver{
+		env:    env,
+		fp:     fp,
+		writer: bufio.NewWriter(fp),
+	}, nil
+}
+
+// Save 保存一个 masscan 任务的所有结果
+func (s *MasscanSaver) Save(jobUUID string, results []MasscanResult) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, result := range results {
+		data, err := json.Marshal(masscanRecord{
+			ScanID:        s.env.Config.ScanID,
+			JobUUID:       jobUUID,
+			MasscanResult: result,
+		})
+		if err != nil {
+			return err
+		}
+		_, _ = s.writer.Write(data)
+		_ = s.writer.WriteByte('\n')
+	}
+	return s.writer.Flush()
+}
+
+// Close 关闭输出文件
+func (s *MasscanSaver) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_ = s.writer.Flush()
+	return s.fp.Close()
+}
@@ -1,21 +1,19 @@
 package service
 
 import (
-	"bufio"
-	"bytes"
 	"cloud-scanner/config/constant"
+	"context"
 	"fmt"
-	"io"
-	"os"
-	"os/exec"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 )
 
 type NmapEngine struct {
-	// 引擎状态
-	Status []constant.EngineStatus
+	env *Env
+
+	// 引擎状态，每个 worker 一个，读写时需要加锁
+	Status     []constant.EngineStatus
+	statusLock sync.RWMutex
 
 	// 存放主线程的 waitGroup
 	mainWaitGroup *sync.WaitGroup
@@ -29,27 +27,44 @@ type NmapEngine struct {
 	// 存放扫描结果的队列
 	// TODO 修改类型
 	saverJobChan *chan PortResult
+
+	// 扫描的统计数据
+	stats *ScanStats
+
+	// 记录扫描进度
+	checkpoint *Checkpoint
+
+	// 识别服务的后端
+	backend FingerprintBackend
+
+	// 记录重试之后仍然失败的目标
+	failures *FailureRecorder
 }
 
 // NewNmapEngine 创建新的NmapEngine
-func NewNmapEngine(mainWaitGroup *sync.WaitGroup, nmapJobChan *chan NmapJob, saverJobChan *chan PortResult) *NmapEngine {
-	status := make([]constant.EngineStatus, appConfig.NmapWorkerCount)
+func NewNmapEngine(env *Env, mainWaitGroup *sync.WaitGroup, nmapJobChan *chan NmapJob, saverJobChan *chan PortResult, stats *ScanStats, checkpoint *Checkpoint, backend FingerprintBackend, failures *FailureRecorder) *NmapEngine {
+	status := make([]constant.EngineStatus, env.Config.NmapWorkerCount)
 	for i := range status {
 		status[i] = constant.EngineInit
 	}
 
 	var wg sync.WaitGroup
 	return &NmapEngine{
+		env:           env,
 		mainWaitGroup: mainWaitGroup,
 		Status:        status,
 		nmapJobChan:   nmapJobChan,
 		saverJobChan:  saverJobChan,
 		waitGroup:     &wg,
+		stats:         stats,
+		checkpoint:    checkpoint,
+		backend:       backend,
+		failures:      failures,
 	}
 }
 
-// Run 启动 NmapEngine
-func (engine *NmapEngine) Run() {
+// Run 启动 NmapEngine，ctx 被取消后会结束正在运行的 nmap 进程
+func (engine *NmapEngine) Run(ctx context.Context) {
 	defer func() {
 		engine.mainWaitGroup.Done()
 		close(*engine.saverJobChan)
@@ -57,123 +72,174 @@ func (engine *NmapEngine) Run() {
 
 	// 创建引擎自己的 waitGroup
 	var i uint = 0
-	for ; i < appConfig.NmapWorkerCount; i++ {
+	for ; i < engine.env.Config.NmapWorkerCount; i++ {
 		engine.waitGroup.Add(1)
-		go engine.worker(i)
-		engine.Status[i] = constant.EngineRunning
+		go engine.worker(ctx, i)
 	}
 
 	// 等待所有协程
 	engine.waitGroup.Wait()
-	logger.Infof("NmapEngine exit.")
+	engine.env.Logger.Infof("NmapEngine exit.")
 }
 
 // worker 引擎的真正工作函数
-func (engine *NmapEngine) worker(idx uint) {
-	defer engine.waitGroup.Done()
+func (engine *NmapEngine) worker(ctx context.Context, idx uint) {
+	defer func() {
+		engine.setStatus(idx, constant.EngineStop)
+		engine.waitGroup.Done()
+	}()
+	engine.setStatus(idx, constant.EngineRunning)
 	tag := fmt.Sprintf("[NmapEngine-%d]", idx)
-	logger.Debugf("%s worker start.", tag)
+	engine.env.Logger.Debugf("%s worker start.", tag)
 	for {
 		// 当任务队列关闭了之后，退出
 		// TODO 是否需要继续检查一遍 masscan engine 的状态？
 		task, opened := <-*engine.nmapJobChan
-		// logger.Debugf("%s received from nmapJobChan, task: %+v, opened: %+v", tag, task, opened)
+		// engine.env.Logger.Debugf("%s received from nmapJobChan, task: %+v, opened: %+v", tag, task, opened)
 		if !opened {
 			break
 		}
-		logger.Debugf("%s Get task %+v", tag, task)
+		engine.env.Logger.Debugf("%s Get task %+v", tag, task)
 
 		// 跳过没有端口开放的 IP
 		if len(task.value) == 0 {
 			continue
 		}
-		host := task.value[0].Host
 
-		// 生成临时文件名字
-		tmpOutFile := fmt.Sprintf("./%s/nmap_%s", constant.TempDir, task.UUID)
+		// 收到退出信号之后不再启动新的 nmap
+		if ctx.Err() != nil {
+			engine.stats.AddNotFingerprinted(task.value[0].Host, "cancelled before nmap")
+			engine.saveCancelled(tag, task)
+			continue
+		}
+
+		engine.setStatus(idx, constant.EngineBusy)
+		engine.scan(ctx, tag, task)
+		engine.setStatus(idx, constant.EngineRunning)
+	}
 
-		// 构造 port 参数
-		tmpPorts := make([]string, 0, len(task.value))
-		for _, mr := range task.value {
-			tmpPorts = append(tmpPorts, strconv.Itoa(int(mr.Port)))
+	engine.env.Logger.Debugf("%s worker stop.", tag)
+}
+
+// scan 识别一个目标上的服务，把结果放到 saver 的任务队列中
+func (engine *NmapEngine) scan(ctx context.Context, tag string, task NmapJob) {
+	host := task.value[0].Host
+	name := engine.backend.Name()
+
+	var results []PortResult
+	attempts, err := engine.env.runWithRetry(ctx, tag, name, engine.env.Config.NmapTimeout, func(ctx context.Context) error {
+		var err error
+		results, err = engine.backend.Fingerprint(ctx, tag, task)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			engine.env.Logger.Warnf("%s %s of %s was interrupted.", tag, name, host)
+			engine.stats.AddNotFingerprinted(host, name+" interrupted")
+			engine.saveCancelled(tag, task)
+			return
 		}
+		engine.env.Logger.Errorf("%s Error when fingerprinting %s with %s after %d attempts, error: %+v", tag, host, name, attempts, err)
+		engine.stats.NmapFailed.Add(1)
+		engine.stats.AddNotFingerprinted(host, name+" failed")
+		engine.failures.Record(task.Target, StageNmap, attempts, err)
+
+		// nmap 失败的目标不会再重试，保存 masscan 的端口之后同样记录完成
+		count := engine.saveUnidentified(tag, task, nil)
+		engine.checkpoint.NmapFinished(task.Target.Host, task.UUID, count)
+		return
+	}
 
-		// 构造 nmap cmd
-		cmd := exec.Command(
-			"nmap", host, "-T5", "-sV", "-p", strings.Join(tmpPorts, ","), "-oG", tmpOutFile,
-		)
-		logger.Debugf("%s cmd: %s", tag, cmd.String())
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		strOut, strErr := string(stdout.Bytes()), string(stderr.Bytes())
-		if err != nil {
-			logger.Errorf("%s error when exec cmd, error: %+v\nstdout: %s\nstderr: %s", tag, err, strOut, strErr)
-			continue
+	for _, portResult := range results {
+		if portResult.Host == "" {
+			portResult.Host = host
 		}
-		if appConfig.Debug {
-			logger.Debugf("%s stdout: %s\nstderr: %s", tag, strOut, strErr)
+		if task.tarpit {
+			portResult.State = StateTarpit
 		}
+		portResult.Source = name
+		portResult.JobUUID = task.UUID
+		portResult.Labels = task.Target.Labels
+		portResult.Timestamp = time.Now()
 
-		// 解析 nmap 扫描结果
-		// # Nmap 7.80 scan initiated Sun Dec  3 15:49:03 2023 as: nmap -sV -p10022,80,12022 -oG=/tmp/111.txt --open 45.159.49.184
-		// Host: 45.159.49.184 ()  Status: Up
-		// Host: 45.159.49.184 ()  Ports: 80/open/tcp//http//nginx 1.24.0/, 10022/open/tcp//ssh//OpenSSH 9.5p1 Debian 2 (protocol 2.0)/, 12022/open/tcp//ssl|unknown///
-		// # Nmap done at Sun Dec  3 15:50:44 2023 -- 1 IP address (1 host up) scanned in 101.25 seconds
-		fp, _ := os.Open(tmpOutFile)
-		reader := bufio.NewReader(fp)
-		for {
-			line, err := reader.ReadString('\n')
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				logger.Warnf("%s Error when reading nmap temp result file %s, err: %+v", tag, tmpOutFile, err)
-				continue
-			}
-			line = strings.TrimSpace(line)
-
-			// 跳过空行或者井号开头的行
-			if line == "" || strings.HasPrefix(line, "#") {
-				continue
-			}
-
-			// 检查是否为 port 行数据
-			if !strings.Contains(line, "Ports:") {
-				continue
-			}
-
-			lineParts := strings.Split(line, "Ports:")
-			portsRawList := strings.Split(lineParts[1], ",")
-			for _, rawItem := range portsRawList {
-				rawItem = strings.TrimSpace(rawItem)
-				itemPart := strings.Split(rawItem, "/")
-				port, _ := strconv.ParseUint(itemPart[0], 10, 32)
-				protocol := itemPart[2]
-				service := itemPart[4]
-				banner := itemPart[6]
-
-				portResult := PortResult{
-					Host:     host,
-					Port:     uint(port),
-					Protocol: protocol,
-					Service:  service,
-					Banner:   banner,
-				}
-
-				*engine.saverJobChan <- portResult
-				logger.Debugf("%s Put port result `%+v` to channel.", tag, portResult)
-			}
-		}
+		*engine.saverJobChan <- portResult
+		engine.env.Logger.Debugf("%s Put port result `%+v` to channel.", tag, portResult)
+	}
+	engine.stats.NmapDone.Add(1)
 
-		// 如果开了 debug 选项，则不删除中间文件
-		if !appConfig.Debug {
-			if err := os.Remove(tmpOutFile); err != nil {
-				logger.Warnf("%s Error when delete masscan output file. filename: %s, error: %+v", tag, tmpOutFile, err)
-			}
-		}
+	count := len(results) + engine.saveUnidentified(tag, task, results)
 
+	// 等 saver 把这些结果都写完之后，才会在状态文件中记录完成
+	engine.checkpoint.NmapFinished(task.Target.Host, task.UUID, count)
+}
+
+// saveCancelled 处理扫描取消时没有识别的任务
+// 有状态文件时什么都不保存，也不记录 nmap_done，继续扫描时这个任务会完整地重新跑一遍，不会产生重复的结果
+// 没有状态文件时扫描不能继续，只能把 masscan 发现的端口保存下来
+func (engine *NmapEngine) saveCancelled(tag string, task NmapJob) {
+	if engine.checkpoint.Resumable() {
+		engine.env.Logger.Debugf("%s Leave %s to be resumed.", tag, task.Target.Host)
+		return
+	}
+	engine.saveUnidentified(tag, task, nil)
+}
+
+// saveUnidentified 把 masscan 发现了但是 nmap 没有给出结果的端口也保存下来，避免 nmap 出错时丢失端口
+// tarpit host 上没有抽到的端口也在这里保存，这样结果中有这个 host 的所有端口
+// 返回保存的结果数量
+func (engine *NmapEngine) saveUnidentified(tag string, task NmapJob, identified []PortResult) int {
+	seen := make(map[string]struct{}, len(identified))
+	for _, r := range identified {
+		seen[fmt.Sprintf("%s/%d", r.Protocol, r.Port)] = struct{}{}
 	}
 
-	logger.Debugf("%s worker stop.", tag)
+	count := 0
+	ports := task.value
+	if len(task.unsampled) > 0 {
+		ports = append(append(make([]MasscanResult, 0, len(task.value)+len(task.unsampled)), task.value...), task.unsampled...)
+	}
+	for _, mr := range ports {
+		if _, ok := seen[fmt.Sprintf("%s/%d", mr.Protocol, mr.Port)]; ok {
+			continue
+		}
+		count += 1
+		state := "open"
+		if task.tarpit {
+			state = StateTarpit
+		}
+		portResult := PortResult{
+			Host:      mr.Host,
+			Port:      mr.Port,
+			Protocol:  mr.Protocol,
+			State:     state,
+			Source:    ResultSourceMasscan,
+			JobUUID:   task.UUID,
+			Labels:    task.Target.Labels,
+			Timestamp: mr.Timestamp,
+		}
+		*engine.saverJobChan <- portResult
+		engine.env.Logger.Debugf("%s Put unidentified port result `%+v` to channel.", tag, portResult)
+	}
+	return count
+}
+
+// setStatus 更新 worker 的状态
+func (engine *NmapEngine) setStatus(idx uint, status constant.EngineStatus) {
+	engine.statusLock.Lock()
+	defer engine.statusLock.Unlock()
+	engine.Status[idx] = status
+}
+
+// CountStatus 统计处于某个状态的 worker 数量
+func (engine *NmapEngine) CountStatus(status constant.EngineStatus) int {
+	engine.statusLock.RLock()
+	defer engine.statusLock.RUnlock()
+	return countStatus(engine.Status, status)
+}
+
+// GetStatus 返回所有 worker 的状态
+func (engine *NmapEngine) GetStatus() []constant.EngineStatus {
+	engine.statusLock.RLock()
+	defer engine.statusLock.RUnlock()
+	return append([]constant.EngineStatus{}, engine.Status...)
 }
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nmapRun 对应 nmap -oX 输出的根节点，只保留需要的字段
+type nmapRun struct {
+	XMLName xml.Name   `xml:"nmaprun"`
+	Hosts   []nmapHost `xml:"host"`
+}
+
+type nmapHost struct {
+	Addresses []nmapAddress `xml:"address"`
+	Ports     []nmapPort    `xml:"ports>port"`
+}
+
+type nmapAddress struct {
+	Addr     string `xml:"addr,attr"`
+	AddrType string `xml:"addrtype,attr"`
+}
+
+type nmapPort struct {
+	Protocol string       `xml:"protocol,attr"`
+	PortID   uint         `xml:"portid,attr"`
+	State    nmapState    `xml:"state"`
+	Service  nmapService  `xml:"service"`
+	Scripts  []nmapScript `xml:"script"`
+}
+
+type nmapState struct {
+	State string `xml:"state,attr"`
+}
+
+type nmapService struct {
+	Name       string   `xml:"name,attr"`
+	Product    string   `xml:"product,attr"`
+	Version    string   `xml:"version,attr"`
+	ExtraInfo  string   `xml:"extrainfo,attr"`
+	OSType     string   `xml:"ostype,attr"`
+	Tunnel     string   `xml:"tunnel,attr"`
+	Confidence int      `xml:"conf,attr"`
+	CPEs       []string `xml:"cpe"`
+}
+
+type nmapScript struct {
+	ID     string `xml:"id,attr"`
+	Output string `xml:"output,attr"`
+}
+
+// parseNmapXML 解析 nmap -oX 的输出
+func parseNmapXML(reader io.Reader) ([]PortResult, error) {
+	var run nmapRun
+	if err := xml.NewDecoder(reader).Decode(&run); err != nil {
+		return nil, fmt.Errorf("decode nmap xml failed: %w", err)
+	}
+
+	results := make([]PortResult, 0)
+	for _, host := range run.Hosts {
+		// 一个 host 可能同时有 IP 和 MAC 地址，只取 IP
+		addr := ""
+		for _, address := range host.Addresses {
+			if address.AddrType == "ipv4" || address.AddrType == "ipv6" {
+				addr = address.Addr
+				break
+			}
+		}
+
+		for _, port := range host.Ports {
+			svc := port.Service
+			r := PortResult{
+				Host:       addr,
+				Port:       port.PortID,
+				Protocol:   port.Protocol,
+				State:      port.State.State,
+				Service:    svc.Name,
+				Banner:     formatBanner(svc.Product, svc.Version, svc.ExtraInfo),
+				Product:    svc.Product,
+				Version:    svc.Version,
+				ExtraInfo:  svc.ExtraInfo,
+				CPE:        svc.CPEs,
+				OSType:     svc.OSType,
+				Confidence: svc.Confidence,
+				Tunnel:     svc.Tunnel,
+			}
+			for _, script := range port.Scripts {
+				r.Scripts = append(r.Scripts, ScriptResult{ID: script.ID, Output: script.Output})
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// formatBanner 按照 nmap 的习惯把产品、版本和附加信息拼成一个 banner
+func formatBanner(product string, version string, extraInfo string) string {
+	parts := make([]string, 0, 3)
+	if product != "" {
+		parts = append(parts, product)
+	}
+	if version != "" {
+		parts = append(parts, version)
+	}
+	if extraInfo != "" {
+		parts = append(parts, fmt.Sprintf("(%s)", extraInfo))
+	}
+	return strings.Join(parts, " ")
+}
+
+// greppablePortPattern 匹配 -oG 输出中的一个端口
+// 格式为 port/state/protocol/owner/service/rpc_info/version/
+// version 字段中可能有逗号，所以不能简单的按逗号切分
+var greppablePortPattern = regexp.MustCompile(`(\d+)/([^/]*)/([^/]*)/([^/]*)/([^/]*)/([^/]*)/([^/]*)/`)
+
+// parseNmapGreppable 解析 nmap -oG 的输出，只在 XML 解析失败时作为兜底
+//
+//	# Nmap 7.80 scan initiated Sun Dec  3 15:49:03 2023 as: nmap -sV -p10022,80,12022 -oG=/tmp/111.txt --open 45.159.49.184
+//	Host: 45.159.49.184 ()  Status: Up
+//	Host: 45.159.49.184 ()  Ports: 80/open/tcp//http//nginx 1.24.0/, 10022/open/tcp//ssh//OpenSSH 9.5p1 Debian 2 (protocol 2.0)/, 12022/open/tcp//ssl|unknown///
+//	# Nmap done at Sun Dec  3 15:50:44 2023 -- 1 IP address (1 host up) scanned in 101.25 seconds
+func parseNmapGreppable(reader io.Reader) ([]PortResult, error) {
+	results := make([]PortResult, 0)
+	bufferReader := bufio.NewReader(reader)
+	for {
+		line, err := bufferReader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return results, err
+		}
+		line = strings.TrimSpace(line)
+
+		// 跳过空行、井号开头的行以及不是 port 数据的行
+		if line != "" && !strings.HasPrefix(line, "#") && strings.Contains(line, "Ports:") {
+			host := ""
+			if fields := strings.Fields(strings.TrimPrefix(line, "Host:")); len(fields) > 0 {
+				host = fields[0]
+			}
+
+			// Ports 后面可能还有用 tab 分隔的 Ignored State 等字段
+			portsPart := strings.SplitN(line, "Ports:", 2)[1]
+			if index := strings.Index(portsPart, "\t"); index >= 0 {
+				portsPart = portsPart[:index]
+			}
+
+			for _, item := range greppablePortPattern.FindAllStringSubmatch(portsPart, -1) {
+				port, _ := strconv.ParseUint(item[1], 10, 32)
+				results = append(results, PortResult{
+					Host:     host,
+					Port:     uint(port),
+					State:    item[2],
+					Protocol: item[3],
+					Service:  item[5],
+					// nmap 会把 version 中的斜杠替换成竖线
+					Banner: strings.ReplaceAll(item[7], "|", "/"),
+				})
+			}
+		}
+
+		if err == io.EOF {
+			return results, nil
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testNmapXML = `<?xml version="1.0" encoding="UTF-8"?>
+<nmaprun scanner="nmap" args="nmap -sV -p 22,80 1.2.3.4">
+<host>
+<address addr="1.2.3.4" addrtype="ipv4"/>
+<address addr="00:11:22:33:44:55" addrtype="mac"/>
+<ports>
+<port protocol="tcp" portid="22"><state state="open"/><service name="ssh" product="OpenSSH" version="9.5p1 Debian 2" extrainfo="protocol 2.0" ostype="Linux" conf="10"><cpe>cpe:/a:openbsd:openssh:9.5p1</cpe><cpe>cpe:/o:linux:linux_kernel</cpe></service></port>
+<port protocol="tcp" portid="443"><state state="open"/><service name="http" product="nginx" tunnel="ssl" conf="10"/><script id="http-title" output="Welcome"/></port>
+<port protocol="udp" portid="53"><state state="open|filtered"/><service name="domain" conf="3"/></port>
+</ports>
+</host>
+</nmaprun>
+`
+
+func TestParseNmapXML(t *testing.T) {
+	results, err := parseNmapXML(strings.NewReader(testNmapXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PortResult{
+		{
+			Host: "1.2.3.4", Port: 22, Protocol: "tcp", State: "open", Service: "ssh",
+			Banner: "OpenSSH 9.5p1 Debian 2 (protocol 2.0)", Product: "OpenSSH", Version: "9.5p1 Debian 2", ExtraInfo: "protocol 2.0",
+			CPE: []string{"cpe:/a:openbsd:openssh:9.5p1", "cpe:/o:linux:linux_kernel"}, OSType: "Linux", Confidence: 10,
+		},
+		{
+			Host: "1.2.3.4", Port: 443, Protocol: "tcp", State: "open", Service: "http",
+			Banner: "nginx", Product: "nginx", Confidence: 10, Tunnel: "ssl",
+			Scripts: []ScriptResult{{ID: "http-title", Output: "Welcome"}},
+		},
+		{Host: "1.2.3.4", Port: 53, Protocol: "udp", State: "open|filtered", Service: "domain", Confidence: 3},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("parseNmapXML() =\n%+v\nwant\n%+v", results, want)
+	}
+}
+
+func TestParseNmapXMLInvalid(t *testing.T) {
+	// nmap 被杀掉时 XML 只写了一半
+	for _, data := range []string{"", "not xml", testNmapXML[:len(testNmapXML)/2], "<other></other>"} {
+		if _, err := parseNmapXML(strings.NewReader(data)); err == nil {
+			t.Errorf("parseNmapXML(%q) should fail", data)
+		}
+	}
+}
+
+func TestParseNmapGreppable(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []PortResult
+	}{
+		{
+			name: "empty",
+			data: "",
+			want: []PortResult{},
+		},
+		{
+			name: "comments and status only",
+			data: "# Nmap 7.80 scan initiated\nHost: 1.2.3.4 ()\tStatus: Up\n# Nmap done\n",
+			want: []PortResult{},
+		},
+		{
+			name: "version with commas and slashes",
+			data: "Host: 45.159.49.184 ()\tPorts: 80/open/tcp//http//nginx 1.24.0/, 10022/open/tcp//ssh//OpenSSH 9.5p1, Debian|2 (protocol 2.0)/, 12022/open/tcp//ssl|unknown///\tIgnored State: closed (997)\n",
+			want: []PortResult{
+				{Host: "45.159.49.184", Port: 80, State: "open", Protocol: "tcp", Service: "http", Banner: "nginx 1.24.0"},
+				{Host: "45.159.49.184", Port: 10022, State: "open", Protocol: "tcp", Service: "ssh", Banner: "OpenSSH 9.5p1, Debian/2 (protocol 2.0)"},
+				{Host: "45.159.49.184", Port: 12022, State: "open", Protocol: "tcp", Service: "ssl|unknown", Banner: ""},
+			},
+		},
+		{
+			name: "truncated line without newline",
+			data: "Host: 1.2.3.4 ()\tPorts: 22/open/tcp//ssh//OpenSSH/, 80/open/tc",
+			want: []PortResult{
+				{Host: "1.2.3.4", Port: 22, State: "open", Protocol: "tcp", Service: "ssh", Banner: "OpenSSH"},
+			},
+		},
+	}
+	for _, test := range tests {
+		results, err := parseNmapGreppable(strings.NewReader(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(results, test.want) {
+			t.Errorf("%s: parseNmapGreppable() =\n%+v\nwant\n%+v", test.name, results, test.want)
+		}
+	}
+}
+
+func TestParseNmapOutputFallback(t *testing.T) {
+	dir := t.TempDir()
+	xmlFile := filepath.Join(dir, "nmap.xml")
+	grepFile := filepath.Join(dir, "nmap.gnmap")
+	if err := os.WriteFile(xmlFile, []byte(testNmapXML[:100]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(grepFile, []byte("Host: 1.2.3.4 ()\tPorts: 22/open/tcp//ssh//OpenSSH/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logger := zap.NewNop().Sugar()
+
+	results, err := parseNmapOutput(logger, xmlFile, grepFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Port != 22 || results[0].Banner != "OpenSSH" {
+		t.Errorf("broken XML should fall back to greppable output, got %+v", results)
+	}
+
+	// 两个文件都没有时返回错误，不能 panic
+	if _, err := parseNmapOutput(logger, filepath.Join(dir, "missing.xml"), filepath.Join(dir, "missing.gnmap")); err == nil {
+		t.Errorf("missing output files should fail")
+	}
+}
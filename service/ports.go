@@ -0,0 +1,306 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 端口协议
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// portRange 一段连续的端口，首尾都包含在内
+type portRange struct {
+	start uint16
+	end   uint16
+}
+
+func (r portRange) String() string {
+	if r.start == r.end {
+		return strconv.Itoa(int(r.start))
+	}
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+// PortSpec 解析后的端口范围
+// 支持以下几种写法，多个之间用逗号分隔：
+//   - 单个端口和端口段：22,80,8000-8100
+//   - 全部 TCP 端口：- 或者 all
+//   - 最常见的 N 个端口：top-1000，按照 nmap-services 中的频率排序
+//   - UDP 端口：U:53,U:161-162,U:top-100，T: 前缀表示 TCP，不写前缀时默认是 TCP
+type PortSpec struct {
+	// 原始的写法
+	Raw string
+
+	tcp []portRange
+	udp []portRange
+
+	// nmap-services 不可用时，TCP 的 top-N 交给 masscan 自带的端口表，servicesErr 是读取 nmap-services 的错误
+	masscanTopPorts int
+	servicesErr     error
+}
+
+// ParsePortSpec 解析端口范围，servicesFile 是 nmap-services 的路径，用于 top-N
+func ParsePortSpec(raw string, servicesFile string) (*PortSpec, error) {
+	spec := &PortSpec{Raw: raw}
+	var services *nmapServices
+
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		protocol := ProtocolTCP
+		if value, ok := cutPrefixFold(item, "U:"); ok {
+			protocol, item = ProtocolUDP, value
+		} else if value, ok := cutPrefixFold(item, "T:"); ok {
+			item = value
+		}
+
+		if item == "-" || strings.EqualFold(item, "all") {
+			spec.add(protocol, portRange{start: 1, end: 65535})
+			continue
+		}
+
+		if value, ok := cutPrefixFold(item, "top-"); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid port spec %q: top-N needs a positive number", item)
+			}
+			if services == nil {
+				var err error
+				services, err = loadNmapServices(servicesFile)
+				if err != nil {
+					// masscan 自带 TCP 的常用端口表，UDP 没有办法兜底
+					if protocol == ProtocolUDP || spec.masscanTopPorts > 0 {
+						return nil, fmt.Errorf("port spec %q needs nmap-services: %w", item, err)
+					}
+					spec.masscanTopPorts = n
+					spec.servicesErr = err
+					continue
+				}
+			}
+			for _, port := range services.top(protocol, n) {
+				spec.add(protocol, portRange{start: port, end: port})
+			}
+			continue
+		}
+
+		r, err := parsePortRange(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port spec %q: %w", item, err)
+		}
+		spec.add(protocol, r)
+	}
+
+	spec.tcp = mergePortRanges(spec.tcp)
+	spec.udp = mergePortRanges(spec.udp)
+	if len(spec.tcp) == 0 && len(spec.udp) == 0 && spec.masscanTopPorts == 0 {
+		return nil, fmt.Errorf("invalid port spec %q: no ports", raw)
+	}
+	return spec, nil
+}
+
+func (s *PortSpec) add(protocol string, r portRange) {
+	if protocol == ProtocolUDP {
+		s.udp = append(s.udp, r)
+	} else {
+		s.tcp = append(s.tcp, r)
+	}
+}
+
+// FallbackTopPorts nmap-services 不可用时返回交给 masscan --top-ports 的数量以及读取 nmap-services 的错误
+func (s *PortSpec) FallbackTopPorts() (int, error) {
+	return s.masscanTopPorts, s.servicesErr
+}
+
+// MasscanArgs 转换成 masscan 的端口参数
+func (s *PortSpec) MasscanArgs() []string {
+	items := make([]string, 0, len(s.tcp)+len(s.udp))
+	for _, r := range s.tcp {
+		items = append(items, r.String())
+	}
+	for _, r := range s.udp {
+		items = append(items, "U:"+r.String())
+	}
+
+	var args []string
+	if len(items) > 0 {
+		args = append(args, "-p"+strings.Join(items, ","))
+	}
+	if s.masscanTopPorts > 0 {
+		args = append(args, "--top-ports", strconv.Itoa(s.masscanTopPorts))
+	}
+	return args
+}
+
+// Contains 判断端口是否在扫描范围内
+// 交给 masscan 的 top-N 不知道具体是哪些端口，只按照明确写出来的端口判断，不能当成所有端口都在范围内
+func (s *PortSpec) Contains(protocol string, port uint) bool {
+	if port == 0 || port > 65535 {
+		return false
+	}
+	if strings.EqualFold(protocol, ProtocolUDP) {
+		return portInRanges(uint16(port), s.udp)
+	}
+	return portInRanges(uint16(port), s.tcp)
+}
+
+// parsePortRange 解析 80 或者 8000-8100
+func parsePortRange(raw string) (portRange, error) {
+	bounds := strings.Split(raw, "-")
+	if len(bounds) > 2 {
+		return portRange{}, fmt.Errorf("too many '-'")
+	}
+	var values [2]uint16
+	for i, bound := range bounds {
+		v, err := strconv.ParseUint(strings.TrimSpace(bound), 10, 16)
+		if err != nil || v == 0 {
+			return portRange{}, fmt.Errorf("port must be between 1 and 65535")
+		}
+		values[i] = uint16(v)
+	}
+	if len(bounds) == 1 {
+		values[1] = values[0]
+	}
+	if values[0] > values[1] {
+		return portRange{}, fmt.Errorf("range start %d is greater than end %d", values[0], values[1])
+	}
+	return portRange{start: values[0], end: values[1]}, nil
+}
+
+// mergePortRanges 排序并合并重叠或者相邻的端口段
+func mergePortRanges(ranges []portRange) []portRange {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	merged := []portRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if uint32(r.start) <= uint32(last.end)+1 {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// nmapPortArgs 把 masscan 发现的端口转换成 nmap 的参数，有 UDP 端口时加上 -sU
+func nmapPortArgs(results []MasscanResult) []string {
+	var tcpPorts, udpPorts []string
+	for _, r := range results {
+		port := strconv.Itoa(int(r.Port))
+		if strings.EqualFold(r.Protocol, ProtocolUDP) {
+			udpPorts = append(udpPorts, port)
+		} else {
+			tcpPorts = append(tcpPorts, port)
+		}
+	}
+
+	if len(udpPorts) == 0 {
+		return []string{"-p", strings.Join(tcpPorts, ",")}
+	}
+	if len(tcpPorts) == 0 {
+		return []string{"-sU", "-p", "U:" + strings.Join(udpPorts, ",")}
+	}
+	// 同时有 TCP 和 UDP 时需要显式的指定 TCP 的扫描方式，否则 nmap 只会扫描 UDP
+	// masscan 本身就需要 root 权限，这里可以使用 SYN 扫描
+	return []string{"-sS", "-sU", "-p", "T:" + strings.Join(tcpPorts, ",") + ",U:" + strings.Join(udpPorts, ",")}
+}
+
+// nmapServices nmap-services 中的端口频率表
+type nmapServices struct {
+	ports map[string][]nmapServicePort
+}
+
+type nmapServicePort struct {
+	port      uint16
+	frequency float64
+}
+
+// loadNmapServices 读取 nmap-services，每一行的格式为：
+//
+//	http	80/tcp	0.484143	# World Wide Web HTTP
+func loadNmapServices(filename string) (*nmapServices, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func(fp *os.File) {
+		_ = fp.Close()
+	}(fp)
+
+	services := &nmapServices{ports: make(map[string][]nmapServicePort)}
+	reader := bufio.NewReader(fp)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read %s failed: %w", filename, err)
+		}
+
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		if fields := strings.Fields(line); len(fields) >= 3 {
+			portProto := strings.SplitN(fields[1], "/", 2)
+			port, portErr := strconv.ParseUint(portProto[0], 10, 16)
+			frequency, freqErr := strconv.ParseFloat(fields[2], 64)
+			if len(portProto) == 2 && portErr == nil && freqErr == nil && port > 0 {
+				protocol := strings.ToLower(portProto[1])
+				services.ports[protocol] = append(services.ports[protocol], nmapServicePort{port: uint16(port), frequency: frequency})
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	for _, ports := range services.ports {
+		sort.SliceStable(ports, func(i, j int) bool {
+			if ports[i].frequency != ports[j].frequency {
+				return ports[i].frequency > ports[j].frequency
+			}
+			return ports[i].port < ports[j].port
+		})
+	}
+	if len(services.ports) == 0 {
+		return nil, fmt.Errorf("no ports found in %s", filename)
+	}
+	return services, nil
+}
+
+// top 返回某个协议下最常见的 n 个端口
+func (s *nmapServices) top(protocol string, n int) []uint16 {
+	ports := s.ports[protocol]
+	if n > len(ports) {
+		n = len(ports)
+	}
+	result := make([]uint16, 0, n)
+	for _, p := range ports[:n] {
+		result = append(result, p.port)
+	}
+	return result
+}
+
+// cutPrefixFold 忽略大小写的 strings.CutPrefix
+func cutPrefixFold(s string, prefix string) (string, bool) {
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
+}
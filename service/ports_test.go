@@ -0,0 +1,121 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testNmapServices = `# Fields in this file are: Service name, portnum/protocol, open-frequency, optional comments
+ssh	22/tcp	0.182286	# Secure Shell Login
+http	80/tcp	0.484143	# World Wide Web HTTP
+https	443/tcp	0.208669	# secure http (SSL)
+telnet	23/tcp	0.221265
+domain	53/udp	0.213496	# Domain Name Server
+snmp	161/udp	0.433467
+ntp	123/udp	0.330879
+`
+
+func writeTestServices(t *testing.T) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "nmap-services")
+	if err := os.WriteFile(filename, []byte(testNmapServices), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestParsePortSpec(t *testing.T) {
+	services := writeTestServices(t)
+	tests := []struct {
+		raw  string
+		args []string
+	}{
+		{"80", []string{"-p80"}},
+		{"22,80,8000-8100", []string{"-p22,80,8000-8100"}},
+		{"80,81,82-90,85", []string{"-p80-90"}},
+		{"-", []string{"-p1-65535"}},
+		{"all", []string{"-p1-65535"}},
+		{"top-2", []string{"-p23,80"}},
+		{"T:top-3", []string{"-p23,80,443"}},
+		{"U:top-2", []string{"-pU:123,U:161"}},
+		{"u:53,U:161-162,443", []string{"-p443,U:53,U:161-162"}},
+		{"top-100", []string{"-p22-23,80,443"}},
+	}
+	for _, test := range tests {
+		spec, err := ParsePortSpec(test.raw, services)
+		if err != nil {
+			t.Errorf("ParsePortSpec(%q) error: %v", test.raw, err)
+			continue
+		}
+		if args := spec.MasscanArgs(); !reflect.DeepEqual(args, test.args) {
+			t.Errorf("ParsePortSpec(%q).MasscanArgs() = %v, want %v", test.raw, args, test.args)
+		}
+	}
+}
+
+func TestParsePortSpecInvalid(t *testing.T) {
+	services := writeTestServices(t)
+	for _, raw := range []string{"", ",", "0", "65536", "90-80", "1-2-3", "http", "top-0", "top-x", "U:"} {
+		if _, err := ParsePortSpec(raw, services); err == nil {
+			t.Errorf("ParsePortSpec(%q) should fail", raw)
+		}
+	}
+}
+
+func TestParsePortSpecFallback(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	spec, err := ParsePortSpec("top-100,8080", missing)
+	if err != nil {
+		t.Fatalf("TCP top-N should fall back to masscan: %v", err)
+	}
+	if n, err := spec.FallbackTopPorts(); n != 100 || err == nil {
+		t.Errorf("FallbackTopPorts() = %d, %v, want 100 and an error", n, err)
+	}
+	if args, want := spec.MasscanArgs(), []string{"-p8080", "--top-ports", "100"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("MasscanArgs() = %v, want %v", args, want)
+	}
+
+	// 不知道 masscan 的 top-N 是哪些端口，只有明确写出来的端口在范围内
+	if !spec.Contains(ProtocolTCP, 8080) {
+		t.Errorf("8080 should be contained")
+	}
+	if spec.Contains(ProtocolTCP, 80) || spec.Contains(ProtocolTCP, 31337) {
+		t.Errorf("ports under the top-N fallback should not be contained")
+	}
+
+	for _, raw := range []string{"U:top-10", "top-10,top-20"} {
+		if _, err := ParsePortSpec(raw, missing); err == nil {
+			t.Errorf("ParsePortSpec(%q) without nmap-services should fail", raw)
+		}
+	}
+}
+
+func TestPortSpecContains(t *testing.T) {
+	spec, err := ParsePortSpec("22,8000-8100,U:53", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		protocol string
+		port     uint
+		want     bool
+	}{
+		{ProtocolTCP, 22, true},
+		{"TCP", 8000, true},
+		{ProtocolTCP, 8100, true},
+		{ProtocolTCP, 8101, false},
+		{ProtocolTCP, 53, false},
+		{ProtocolUDP, 53, true},
+		{"UDP", 22, false},
+		{ProtocolTCP, 0, false},
+		{ProtocolTCP, 65536, false},
+	}
+	for _, test := range tests {
+		if got := spec.Contains(test.protocol, test.port); got != test.want {
+			t.Errorf("Contains(%s, %d) = %v, want %v", test.protocol, test.port, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,569 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 没有 totalwaitms 时等待响应的时间，和 nmap 一样
+const defaultProbeWait = 5 * time.Second
+
+// serviceProbe nmap-service-probes 中的一个 Probe
+type serviceProbe struct {
+	protocol string
+	name     string
+	payload  []byte
+	rarity   int
+
+	// 这些端口上的服务一般会响应这个 Probe，优先发送
+	ports    []portRange
+	sslports []portRange
+
+	totalWait time.Duration
+
+	// 这个 Probe 的响应还可以用哪些 Probe 的规则匹配
+	fallbackNames []string
+	fallbacks     []*serviceProbe
+
+	matches []*serviceMatch
+}
+
+// serviceMatch 一条 match 或者 softmatch 规则
+type serviceMatch struct {
+	service string
+	soft    bool
+	pattern *regexp.Regexp
+
+	// 版本信息的模板，可以引用正则中的分组，比如 $1
+	product    string
+	version    string
+	info       string
+	hostname   string
+	ostype     string
+	devicetype string
+	cpe        []string
+}
+
+// serviceMatchResult 一次匹配的结果
+type serviceMatchResult struct {
+	service    string
+	soft       bool
+	product    string
+	version    string
+	info       string
+	hostname   string
+	ostype     string
+	devicetype string
+	cpe        []string
+}
+
+// ServiceProbes 解析后的 nmap-service-probes
+type ServiceProbes struct {
+	probes []*serviceProbe
+
+	// Exclude 指令中的端口不会发送任何 Probe
+	exclude *PortSpec
+
+	// 正则不兼容 Go 的规则数量，这些规则会被跳过
+	skipped int
+}
+
+// LoadServiceProbes 读取 nmap-service-probes
+// nmap 的正则是 PCRE，Go 的 regexp 不支持的语法（比如反向引用、环视）会被跳过
+func LoadServiceProbes(filename string) (*ServiceProbes, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open service probes file %s failed: %w", filename, err)
+	}
+	defer func(fp *os.File) {
+		_ = fp.Close()
+	}(fp)
+	return parseServiceProbes(fp, filename)
+}
+
+func parseServiceProbes(reader io.Reader, filename string) (*ServiceProbes, error) {
+	probes := &ServiceProbes{}
+	var current *serviceProbe
+
+	bufferReader := bufio.NewReader(reader)
+	lineNo := 0
+	for {
+		line, err := bufferReader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read %s failed: %w", filename, err)
+		}
+		lineNo += 1
+
+		if parseErr := probes.parseLine(&current, strings.TrimSpace(line)); parseErr != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNo, parseErr)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	// fallback 引用的 Probe 可能在后面定义，全部读完之后再关联
+	byName := make(map[string]*serviceProbe, len(probes.probes))
+	for _, probe := range probes.probes {
+		byName[probe.protocol+"/"+probe.name] = probe
+	}
+	for _, probe := range probes.probes {
+		for _, name := range probe.fallbackNames {
+			if fallback, ok := byName[probe.protocol+"/"+name]; ok {
+				probe.fallbacks = append(probe.fallbacks, fallback)
+			}
+		}
+		// TCP 的 NULL Probe 的规则对所有 TCP Probe 都适用
+		if null, ok := byName[ProtocolTCP+"/NULL"]; ok && probe.protocol == ProtocolTCP && probe != null {
+			probe.fallbacks = append(probe.fallbacks, null)
+		}
+	}
+
+	if len(probes.probes) == 0 {
+		return nil, fmt.Errorf("no probes found in %s", filename)
+	}
+	return probes, nil
+}
+
+// parseLine 解析一行，current 是正在解析的 Probe
+func (p *ServiceProbes) parseLine(current **serviceProbe, line string) error {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	directive, value, _ := strings.Cut(line, " ")
+	value = strings.TrimSpace(value)
+
+	switch directive {
+	case "Exclude":
+		exclude, err := ParsePortSpec(value, "")
+		if err != nil {
+			return fmt.Errorf("invalid Exclude: %w", err)
+		}
+		p.exclude = exclude
+		return nil
+	case "Probe":
+		probe, err := parseProbe(value)
+		if err != nil {
+			return err
+		}
+		p.probes = append(p.probes, probe)
+		*current = probe
+		return nil
+	}
+
+	probe := *current
+	if probe == nil {
+		return fmt.Errorf("%s before any Probe", directive)
+	}
+	switch directive {
+	case "match", "softmatch":
+		match, err := parseMatch(value, directive == "softmatch")
+		if err != nil {
+			return err
+		}
+		if match == nil {
+			p.skipped += 1
+			return nil
+		}
+		probe.matches = append(probe.matches, match)
+	case "rarity":
+		rarity, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid rarity %q", value)
+		}
+		probe.rarity = rarity
+	case "ports", "sslports":
+		ranges, err := parseProbePorts(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", directive, err)
+		}
+		if directive == "ports" {
+			probe.ports = ranges
+		} else {
+			probe.sslports = ranges
+		}
+	case "totalwaitms":
+		ms, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid totalwaitms %q", value)
+		}
+		probe.totalWait = time.Duration(ms) * time.Millisecond
+	case "fallback":
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				probe.fallbackNames = append(probe.fallbackNames, name)
+			}
+		}
+	default:
+		// tcpwrappedms 之类的指令用不到，忽略
+	}
+	return nil
+}
+
+// parseProbe 解析 Probe TCP GetRequest q|GET / HTTP/1.0\r\n\r\n|
+func parseProbe(value string) (*serviceProbe, error) {
+	fields := strings.SplitN(value, " ", 3)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid Probe %q", value)
+	}
+	protocol := strings.ToLower(fields[0])
+	if protocol != ProtocolTCP && protocol != ProtocolUDP {
+		return nil, fmt.Errorf("invalid Probe protocol %q", fields[0])
+	}
+	rest := fields[2]
+	if len(rest) < 3 || rest[0] != 'q' {
+		return nil, fmt.Errorf("invalid Probe string %q", rest)
+	}
+	delimiter := rest[1]
+	end := strings.IndexByte(rest[2:], delimiter)
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated Probe string %q", rest)
+	}
+	payload, err := unescapeProbeString(rest[2 : 2+end])
+	if err != nil {
+		return nil, err
+	}
+	return &serviceProbe{
+		protocol:  protocol,
+		name:      fields[1],
+		payload:   payload,
+		rarity:    1,
+		totalWait: defaultProbeWait,
+	}, nil
+}
+
+// parseMatch 解析 match 和 softmatch，正则不能编译时返回 nil
+//
+//	match ftp m/^220 ProFTPD (\S+) Server/s p/ProFTPD/ v/$1/ cpe:/a:proftpd:proftpd:$1/
+func parseMatch(value string, soft bool) (*serviceMatch, error) {
+	service, rest, ok := strings.Cut(value, " ")
+	if !ok || len(rest) < 3 || rest[0] != 'm' {
+		return nil, fmt.Errorf("invalid match %q", value)
+	}
+	delimiter := rest[1]
+	end := strings.IndexByte(rest[2:], delimiter)
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated match pattern %q", value)
+	}
+	pattern := rest[2 : 2+end]
+	rest = rest[3+end:]
+
+	// 正则后面紧跟着 s 和 i 两种选项
+	flags := ""
+	for len(rest) > 0 && (rest[0] == 's' || rest[0] == 'i') {
+		flags += rest[:1]
+		rest = rest[1:]
+	}
+
+	match := &serviceMatch{service: service, soft: soft}
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			break
+		}
+		var key, field string
+		var err error
+		if strings.HasPrefix(rest, "cpe:") {
+			key = "cpe"
+			field, rest, err = cutDelimited(rest[len("cpe:"):])
+			// cpe 后面可能跟着一个 a，表示是 CPE 2.2 的写法，用不到
+			rest = strings.TrimPrefix(rest, "a")
+		} else {
+			key = rest[:1]
+			field, rest, err = cutDelimited(rest[1:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid match %q: %w", value, err)
+		}
+		switch key {
+		case "p":
+			match.product = field
+		case "v":
+			match.version = field
+		case "i":
+			match.info = field
+		case "h":
+			match.hostname = field
+		case "o":
+			match.ostype = field
+		case "d":
+			match.devicetype = field
+		case "cpe":
+			match.cpe = append(match.cpe, "cpe:/"+field)
+		}
+	}
+
+	compiled, err := compileProbePattern(pattern, flags)
+	if err != nil {
+		return nil, nil
+	}
+	match.pattern = compiled
+	return match, nil
+}
+
+// cutDelimited 读取 /xxx/ 这种用第一个字符做分隔符的字段
+func cutDelimited(s string) (string, string, error) {
+	if s == "" {
+		return "", "", fmt.Errorf("missing delimiter")
+	}
+	delimiter := s[0]
+	end := strings.IndexByte(s[1:], delimiter)
+	if end < 0 {
+		return "", "", fmt.Errorf("unterminated field %q", s)
+	}
+	return s[1 : 1+end], s[2+end:], nil
+}
+
+// compileProbePattern 把 PCRE 的正则转换成 Go 的正则
+// 响应按照 Latin-1 转成字符串之后再匹配，这样 \xHH 才能匹配到对应的字节
+func compileProbePattern(pattern string, flags string) (*regexp.Regexp, error) {
+	pattern = strings.ReplaceAll(pattern, `\Z`, `\n?\z`)
+	prefix := ""
+	if strings.Contains(flags, "s") {
+		prefix += "s"
+	}
+	if strings.Contains(flags, "i") {
+		prefix += "i"
+	}
+	if prefix != "" {
+		pattern = "(?" + prefix + ")" + pattern
+	}
+	return regexp.Compile(latin1(pattern))
+}
+
+// unescapeProbeString 解析 Probe 字符串中的转义
+func unescapeProbeString(s string) ([]byte, error) {
+	result := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			result = append(result, s[i])
+			continue
+		}
+		i += 1
+		if i >= len(s) {
+			return nil, fmt.Errorf("trailing backslash in %q", s)
+		}
+		switch s[i] {
+		case '0':
+			result = append(result, 0)
+		case 'a':
+			result = append(result, '\a')
+		case 'b':
+			result = append(result, '\b')
+		case 'f':
+			result = append(result, '\f')
+		case 'n':
+			result = append(result, '\n')
+		case 'r':
+			result = append(result, '\r')
+		case 't':
+			result = append(result, '\t')
+		case 'v':
+			result = append(result, '\v')
+		case 'x':
+			if i+3 > len(s) {
+				return nil, fmt.Errorf("invalid \\x escape in %q", s)
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid \\x escape in %q", s)
+			}
+			result = append(result, byte(v))
+			i += 2
+		default:
+			result = append(result, s[i])
+		}
+	}
+	return result, nil
+}
+
+// parseProbePorts 解析 ports 和 sslports，比如 21,43,110,8000-8010
+func parseProbePorts(value string) ([]portRange, error) {
+	var ranges []portRange
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		r, err := parsePortRange(item)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// latin1 把每个字节当成一个字符，转换成 Go 的字符串
+func latin1(s string) string {
+	var builder strings.Builder
+	builder.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		builder.WriteRune(rune(s[i]))
+	}
+	return builder.String()
+}
+
+// fromLatin1 把 latin1 转换出来的字符串还原成原始的字节
+func fromLatin1(s string) string {
+	result := make([]byte, 0, len(s))
+	for _, ch := range s {
+		result = append(result, byte(ch))
+	}
+	return string(result)
+}
+
+// portInRanges 判断端口是否在这些端口段中
+func portInRanges(port uint16, ranges []portRange) bool {
+	for _, r := range ranges {
+		if port >= r.start && port <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded 判断端口是否在 Exclude 指令中
+func (p *ServiceProbes) excluded(protocol string, port uint16) bool {
+	if p.exclude == nil {
+		return false
+	}
+	if protocol == ProtocolUDP {
+		return portInRanges(port, p.exclude.udp)
+	}
+	return portInRanges(port, p.exclude.tcp)
+}
+
+// isSSLPort 判断端口是否是常见的 SSL 端口
+func (p *ServiceProbes) isSSLPort(port uint16) bool {
+	for _, probe := range p.probes {
+		if portInRanges(port, probe.sslports) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates 按照发送顺序返回一个端口需要尝试的 Probe
+//   - TCP 的 NULL Probe 最先发送，只等待服务端主动发送的 banner
+//   - ports（SSL 连接时是 sslports）中包含这个端口的 Probe
+//   - 剩下的 rarity 不超过 intensity 的 Probe
+func (p *ServiceProbes) candidates(protocol string, port uint16, ssl bool, intensity int) []*serviceProbe {
+	var null, hinted, others []*serviceProbe
+	for _, probe := range p.probes {
+		if probe.protocol != protocol {
+			continue
+		}
+		if probe.name == "NULL" {
+			null = append(null, probe)
+			continue
+		}
+		hints := probe.ports
+		if ssl {
+			hints = probe.sslports
+		}
+		if portInRanges(port, hints) {
+			hinted = append(hinted, probe)
+		} else if probe.rarity <= intensity {
+			others = append(others, probe)
+		}
+	}
+	return append(append(null, hinted...), others...)
+}
+
+// match 用 Probe 自己的规则以及 fallback 的规则匹配响应，硬匹配优先
+func (probe *serviceProbe) match(response string) *serviceMatchResult {
+	var soft *serviceMatchResult
+	groups := append([]*serviceProbe{probe}, probe.fallbacks...)
+	for _, group := range groups {
+		for _, rule := range group.matches {
+			submatches := rule.pattern.FindStringSubmatch(response)
+			if submatches == nil {
+				continue
+			}
+			result := rule.apply(submatches)
+			if !rule.soft {
+				return result
+			}
+			if soft == nil {
+				soft = result
+			}
+		}
+	}
+	return soft
+}
+
+// apply 用正则的分组替换版本信息模板中的变量
+func (m *serviceMatch) apply(submatches []string) *serviceMatchResult {
+	groups := make([]string, len(submatches))
+	for i, s := range submatches {
+		groups[i] = fromLatin1(s)
+	}
+	result := &serviceMatchResult{
+		service:    m.service,
+		soft:       m.soft,
+		product:    substituteVersionInfo(m.product, groups),
+		version:    substituteVersionInfo(m.version, groups),
+		info:       substituteVersionInfo(m.info, groups),
+		hostname:   substituteVersionInfo(m.hostname, groups),
+		ostype:     substituteVersionInfo(m.ostype, groups),
+		devicetype: substituteVersionInfo(m.devicetype, groups),
+	}
+	for _, cpe := range m.cpe {
+		result.cpe = append(result.cpe, substituteVersionInfo(cpe, groups))
+	}
+	return result
+}
+
+// versionHelperPattern 版本信息模板中的变量：$1、$P(1)、$SUBST(1,"_",".")、$I(1,">")
+var versionHelperPattern = regexp.MustCompile(`\$(?:(\d)|P\((\d)\)|SUBST\((\d),"([^"]*)","([^"]*)"\)|I\((\d),"([<>])"\))`)
+
+// substituteVersionInfo 替换模板中的变量
+func substituteVersionInfo(template string, groups []string) string {
+	if !strings.Contains(template, "$") {
+		return template
+	}
+	group := func(s string) string {
+		idx, _ := strconv.Atoi(s)
+		if idx < len(groups) {
+			return groups[idx]
+		}
+		return ""
+	}
+	return versionHelperPattern.ReplaceAllStringFunc(template, func(s string) string {
+		m := versionHelperPattern.FindStringSubmatch(s)
+		switch {
+		case m[1] != "":
+			return group(m[1])
+		case m[2] != "":
+			// 只保留可打印字符
+			return strings.Map(func(r rune) rune {
+				if r >= 0x20 && r < 0x7f {
+					return r
+				}
+				return -1
+			}, group(m[2]))
+		case m[3] != "":
+			return strings.ReplaceAll(group(m[3]), m[4], m[5])
+		case m[6] != "":
+			// 把分组中的字节按大端或者小端转换成整数
+			data := group(m[6])
+			var v uint64
+			for i := 0; i < len(data) && i < 8; i++ {
+				if m[7] == ">" {
+					v = v<<8 | uint64(data[i])
+				} else {
+					v |= uint64(data[i]) << (8 * uint(i))
+				}
+			}
+			return strconv.FormatUint(v, 10)
+		}
+		return s
+	})
+}
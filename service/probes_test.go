@@ -0,0 +1,306 @@
+package service
+
+import (
+	"bytes"
+	"cloud-scanner/config"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testServiceProbes = `# 测试用的 nmap-service-probes
+Exclude T:9100-9107
+
+Probe TCP NULL q||
+totalwaitms 1000
+match ssh m/^SSH-([\d.]+)-OpenSSH_([\w._-]+)[ -]/ p/OpenSSH/ v/$2/ i/protocol $1/ cpe:/a:openbsd:openssh:$2/a
+softmatch ftp m/^220[- ]/
+match backref m/^(a)\1/ p/unsupported/
+
+Probe TCP GetRequest q|GET / HTTP/1.0\r\n\r\n|
+rarity 1
+ports 80,8000-8010
+sslports 443
+match http m|^HTTP/1\.[01] \d\d\d .*\r\nServer: nginx/([\d.]+)|s p/nginx/ v/$1/ cpe:/a:igor_sysoev:nginx:$1/
+fallback Later
+
+Probe TCP Later q|\x00\x01later\0|
+rarity 9
+match later m/^LATER$/i p/$P(1)/ v/$SUBST(0,"a","4")/
+
+Probe UDP DNSVersionBindReq q|\0\x06\x01\0\0\x01\0\0\0\0\0\0\x07version\x04bind\0\0\x10\0\x03|
+rarity 1
+ports 53
+match domain m/^\0\x06\x81/ p/dns/
+`
+
+func TestParseServiceProbes(t *testing.T) {
+	probes, err := parseServiceProbes(strings.NewReader(testServiceProbes), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probes.probes) != 4 {
+		t.Fatalf("got %d probes, want 4", len(probes.probes))
+	}
+	if probes.skipped != 1 {
+		t.Errorf("skipped = %d, want 1 rule with a back reference", probes.skipped)
+	}
+
+	null, get, later, dns := probes.probes[0], probes.probes[1], probes.probes[2], probes.probes[3]
+	if null.name != "NULL" || len(null.payload) != 0 || null.totalWait != time.Second || len(null.matches) != 2 {
+		t.Errorf("NULL probe = %+v", null)
+	}
+	if string(get.payload) != "GET / HTTP/1.0\r\n\r\n" || get.rarity != 1 || get.totalWait != defaultProbeWait {
+		t.Errorf("GetRequest probe = %+v", get)
+	}
+	if !reflect.DeepEqual(get.ports, []portRange{{80, 80}, {8000, 8010}}) || !reflect.DeepEqual(get.sslports, []portRange{{443, 443}}) {
+		t.Errorf("GetRequest ports = %v, sslports = %v", get.ports, get.sslports)
+	}
+	// fallback 引用后面定义的 Probe，TCP 的 Probe 都会带上 NULL
+	if len(get.fallbacks) != 2 || get.fallbacks[0] != later || get.fallbacks[1] != null {
+		t.Errorf("GetRequest fallbacks = %v", get.fallbacks)
+	}
+	if !bytes.Equal(later.payload, []byte("\x00\x01later\x00")) {
+		t.Errorf("Later payload = %q", later.payload)
+	}
+	if dns.protocol != ProtocolUDP || len(dns.fallbacks) != 0 || dns.payload[len(dns.payload)-1] != 0x03 {
+		t.Errorf("UDP probe = %+v", dns)
+	}
+
+	if !probes.excluded(ProtocolTCP, 9100) || probes.excluded(ProtocolTCP, 9108) || probes.excluded(ProtocolUDP, 9100) {
+		t.Errorf("Exclude T:9100-9107 is not applied correctly")
+	}
+	if !probes.isSSLPort(443) || probes.isSSLPort(80) {
+		t.Errorf("isSSLPort is wrong")
+	}
+}
+
+func TestParseServiceProbesInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"# only comments\n",
+		"match ssh m/^SSH/\n",
+		"Probe TCP\n",
+		"Probe SCTP Init q||\n",
+		"Probe TCP Get q|GET /\n",
+		"Probe TCP Get q|\\x4|\n",
+		"Probe TCP NULL q||\nmatch ssh m/^SSH\n",
+		"Probe TCP NULL q||\nmatch ssh s/^SSH/\n",
+		"Probe TCP NULL q||\nmatch ssh m/^SSH/ p/OpenSSH\n",
+		"Probe TCP NULL q||\nrarity high\n",
+		"Probe TCP NULL q||\nports 80-\n",
+		"Probe TCP NULL q||\ntotalwaitms soon\n",
+		"Exclude 0\n",
+	}
+	for _, data := range tests {
+		if _, err := parseServiceProbes(strings.NewReader(data), "test"); err == nil {
+			t.Errorf("parseServiceProbes(%q) should fail", data)
+		}
+	}
+}
+
+func TestServiceProbeMatch(t *testing.T) {
+	probes, err := parseServiceProbes(strings.NewReader(testServiceProbes), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	null, get := probes.probes[0], probes.probes[1]
+
+	tests := []struct {
+		name     string
+		probe    *serviceProbe
+		response string
+		want     *serviceMatchResult
+	}{
+		{
+			name:     "hard match with groups and cpe",
+			probe:    null,
+			response: "SSH-2.0-OpenSSH_9.5p1 Debian-2\r\n",
+			want: &serviceMatchResult{
+				service: "ssh", product: "OpenSSH", version: "9.5p1", info: "protocol 2.0",
+				cpe: []string{"cpe:/a:openbsd:openssh:9.5p1"},
+			},
+		},
+		{
+			name:     "soft match",
+			probe:    null,
+			response: "220 ready\r\n",
+			want:     &serviceMatchResult{service: "ftp", soft: true},
+		},
+		{
+			name:     "dot matches newline with the s flag",
+			probe:    get,
+			response: "HTTP/1.1 200 OK\r\nDate: today\r\nServer: nginx/1.24.0\r\n\r\n",
+			want: &serviceMatchResult{
+				service: "http", product: "nginx", version: "1.24.0",
+				cpe: []string{"cpe:/a:igor_sysoev:nginx:1.24.0"},
+			},
+		},
+		{
+			name:     "rules of fallback probes and version helpers",
+			probe:    get,
+			response: "later",
+			want:     &serviceMatchResult{service: "later", product: "", version: "l4ter"},
+		},
+		{
+			name:     "NULL rules apply to other TCP probes",
+			probe:    get,
+			response: "SSH-1.99-OpenSSH_3.9 x",
+			want: &serviceMatchResult{
+				service: "ssh", product: "OpenSSH", version: "3.9", info: "protocol 1.99",
+				cpe: []string{"cpe:/a:openbsd:openssh:3.9"},
+			},
+		},
+		{
+			name:     "no match",
+			probe:    get,
+			response: "HTTP/1.1 200 OK\r\nServer: apache\r\n\r\n",
+			want:     nil,
+		},
+	}
+	for _, test := range tests {
+		got := test.probe.match(latin1(test.response))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: match() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSubstituteVersionInfo(t *testing.T) {
+	groups := []string{"all", "1_2_3", "a\x01b", "\x01\x02"}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"plain", "plain"},
+		{"v$1", "v1_2_3"},
+		{"$9", ""},
+		{`$SUBST(1,"_",".")`, "1.2.3"},
+		{"$P(2)", "ab"},
+		{`$I(3,">")`, "258"},
+		{`$I(3,"<")`, "513"},
+	}
+	for _, test := range tests {
+		if got := substituteVersionInfo(test.template, groups); got != test.want {
+			t.Errorf("substituteVersionInfo(%q) = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestServiceProbesCandidates(t *testing.T) {
+	probes, err := parseServiceProbes(strings.NewReader(testServiceProbes), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(candidates []*serviceProbe) []string {
+		result := make([]string, 0, len(candidates))
+		for _, probe := range candidates {
+			result = append(result, probe.name)
+		}
+		return result
+	}
+	tests := []struct {
+		protocol  string
+		port      uint16
+		ssl       bool
+		intensity int
+		want      []string
+	}{
+		{ProtocolTCP, 8005, false, 0, []string{"NULL", "GetRequest"}},
+		{ProtocolTCP, 22, false, 7, []string{"NULL", "GetRequest"}},
+		{ProtocolTCP, 22, false, 9, []string{"NULL", "GetRequest", "Later"}},
+		{ProtocolTCP, 443, true, 0, []string{"NULL", "GetRequest"}},
+		{ProtocolTCP, 443, false, 0, []string{"NULL"}},
+		{ProtocolUDP, 53, false, 0, []string{"DNSVersionBindReq"}},
+	}
+	for _, test := range tests {
+		got := names(probes.candidates(test.protocol, test.port, test.ssl, test.intensity))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("candidates(%s, %d, ssl=%v, %d) = %v, want %v", test.protocol, test.port, test.ssl, test.intensity, got, test.want)
+		}
+	}
+}
+
+// serveFake 在本地监听一个随机端口，每个连接交给 handle 处理
+func serveFake(t *testing.T, handle func(conn net.Conn)) uint16 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				handle(conn)
+			}()
+		}
+	}()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestBuiltinBackendFingerprint(t *testing.T) {
+	// 连接之后立刻发送 banner 的 SSH
+	sshPort := serveFake(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("SSH-2.0-OpenSSH_9.5p1 Debian-2\r\n"))
+	})
+	// 收到请求之后才响应的 HTTP
+	httpPort := serveFake(t, func(conn net.Conn) {
+		buffer := make([]byte, 1024)
+		n, _ := conn.Read(buffer)
+		if strings.HasPrefix(string(buffer[:n]), "GET / ") {
+			_, _ = conn.Write([]byte("HTTP/1.0 200 OK\r\nServer: nginx/1.24.0\r\n\r\n"))
+		}
+	})
+	// 什么都不响应
+	silentPort := serveFake(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 1024))
+	})
+
+	filename := filepath.Join(t.TempDir(), "nmap-service-probes")
+	if err := os.WriteFile(filename, []byte(testServiceProbes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	appConfig := config.AppConfig{VersionIntensity: -1, FingerprintTimeout: 200 * time.Millisecond}
+	backend, err := NewBuiltinBackend(NewEnv(&appConfig, nil), filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := NmapJob{Target: Target{Host: "127.0.0.1"}}
+	for _, port := range []uint16{sshPort, httpPort, silentPort} {
+		job.value = append(job.value, MasscanResult{Host: "127.0.0.1", Port: uint(port), Protocol: ProtocolTCP})
+	}
+	results, err := backend.Fingerprint(context.Background(), "[test]", job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[uint]PortResult)
+	for _, r := range results {
+		found[r.Port] = r
+	}
+	if len(found) != 2 {
+		t.Fatalf("Fingerprint() = %+v, want ssh and http identified", results)
+	}
+	if r := found[uint(sshPort)]; r.Service != "ssh" || r.Product != "OpenSSH" || r.Version != "9.5p1" || r.Confidence != 10 {
+		t.Errorf("ssh result = %+v", r)
+	}
+	if r := found[uint(httpPort)]; r.Service != "http" || r.Banner != "nginx 1.24.0" {
+		t.Errorf("http result = %+v", r)
+	}
+}
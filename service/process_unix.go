@@ -0,0 +1,14 @@
+//go:build !windows
+
+package service
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup 让子进程使用单独的进程组
+// 这样终端上的 Ctrl-C 不会直接发给 masscan/nmap，由我们通过 context 统一结束它们
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
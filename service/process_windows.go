@@ -0,0 +1,8 @@
+//go:build windows
+
+package service
+
+import "os/exec"
+
+// setProcessGroup Windows 下不需要处理
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"cloud-scanner/config/constant"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// TTY 上刷新状态行的最长间隔
+const progressTTYInterval = time.Second
+
+// progressSnapshot 某个时刻的扫描进度
+type progressSnapshot struct {
+	time time.Time
+
+	targetsQueued uint64
+	targetsDone   uint64
+	nmapQueued    uint64
+	nmapDone      uint64
+	openPorts     uint64
+	resultsSaved  uint64
+
+	// 正在运行的 masscan 和 nmap 任务数量
+	masscanInFlight int
+	nmapInFlight    int
+
+	// TaskBuilder 是否已经把所有的目标都放到队列里了，没有的话总数还会增长
+	inputDone bool
+}
+
+// ProgressReporter 定期汇总各个引擎的状态和统计数据，输出扫描进度
+//   - stderr 是终端时，在一行里刷新状态
+//   - 否则定期输出一条结构化的日志
+type ProgressReporter struct {
+	env *Env
+
+	builder *TaskBuilder
+	masscan *MasscanEngine
+	nmap    *NmapEngine
+	stats   *ScanStats
+
+	interval time.Duration
+	output   io.Writer
+	tty      bool
+
+	startedAt time.Time
+	last      progressSnapshot
+}
+
+// NewProgressReporter 创建一个 ProgressReporter，interval 是非终端时输出日志的间隔
+func NewProgressReporter(env *Env, builder *TaskBuilder, masscan *MasscanEngine, nmap *NmapEngine, stats *ScanStats, interval time.Duration) *ProgressReporter {
+	return &ProgressReporter{
+		env:      env,
+		builder:  builder,
+		masscan:  masscan,
+		nmap:     nmap,
+		stats:    stats,
+		interval: interval,
+		output:   os.Stderr,
+		tty:      isTerminal(os.Stderr),
+	}
+}
+
+// Run 定期输出扫描进度，直到 ctx 被取消，退出前会再输出一次最终的进度
+func (p *ProgressReporter) Run(ctx context.Context) {
+	interval := p.interval
+	if p.tty && interval > progressTTYInterval {
+		interval = progressTTYInterval
+	}
+	p.startedAt = time.Now()
+	p.last = progressSnapshot{time: p.startedAt}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.report(false)
+		case <-ctx.Done():
+			p.report(true)
+			return
+		}
+	}
+}
+
+// snapshot 读取当前的进度
+func (p *ProgressReporter) snapshot() progressSnapshot {
+	return progressSnapshot{
+		time:            time.Now(),
+		targetsQueued:   p.stats.TargetsQueued.Load(),
+		targetsDone:     p.stats.MasscanDone.Load() + p.stats.MasscanFailed.Load(),
+		nmapQueued:      p.stats.NmapQueued.Load(),
+		nmapDone:        p.stats.NmapDone.Load() + p.stats.NmapFailed.Load(),
+		openPorts:       p.stats.OpenPorts.Load(),
+		resultsSaved:    p.stats.ResultsSaved.Load(),
+		masscanInFlight: p.masscan.CountStatus(constant.EngineBusy),
+		nmapInFlight:    p.nmap.CountStatus(constant.EngineBusy),
+		inputDone:       p.builder.GetStatus() == constant.EngineStop,
+	}
+}
+
+// report 输出一次进度，final 表示扫描已经结束
+func (p *ProgressReporter) report(final bool) {
+	current := p.snapshot()
+	last := p.last
+	p.last = current
+
+	elapsed := current.time.Sub(last.time).Seconds()
+	masscanRate := perSecond(current.targetsDone-last.targetsDone, elapsed)
+	nmapRate := perSecond(current.nmapDone-last.nmapDone, elapsed)
+	savedRate := perSecond(current.resultsSaved-last.resultsSaved, elapsed)
+	eta, ok := p.estimate(current)
+
+	if p.tty {
+		line := fmt.Sprintf(
+			"targets %d/%d%s | masscan %d running %.1f/s | nmap %d/%d, %d running %.1f/s | ports %d | saved %d %.1f/s | ETA %s",
+			current.targetsDone, current.targetsQueued, totalSuffix(current.inputDone),
+			current.masscanInFlight, masscanRate,
+			current.nmapDone, current.nmapQueued, current.nmapInFlight, nmapRate,
+			current.openPorts, current.resultsSaved, savedRate, formatETA(eta, ok, current.inputDone),
+		)
+		// \r 回到行首，\033[K 清掉上次输出剩下的内容
+		end := ""
+		if final {
+			end = "\n"
+		}
+		_, _ = fmt.Fprintf(p.output, "\r\033[K%s%s", line, end)
+		return
+	}
+
+	p.env.Logger.Infow("Scan progress",
+		"targets_queued", current.targetsQueued,
+		"targets_done", current.targetsDone,
+		"input_done", current.inputDone,
+		"masscan_running", current.masscanInFlight,
+		"masscan_per_sec", round1(masscanRate),
+		"nmap_queued", current.nmapQueued,
+		"nmap_done", current.nmapDone,
+		"nmap_running", current.nmapInFlight,
+		"nmap_per_sec", round1(nmapRate),
+		"open_ports", current.openPorts,
+		"results_saved", current.resultsSaved,
+		"saved_per_sec", round1(savedRate),
+		"eta", formatETA(eta, ok, current.inputDone),
+	)
+}
+
+// estimate 根据开始以来的平均速度估算剩余时间，masscan 和 nmap 两个阶段取较慢的一个
+// 还没有任何任务完成时无法估算
+func (p *ProgressReporter) estimate(current progressSnapshot) (time.Duration, bool) {
+	elapsed := current.time.Sub(p.startedAt).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+
+	var eta float64
+	stages := []struct {
+		queued uint64
+		done   uint64
+	}{
+		{current.targetsQueued, current.targetsDone},
+		{current.nmapQueued, current.nmapDone},
+	}
+	for _, stage := range stages {
+		if stage.done >= stage.queued {
+			continue
+		}
+		if stage.done == 0 {
+			return 0, false
+		}
+		remaining := float64(stage.queued-stage.done) / (float64(stage.done) / elapsed)
+		if remaining > eta {
+			eta = remaining
+		}
+	}
+	return time.Duration(eta * float64(time.Second)).Round(time.Second), true
+}
+
+func perSecond(delta uint64, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(delta) / seconds
+}
+
+func round1(v float64) float64 {
+	return float64(int64(v*10+0.5)) / 10
+}
+
+// totalSuffix 输入还没有读完时，总数后面加一个 +，表示总数还会增长
+func totalSuffix(inputDone bool) string {
+	if inputDone {
+		return ""
+	}
+	return "+"
+}
+
+func formatETA(eta time.Duration, ok bool, inputDone bool) string {
+	if !ok {
+		return "unknown"
+	}
+	return eta.String() + totalSuffix(inputDone)
+}
+
+// isTerminal 判断文件是否是一个终端
+func isTerminal(fp *os.File) bool {
+	info, err := fp.Stat()
+	if err != nil {
+		return false
+	}
+	// TERM=dumb 的终端不支持 \033[K，当作普通输出处理
+	return info.Mode()&os.ModeCharDevice != 0 && !strings.EqualFold(os.Getenv("TERM"), "dumb")
+}
@@ -0,0 +1,329 @@
+package service
+
+import (
+	"cloud-scanner/config"
+	"context"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// providerLimit 一个云厂商的地址段以及允许的发包速率
+type providerLimit struct {
+	name     string
+	prefixes []netip.Prefix
+	rate     float64
+}
+
+// RateGrant 分配给一次 masscan 的速率
+type RateGrant struct {
+	// 传给 masscan 的 --rate
+	Rate uint
+
+	// 这次扫描的目标在每个限速分组中所占的比例
+	shares map[string]float64
+}
+
+// rateQueue 一个使用 RateBudget 的扫描的任务队列，以及它的 worker 数量
+type rateQueue struct {
+	queue     *chan Target
+	workers   int
+	batchSize int
+}
+
+// rateWaiter 一个正在等待分配速率的 masscan
+type rateWaiter struct {
+	shares map[string]float64
+
+	// 这个扫描自己的速率上限，0 表示不限制
+	limit float64
+}
+
+// RateBudget 所有 masscan 进程共享的发包速率
+//   - 同时运行的 masscan 的速率加起来不超过 --masscanRate
+//   - 落在同一个 /24（IPv6 是 /64）里的速率不超过 --rate-per-24
+//   - 落在同一个云厂商地址段里的速率不超过配置文件中的 provider_rates
+//
+// masscan 启动之后不能调整速率，所以只能在启动新的 masscan 时重新分配，
+// 有 masscan 结束时释放的速率会分给后面启动的 masscan
+// connect 后端扫描每一批目标时也按照同样的方式分配速率，限制每秒发起的连接数
+// 同时运行的多个扫描可以共享同一个 RateBudget，这些限制对所有扫描一起生效
+type RateBudget struct {
+	lock sync.Mutex
+
+	total      float64
+	subnetRate float64
+	providers  []providerLimit
+
+	// 使用这个 RateBudget 的扫描，用来估算接下来会有多少个 masscan 同时运行
+	queues []*rateQueue
+
+	// 正在运行的 masscan 数量，以及按到达顺序排列的等待分配速率的 masscan
+	active  int
+	waiters []*rateWaiter
+
+	allocated float64
+	groupUsed map[string]float64
+
+	// 每次释放速率时关闭并替换，用来唤醒等待的 worker
+	released chan struct{}
+}
+
+// NewRateBudget 根据配置创建一个 RateBudget，queue 是 masscan 的任务队列
+// 多个扫描共享时 queue 为 nil，每个扫描再通过 Attach 加入
+func NewRateBudget(env *Env, queue *chan Target) (*RateBudget, error) {
+	appConfig := env.Config
+	budget := &RateBudget{
+		total:      float64(appConfig.MasscanRate),
+		subnetRate: float64(appConfig.RatePerSubnet),
+		groupUsed:  make(map[string]float64),
+		released:   make(chan struct{}),
+	}
+	if budget.total < 1 {
+		return nil, fmt.Errorf("masscan rate must be at least 1")
+	}
+
+	for _, provider := range appConfig.ProviderRates {
+		if err := budget.addProvider(provider); err != nil {
+			return nil, err
+		}
+	}
+	if queue != nil {
+		budget.Attach(env, queue)
+	}
+	return budget, nil
+}
+
+// Attach 把一个扫描的 masscan 任务队列加入 RateBudget，扫描结束后调用返回的函数移除
+func (b *RateBudget) Attach(env *Env, queue *chan Target) (detach func()) {
+	q := &rateQueue{
+		queue:     queue,
+		workers:   int(env.Config.MasscanWorkerCount),
+		batchSize: int(env.Config.MasscanBatchSize),
+	}
+	if q.batchSize < 1 {
+		q.batchSize = 1
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.queues = append(b.queues, q)
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for i, attached := range b.queues {
+			if attached == q {
+				b.queues = append(b.queues[:i], b.queues[i+1:]...)
+				break
+			}
+		}
+		// 需求变少了，等待的 masscan 可能可以分到更多的速率
+		b.wakeUp()
+	}
+}
+
+func (b *RateBudget) addProvider(provider config.ProviderRate) error {
+	if provider.Name == "" {
+		return fmt.Errorf("provider rate: name is required")
+	}
+	if provider.Rate == 0 {
+		return fmt.Errorf("provider rate %s: rate must be at least 1", provider.Name)
+	}
+	limit := providerLimit{name: provider.Name, rate: float64(provider.Rate)}
+	for _, cidr := range provider.CIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("provider rate %s: invalid CIDR %q: %w", provider.Name, cidr, err)
+		}
+		limit.prefixes = append(limit.prefixes, prefix.Masked())
+	}
+	if len(limit.prefixes) == 0 {
+		return fmt.Errorf("provider rate %s: cidrs is required", provider.Name)
+	}
+	b.providers = append(b.providers, limit)
+	return nil
+}
+
+// Acquire 为扫描一批目标分配速率，速率不够时等待其他 masscan 结束，ctx 被取消时返回错误
+// limit 是这次扫描自己的速率上限，共享 RateBudget 的扫描可以使用更低的速率，0 表示不限制
+func (b *RateBudget) Acquire(ctx context.Context, batch []string, limit uint) (*RateGrant, error) {
+	waiter := &rateWaiter{shares: b.shares(batch), limit: float64(limit)}
+
+	b.lock.Lock()
+	b.waiters = append(b.waiters, waiter)
+	defer func() {
+		b.removeWaiter(waiter)
+		b.lock.Unlock()
+	}()
+
+	for {
+		if rate, ok := b.tryGrant(waiter); ok {
+			// 先等待的 masscan 现在也能分到速率的话，让它先启动，避免刚结束的 worker 一直插队
+			if !b.earlierGrantable(waiter) {
+				b.active += 1
+				b.allocated += rate
+				for group, share := range waiter.shares {
+					b.groupUsed[group] += rate * share
+				}
+				return &RateGrant{Rate: uint(rate), shares: waiter.shares}, nil
+			}
+			b.wakeUp()
+		}
+
+		released := b.released
+		b.lock.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+		}
+		b.lock.Lock()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryGrant 计算现在能分配给这次扫描的速率，调用前需要加锁
+// 可以分到的速率不到应得的一半时，等其他 masscan 释放之后再分配，避免一直用很低的速率扫描
+func (b *RateBudget) tryGrant(waiter *rateWaiter) (float64, bool) {
+	// 接下来会同时运行的 masscan 数量：正在运行的、正在等待的，以及队列中还没有 worker 取走的
+	// 不会超过所有扫描的 worker 数量之和
+	demand := b.active + len(b.waiters)
+	workers := 0
+	for _, q := range b.queues {
+		demand += (len(*q.queue) + q.batchSize - 1) / q.batchSize
+		workers += q.workers
+	}
+	if demand > workers {
+		demand = workers
+	}
+	if demand < 1 {
+		demand = 1
+	}
+
+	// 应得的速率：平分全局速率，并且不超过各个分组的上限
+	desired := b.total / float64(demand)
+	if waiter.limit > 0 {
+		desired = math.Min(desired, waiter.limit)
+	}
+	available := b.total - b.allocated
+	for group, share := range waiter.shares {
+		limit := b.groupLimit(group)
+		if limit <= 0 || share <= 0 {
+			continue
+		}
+		desired = math.Min(desired, limit/share)
+		available = math.Min(available, (limit-b.groupUsed[group])/share)
+	}
+
+	rate := math.Floor(math.Min(desired, available))
+	if b.active == 0 {
+		// 没有其他 masscan 在运行时，应得的速率一定是可以分配的
+		rate = math.Floor(desired)
+	}
+	if rate < 1 {
+		return math.Max(rate, 1), b.active == 0
+	}
+	return rate, rate >= desired/2
+}
+
+// Release 释放一次扫描占用的速率
+func (b *RateBudget) Release(grant *RateGrant) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	rate := float64(grant.Rate)
+	b.active -= 1
+	b.allocated -= rate
+	for group, share := range grant.shares {
+		b.groupUsed[group] -= rate * share
+		if b.groupUsed[group] < 1e-6 {
+			delete(b.groupUsed, group)
+		}
+	}
+	b.wakeUp()
+}
+
+// earlierGrantable 判断比 waiter 先到的 masscan 中，是否有现在就能分到速率的，调用前需要加锁
+func (b *RateBudget) earlierGrantable(waiter *rateWaiter) bool {
+	for _, earlier := range b.waiters {
+		if earlier == waiter {
+			return false
+		}
+		if _, ok := b.tryGrant(earlier); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *RateBudget) removeWaiter(waiter *rateWaiter) {
+	for i, w := range b.waiters {
+		if w == waiter {
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// wakeUp 唤醒所有正在等待的 masscan 重新计算速率，调用前需要加锁
+func (b *RateBudget) wakeUp() {
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// shares 计算一批目标在每个限速分组中所占的比例
+// masscan 在所有目标上平均发包，某个分组收到的速率就是总速率乘以它的地址占比
+func (b *RateBudget) shares(batch []string) map[string]float64 {
+	shares := make(map[string]float64)
+	if b.subnetRate <= 0 && len(b.providers) == 0 {
+		return shares
+	}
+
+	weight := 1 / float64(len(batch))
+	for _, task := range batch {
+		addr, err := netip.ParseAddr(task)
+		if err != nil {
+			continue
+		}
+		if b.subnetRate > 0 {
+			bits := 24
+			if addr.Is6() {
+				bits = 64
+			}
+			prefix, _ := addr.Prefix(bits)
+			shares["subnet:"+prefix.String()] += weight
+		}
+		for _, provider := range b.providers {
+			if provider.contains(addr) {
+				shares["provider:"+provider.name] += weight
+			}
+		}
+	}
+	return shares
+}
+
+// groupLimit 返回限速分组的速率上限
+func (b *RateBudget) groupLimit(group string) float64 {
+	if strings.HasPrefix(group, "subnet:") {
+		return b.subnetRate
+	}
+	name := strings.TrimPrefix(group, "provider:")
+	for _, provider := range b.providers {
+		if provider.name == name {
+			return provider.rate
+		}
+	}
+	return 0
+}
+
+func (p *providerLimit) contains(addr netip.Addr) bool {
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
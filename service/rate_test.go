@@ -0,0 +1,237 @@
+package service
+
+import (
+	"cloud-scanner/config"
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestRateBudget(t *testing.T, appConfig config.AppConfig, queue *chan Target) *RateBudget {
+	t.Helper()
+	budget, err := NewRateBudget(NewEnv(&appConfig, nil), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return budget
+}
+
+func TestRateBudgetTryGrant(t *testing.T) {
+	const subnet = "subnet:1.2.3.0/24"
+	tests := []struct {
+		name      string
+		workers   uint
+		queued    int
+		active    int
+		allocated float64
+		groupUsed map[string]float64
+		shares    map[string]float64
+		limit     float64
+		rate      float64
+		ok        bool
+	}{
+		{
+			name:    "idle budget grants the whole rate",
+			workers: 4,
+			rate:    1000,
+			ok:      true,
+		},
+		{
+			name:    "queued targets split the rate",
+			workers: 4,
+			queued:  3,
+			rate:    333,
+			ok:      true,
+		},
+		{
+			name:    "demand is capped by worker count",
+			workers: 2,
+			queued:  10,
+			rate:    500,
+			ok:      true,
+		},
+		{
+			name:      "less than half of the fair share waits",
+			workers:   2,
+			active:    1,
+			allocated: 900,
+			rate:      100,
+			ok:        false,
+		},
+		{
+			name:      "half of the fair share is granted",
+			workers:   2,
+			queued:    1,
+			active:    1,
+			allocated: 750,
+			rate:      250,
+			ok:        true,
+		},
+		{
+			name:    "rate of the scan itself is a cap",
+			workers: 4,
+			limit:   300,
+			rate:    300,
+			ok:      true,
+		},
+		{
+			name:    "subnet cap limits the rate",
+			workers: 1,
+			shares:  map[string]float64{subnet: 1},
+			rate:    100,
+			ok:      true,
+		},
+		{
+			name:    "subnet cap is scaled by its share of the batch",
+			workers: 1,
+			shares:  map[string]float64{subnet: 0.5},
+			rate:    200,
+			ok:      true,
+		},
+		{
+			name:      "used subnet rate is not granted twice",
+			workers:   2,
+			active:    1,
+			allocated: 80,
+			groupUsed: map[string]float64{subnet: 80},
+			shares:    map[string]float64{subnet: 1},
+			rate:      20,
+			ok:        false,
+		},
+		{
+			name:      "exhausted budget never grants zero",
+			workers:   2,
+			active:    1,
+			allocated: 1000,
+			rate:      1,
+			ok:        false,
+		},
+	}
+	for _, test := range tests {
+		queue := make(chan Target, 16)
+		for i := 0; i < test.queued; i++ {
+			queue <- Target{}
+		}
+		budget := newTestRateBudget(t, config.AppConfig{
+			MasscanRate:        1000,
+			RatePerSubnet:      100,
+			MasscanWorkerCount: test.workers,
+			MasscanBatchSize:   1,
+		}, &queue)
+		budget.active = test.active
+		budget.allocated = test.allocated
+		for group, used := range test.groupUsed {
+			budget.groupUsed[group] = used
+		}
+
+		rate, ok := budget.tryGrant(&rateWaiter{shares: test.shares, limit: test.limit})
+		if rate != test.rate || ok != test.ok {
+			t.Errorf("%s: tryGrant() = %v, %v, want %v, %v", test.name, rate, ok, test.rate, test.ok)
+		}
+	}
+}
+
+func TestRateBudgetShares(t *testing.T) {
+	budget := newTestRateBudget(t, config.AppConfig{
+		MasscanRate:        1000,
+		RatePerSubnet:      100,
+		MasscanWorkerCount: 1,
+		ProviderRates: []config.ProviderRate{
+			{Name: "cloud", Rate: 500, CIDRs: []string{"1.2.0.0/16"}},
+		},
+	}, nil)
+
+	shares := budget.shares([]string{"1.2.3.4", "1.2.3.5", "1.2.4.1", "5.6.7.8"})
+	want := map[string]float64{
+		"subnet:1.2.3.0/24": 0.5,
+		"subnet:1.2.4.0/24": 0.25,
+		"subnet:5.6.7.0/24": 0.25,
+		"provider:cloud":    0.75,
+	}
+	if len(shares) != len(want) {
+		t.Fatalf("shares() = %v, want %v", shares, want)
+	}
+	for group, share := range want {
+		if shares[group] != share {
+			t.Errorf("shares()[%s] = %v, want %v", group, shares[group], share)
+		}
+	}
+	if limit := budget.groupLimit("provider:cloud"); limit != 500 {
+		t.Errorf("groupLimit(provider:cloud) = %v, want 500", limit)
+	}
+}
+
+func TestRateBudgetAcquireRelease(t *testing.T) {
+	budget := newTestRateBudget(t, config.AppConfig{MasscanRate: 1000, MasscanWorkerCount: 2}, nil)
+
+	first, err := budget.Acquire(context.Background(), []string{"1.2.3.4"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Rate != 1000 {
+		t.Fatalf("first grant = %d, want 1000", first.Rate)
+	}
+
+	// 速率都被占用时等待，ctx 超时后返回错误
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := budget.Acquire(ctx, []string{"5.6.7.8"}, 0); err == nil {
+		t.Fatalf("Acquire should wait until ctx is done when the budget is used up")
+	}
+
+	// 释放之后等待的 masscan 可以分到速率
+	granted := make(chan *RateGrant)
+	go func() {
+		grant, _ := budget.Acquire(context.Background(), []string{"5.6.7.8"}, 0)
+		granted <- grant
+	}()
+	time.Sleep(20 * time.Millisecond)
+	budget.Release(first)
+	select {
+	case grant := <-granted:
+		if grant == nil || grant.Rate != 1000 {
+			t.Errorf("grant after release = %+v, want rate 1000", grant)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Acquire was not woken up by Release")
+	}
+}
+
+func TestNewRateBudgetInvalid(t *testing.T) {
+	tests := []config.AppConfig{
+		{MasscanRate: 0},
+		{MasscanRate: 1000, ProviderRates: []config.ProviderRate{{Rate: 10, CIDRs: []string{"1.2.3.0/24"}}}},
+		{MasscanRate: 1000, ProviderRates: []config.ProviderRate{{Name: "a", CIDRs: []string{"1.2.3.0/24"}}}},
+		{MasscanRate: 1000, ProviderRates: []config.ProviderRate{{Name: "a", Rate: 10, CIDRs: []string{"1.2.3.0/33"}}}},
+		{MasscanRate: 1000, ProviderRates: []config.ProviderRate{{Name: "a", Rate: 10}}},
+	}
+	for _, appConfig := range tests {
+		if _, err := NewRateBudget(NewEnv(&appConfig, nil), nil); err == nil {
+			t.Errorf("NewRateBudget(%+v) should fail", appConfig)
+		}
+	}
+}
+
+func TestRateBudgetAttach(t *testing.T) {
+	appConfig := config.AppConfig{MasscanRate: 1000, MasscanWorkerCount: 2, MasscanBatchSize: 1}
+	env := NewEnv(&appConfig, nil)
+	budget, err := NewRateBudget(env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个扫描共享速率，各自的队列中都有一个目标
+	first, second := make(chan Target, 4), make(chan Target, 4)
+	first <- Target{}
+	second <- Target{}
+	budget.Attach(env, &first)
+	detach := budget.Attach(env, &second)
+	if rate, _ := budget.tryGrant(&rateWaiter{}); rate != 500 {
+		t.Errorf("rate with two attached scans = %v, want 500", rate)
+	}
+
+	detach()
+	if rate, _ := budget.tryGrant(&rateWaiter{}); rate != 1000 {
+		t.Errorf("rate after detaching = %v, want 1000", rate)
+	}
+}
@@ -0,0 +1,330 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadResults 读取之前的扫描结果，source 可以是结果文件或者数据库
+//   - 结果文件支持所有的输出格式，根据文件内容自动识别
+//   - 数据库使用和 --database 一样的 DSN，在后面加上 #<scan_id> 指定扫描
+//     不指定时使用最近的一次扫描，excludeScanID 不为空时跳过这次扫描
+func LoadResults(logger *zap.SugaredLogger, source string, excludeScanID string) ([]OutputRecord, error) {
+	if isDatabaseDSN(source) {
+		return loadDatabaseResults(logger, source, excludeScanID)
+	}
+	return loadFileResults(source)
+}
+
+// RedactSource 隐藏数据库 DSN 中的密码，文件路径原样返回
+func RedactSource(source string) string {
+	if !strings.Contains(source, "://") {
+		return source
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return source
+	}
+	return u.Redacted()
+}
+
+// isDatabaseDSN 判断是不是数据库的 DSN，和 openDatabase 支持的前缀一致
+func isDatabaseDSN(source string) bool {
+	for _, prefix := range []string{"sqlite:", "postgres://", "postgresql://"} {
+		if strings.HasPrefix(source, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFileResults 读取结果文件
+func loadFileResults(filename string) ([]OutputRecord, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read result file %s: %w", filename, err)
+	}
+
+	var records []OutputRecord
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(trimmed) == 0:
+		return records, nil
+	case trimmed[0] == '{':
+		records, err = parseJSONResults(trimmed)
+	case bytes.HasPrefix(trimmed, []byte(strings.Join(csvHeader[:3], ","))):
+		records, err = parseCSVResults(trimmed)
+	default:
+		records, err = parseTextResults(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse result file %s failed: %w", filename, err)
+	}
+	return records, nil
+}
+
+// parseJSONResults 整个文件是一个 JSON 文档时读取其中的 results，否则按 JSON Lines 读取
+func parseJSONResults(data []byte) ([]OutputRecord, error) {
+	// 只有一行的 JSON Lines 也是一个完整的 JSON 文档，需要通过 results 字段区分
+	var document struct {
+		Results *[]OutputRecord `json:"results"`
+	}
+	if err := json.Unmarshal(data, &document); err == nil && document.Results != nil {
+		return *document.Results, nil
+	}
+
+	records := make([]OutputRecord, 0)
+	for lineNo, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var record OutputRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// parseCSVResults 读取 CSV 格式，按照表头中的列名取值，兼容以后增加的列
+func parseCSVResults(data []byte) ([]OutputRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+
+	records := make([]OutputRecord, 0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 追加写入的文件中可能有重复的表头
+		if row[0] == header[0] {
+			continue
+		}
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+
+		record := OutputRecord{ScanID: get("scan_id")}
+		record.Host = get("host")
+		record.Protocol = get("protocol")
+		port, err := strconv.ParseUint(get("port"), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q of %s", get("port"), record.Host)
+		}
+		record.Port = uint(port)
+		record.State = get("state")
+		record.Source = get("source")
+		record.JobUUID = get("job_uuid")
+		record.Service = get("service")
+		record.Banner = get("banner")
+		record.Product = get("product")
+		record.Version = get("version")
+		record.ExtraInfo = get("extrainfo")
+		record.CPE = strings.Fields(get("cpe"))
+		record.OSType = get("ostype")
+		record.Confidence, _ = strconv.Atoi(get("confidence"))
+		record.Tunnel = get("tunnel")
+		if scripts := get("scripts"); scripts != "" {
+			_ = json.Unmarshal([]byte(scripts), &record.Scripts)
+		}
+		if labels := get("labels"); labels != "" {
+			_ = json.Unmarshal([]byte(labels), &record.Labels)
+		}
+		record.Timestamp, _ = time.Parse(time.RFC3339Nano, get("timestamp"))
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// parseTextResults 读取最早的文本格式：host, protocol, port, service, banner
+// banner 没有转义，可能包含逗号，所以最多只切分成 5 段
+func parseTextResults(data []byte) ([]OutputRecord, error) {
+	records := make([]OutputRecord, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		// 没有识别出服务时行尾是 ", , "，不能去掉行尾的空格
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.SplitN(line, ", ", 5)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expect host, protocol, port, service, banner", lineNo)
+		}
+		port, err := strconv.ParseUint(fields[2], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid port %q", lineNo, fields[2])
+		}
+		record := OutputRecord{}
+		record.Host = fields[0]
+		record.Protocol = fields[1]
+		record.Port = uint(port)
+		record.State = "open"
+		record.Service = fields[3]
+		if len(fields) == 5 {
+			record.Banner = fields[4]
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// loadDatabaseResults 从数据库中读取一次扫描的所有端口和服务
+func loadDatabaseResults(logger *zap.SugaredLogger, source string, excludeScanID string) ([]OutputRecord, error) {
+	dsn, scanID, _ := strings.Cut(source, "#")
+	db, dialect, err := openDatabase(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	if scanID == "" {
+		err := db.QueryRow(
+			rebindQuery(dialect, `SELECT id FROM scans WHERE id <> ? ORDER BY started_at DESC LIMIT 1`),
+			excludeScanID,
+		).Scan(&scanID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("no previous scan found in database")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("query latest scan failed: %w", err)
+		}
+	}
+	logger.Infof("Load results of scan %s from database.", scanID)
+
+	rows, err := db.Query(rebindQuery(dialect, `
+		SELECT p.host, p.port, p.protocol, p.state, p.source, p.job_uuid, p.updated_at,
+			COALESCE(s.name, ''), COALESCE(s.product, ''), COALESCE(s.version, ''), COALESCE(s.extrainfo, ''),
+			COALESCE(s.banner, ''), COALESCE(s.cpe, ''), COALESCE(s.ostype, ''), COALESCE(s.confidence, 0),
+			COALESCE(s.tunnel, ''), COALESCE(s.scripts, ''), h.labels
+		FROM ports p
+		JOIN hosts h ON h.scan_id = p.scan_id AND h.host = p.host
+		LEFT JOIN services s ON s.scan_id = p.scan_id AND s.host = p.host AND s.port = p.port AND s.protocol = p.protocol
+		WHERE p.scan_id = ?
+		ORDER BY p.host, p.protocol, p.port`), scanID)
+	if err != nil {
+		return nil, fmt.Errorf("query results of scan %s failed: %w", scanID, err)
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	records := make([]OutputRecord, 0)
+	for rows.Next() {
+		record := OutputRecord{ScanID: scanID}
+		var cpe, scripts, labels string
+		err := rows.Scan(
+			&record.Host, &record.Port, &record.Protocol, &record.State, &record.Source, &record.JobUUID, &record.Timestamp,
+			&record.Service, &record.Product, &record.Version, &record.ExtraInfo,
+			&record.Banner, &cpe, &record.OSType, &record.Confidence,
+			&record.Tunnel, &scripts, &labels,
+		)
+		if err != nil {
+			return nil, err
+		}
+		record.CPE = strings.Fields(cpe)
+		if scripts != "" {
+			_ = json.Unmarshal([]byte(scripts), &record.Scripts)
+		}
+		if labels != "" {
+			_ = json.Unmarshal([]byte(labels), &record.Labels)
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		logger.Warnf("Scan %s has no results in database.", scanID)
+	}
+	return records, nil
+}
+
+// ScanInfo 一次扫描的基本信息，报告中使用
+type ScanInfo struct {
+	ScanID     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// 扫描时使用的参数，只有数据库和扫描结束时生成报告才有
+	Parameters map[string]any
+}
+
+// LoadScanInfo 读取扫描的基本信息，scanID 为 records 中的扫描 ID
+// 数据库中有扫描参数，JSON 格式的结果文件中有开始和结束时间，其他格式只有扫描 ID
+func LoadScanInfo(source string, scanID string) (*ScanInfo, error) {
+	info := &ScanInfo{ScanID: scanID}
+	if isDatabaseDSN(source) {
+		dsn, _, _ := strings.Cut(source, "#")
+		db, dialect, err := openDatabase(dsn)
+		if err != nil {
+			return nil, err
+		}
+		defer func(db *sql.DB) {
+			_ = db.Close()
+		}(db)
+
+		var finishedAt sql.NullTime
+		var parameters string
+		err = db.QueryRow(
+			rebindQuery(dialect, `SELECT started_at, finished_at, parameters FROM scans WHERE id = ?`), scanID,
+		).Scan(&info.StartedAt, &finishedAt, &parameters)
+		if err != nil {
+			return nil, fmt.Errorf("query scan %s failed: %w", scanID, err)
+		}
+		info.FinishedAt = finishedAt.Time
+		if parameters != "" {
+			_ = json.Unmarshal([]byte(parameters), &info.Parameters)
+		}
+		return info, nil
+	}
+
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read result file %s: %w", source, err)
+	}
+	var document struct {
+		StartedAt  time.Time `json:"started_at"`
+		FinishedAt time.Time `json:"finished_at"`
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if json.Unmarshal(trimmed, &document) == nil {
+			info.StartedAt, info.FinishedAt = document.StartedAt, document.FinishedAt
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,277 @@
+package service
+
+import (
+	"cloud-scanner/config"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// 报告的格式
+const (
+	ReportFormatHTML     = "html"
+	ReportFormatMarkdown = "markdown"
+)
+
+// 没有识别出服务的端口在服务分布中的名字
+const unidentifiedService = "(unidentified)"
+
+//go:embed report.html.tmpl
+var reportHTMLTemplate string
+
+//go:embed report.md.tmpl
+var reportMarkdownTemplate string
+
+// ReportFormatFromFilename 根据扩展名判断报告的格式
+func ReportFormatFromFilename(filename string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".html", ".htm":
+		return ReportFormatHTML, true
+	case ".md", ".markdown":
+		return ReportFormatMarkdown, true
+	}
+	return "", false
+}
+
+// ReportCount 分布统计中的一项
+type ReportCount struct {
+	Name    string
+	Count   int
+	Percent float64
+}
+
+// ReportHost 一个 host 的所有端口
+type ReportHost struct {
+	Host   string
+	Labels string
+	Ports  []PortResult
+}
+
+// ReportParameter 一个扫描参数
+type ReportParameter struct {
+	Name  string
+	Value string
+}
+
+// ScanReport 扫描报告的内容，由 SaverEngine 写出的结果统计得到
+type ScanReport struct {
+	Title       string
+	Source      string
+	GeneratedAt time.Time
+	Info        ScanInfo
+
+	// 汇总统计
+	Hosts        int
+	OpenPorts    int
+	TCPPorts     int
+	UDPPorts     int
+	Identified   int
+	Unidentified int
+	TarpitPorts  int
+
+	// 服务分布，以及开放的 host 最多的端口
+	Services []ReportCount
+	TopPorts []ReportCount
+
+	HostTables []ReportHost
+	Parameters []ReportParameter
+}
+
+// BuildReport 根据扫描结果生成报告，重复的结果只统计一次，topPorts 为端口排行的长度
+func BuildReport(records []OutputRecord, info *ScanInfo, topPorts int) *ScanReport {
+	report := &ScanReport{
+		Title:       "Scan report",
+		GeneratedAt: time.Now(),
+		Info:        *info,
+	}
+	ports, hosts := indexResults(records)
+	report.Hosts = len(hosts)
+	report.OpenPorts = len(ports)
+
+	services := make(map[string]int)
+	portHosts := make(map[string]int)
+	hostPorts := make(map[string][]PortResult, len(hosts))
+	for _, result := range ports {
+		switch result.Protocol {
+		case ProtocolTCP:
+			report.TCPPorts += 1
+		case ProtocolUDP:
+			report.UDPPorts += 1
+		}
+		if result.State == StateTarpit {
+			report.TarpitPorts += 1
+		}
+		name := result.Service
+		if name == "" {
+			name = unidentifiedService
+			report.Unidentified += 1
+		} else {
+			report.Identified += 1
+		}
+		services[name] += 1
+		portHosts[fmt.Sprintf("%d/%s", result.Port, result.Protocol)] += 1
+		hostPorts[result.Host] = append(hostPorts[result.Host], result)
+	}
+
+	report.Services = sortCounts(services, report.OpenPorts, 0)
+	report.TopPorts = sortCounts(portHosts, report.Hosts, topPorts)
+
+	hostNames := make([]string, 0, len(hostPorts))
+	for host := range hostPorts {
+		hostNames = append(hostNames, host)
+	}
+	sortHosts(hostNames)
+	for _, host := range hostNames {
+		results := hostPorts[host]
+		sortPortResults(results)
+		report.HostTables = append(report.HostTables, ReportHost{Host: host, Labels: FormatLabels(results[0].Labels), Ports: results})
+	}
+
+	report.Parameters = flattenParameters(info.Parameters)
+	return report
+}
+
+// sortCounts 按照数量从多到少排序，数量一样时按名字排序，limit 为 0 时不限制数量
+func sortCounts(counts map[string]int, total int, limit int) []ReportCount {
+	items := make([]ReportCount, 0, len(counts))
+	for name, count := range counts {
+		item := ReportCount{Name: name, Count: count}
+		if total > 0 {
+			item.Percent = float64(count) * 100 / float64(total)
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return lessCountName(items[i].Name, items[j].Name)
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+// lessCountName 端口按照数字排序，其他的按照字符串排序
+func lessCountName(a string, b string) bool {
+	var portA, portB uint
+	_, errA := fmt.Sscanf(a, "%d/", &portA)
+	_, errB := fmt.Sscanf(b, "%d/", &portB)
+	if errA == nil && errB == nil && portA != portB {
+		return portA < portB
+	}
+	return a < b
+}
+
+// flattenParameters 把扫描参数展开成一层，嵌套的字段用 . 连接，空值不显示
+func flattenParameters(parameters map[string]any) []ReportParameter {
+	result := make([]ReportParameter, 0, len(parameters))
+	var walk func(prefix string, value any)
+	walk = func(prefix string, value any) {
+		switch v := value.(type) {
+		case nil:
+		case map[string]any:
+			for key, item := range v {
+				name := key
+				if prefix != "" {
+					name = prefix + "." + key
+				}
+				walk(name, item)
+			}
+		case string:
+			if v != "" {
+				result = append(result, ReportParameter{Name: prefix, Value: v})
+			}
+		case []any:
+			if len(v) > 0 {
+				data, _ := json.Marshal(v)
+				result = append(result, ReportParameter{Name: prefix, Value: string(data)})
+			}
+		case float64:
+			// 扫描参数中的时间序列化之后是纳秒数，根据 AppConfig 中字段的类型还原
+			if field, ok := reflect.TypeOf(config.AppConfig{}).FieldByName(prefix); ok && field.Type == reflect.TypeOf(time.Duration(0)) {
+				result = append(result, ReportParameter{Name: prefix, Value: time.Duration(v).String()})
+				return
+			}
+			result = append(result, ReportParameter{Name: prefix, Value: strconv.FormatFloat(v, 'f', -1, 64)})
+		default:
+			result = append(result, ReportParameter{Name: prefix, Value: fmt.Sprint(v)})
+		}
+	}
+	walk("", parameters)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// reportFuncs 模板中使用的函数
+var reportFuncs = map[string]any{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	},
+	"percent": func(value float64) string {
+		return fmt.Sprintf("%.1f%%", value)
+	},
+	"product": func(result PortResult) string {
+		return strings.TrimSpace(result.Product + " " + result.Version)
+	},
+	"state": func(state string) string {
+		if state == "" {
+			return "open"
+		}
+		return state
+	},
+	// banner 等内容由被扫描的服务决定，先转义 HTML，避免在支持内嵌 HTML 的查看器中执行
+	// Markdown 表格中的 | 和换行也需要转义
+	"md": func(value string) string {
+		value = html.EscapeString(value)
+		value = strings.ReplaceAll(value, "\\", "\\\\")
+		value = strings.ReplaceAll(value, "|", "\\|")
+		value = strings.ReplaceAll(value, "\r", "")
+		return strings.ReplaceAll(value, "\n", "<br>")
+	},
+}
+
+// WriteHTML 输出一个不依赖外部资源的 HTML 文件
+func (r *ScanReport) WriteHTML(w io.Writer) error {
+	tmpl, err := htmltemplate.New("report").Funcs(reportFuncs).Parse(reportHTMLTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, r)
+}
+
+// WriteMarkdown 输出 Markdown 格式
+func (r *ScanReport) WriteMarkdown(w io.Writer) error {
+	tmpl, err := template.New("report").Funcs(reportFuncs).Parse(reportMarkdownTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, r)
+}
+
+// Write 按照格式输出报告
+func (r *ScanReport) Write(w io.Writer, format string) error {
+	switch format {
+	case ReportFormatHTML:
+		return r.WriteHTML(w)
+	case ReportFormatMarkdown:
+		return r.WriteMarkdown(w)
+	}
+	return fmt.Errorf("unknown report format: %s", format)
+}
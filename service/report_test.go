@@ -0,0 +1,33 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMarkdownEscape(t *testing.T) {
+	records := []OutputRecord{{ScanID: "scan", PortResult: PortResult{
+		Host: "1.2.3.4", Port: 80, Protocol: "tcp", State: "open", Service: "http",
+		Product:   "<script>alert(1)</script>",
+		ExtraInfo: "a|b",
+		Banner:    "<img src=x onerror=alert(1)>\r\nServer: x & y",
+	}}}
+	report := BuildReport(records, &ScanInfo{ScanID: "scan"}, 10)
+
+	var buffer bytes.Buffer
+	if err := report.WriteMarkdown(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	output := buffer.String()
+	// 服务返回的内容不能变成 HTML 标签，只有换行转换成的 <br> 是标签
+	for _, tag := range []string{"<img", "<script"} {
+		if strings.Contains(output, tag) {
+			t.Errorf("WriteMarkdown() contains %s:\n%s", tag, output)
+		}
+	}
+	want := "| 80 | tcp | open | http | &lt;script&gt;alert(1)&lt;/script&gt; | a\\|b | &lt;img src=x onerror=alert(1)&gt;<br>Server: x &amp; y |"
+	if !strings.Contains(output, want) {
+		t.Errorf("WriteMarkdown() =\n%s\nwant a row\n%s", output, want)
+	}
+}
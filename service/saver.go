@@ -1,16 +1,16 @@
 package service
 
 import (
-	"bufio"
 	"cloud-scanner/config/constant"
-	"fmt"
-	"os"
 	"sync"
 )
 
 type SaverEngine struct {
-	// 引擎状态
-	Status constant.EngineStatus
+	env *Env
+
+	// 引擎状态，读写时需要加锁
+	Status     constant.EngineStatus
+	statusLock sync.RWMutex
 
 	// 存放主线程的 wait group
 	mainWaitGroup *sync.WaitGroup
@@ -20,20 +20,34 @@ type SaverEngine struct {
 
 	// 接受任务的队列
 	saverJobChan *chan PortResult
+
+	// 结果的存储后端，每条结果都会写到所有的后端中
+	sinks []ResultSink
+
+	// 扫描的统计数据
+	stats *ScanStats
+
+	// 记录扫描进度
+	checkpoint *Checkpoint
 }
 
 // NewSaverEngine 创建一个新的 SaverEngine
-func NewSaverEngine(mainWaitGroup *sync.WaitGroup, saverJobChan *chan PortResult) *SaverEngine {
+func NewSaverEngine(env *Env, mainWaitGroup *sync.WaitGroup, saverJobChan *chan PortResult, sinks []ResultSink, stats *ScanStats, checkpoint *Checkpoint) *SaverEngine {
 	var waitGroup sync.WaitGroup
 	return &SaverEngine{
+		env:           env,
 		Status:        constant.EngineInit,
 		mainWaitGroup: mainWaitGroup,
 		waitGroup:     &waitGroup,
 		saverJobChan:  saverJobChan,
+		sinks:         sinks,
+		stats:         stats,
+		checkpoint:    checkpoint,
 	}
 }
 
 // Run 启动 SaverEngine
+// SaverEngine 不响应 ctx 的取消，而是一直消费到队列关闭为止，保证已经得到的结果都能写到后端中
 func (engine *SaverEngine) Run() {
 	defer func() {
 		engine.mainWaitGroup.Done()
@@ -44,7 +58,7 @@ func (engine *SaverEngine) Run() {
 	go engine.worker()
 	engine.waitGroup.Wait()
 
-	logger.Debugf("SaverEngine exit.")
+	engine.env.Logger.Debugf("SaverEngine exit.")
 }
 
 // worker 真正的工作函数
@@ -52,17 +66,16 @@ func (engine *SaverEngine) worker() {
 	defer engine.waitGroup.Done()
 
 	tag := "[SaverEngine]"
-	logger.Debugf("%s worker start.", tag)
+	engine.setStatus(constant.EngineRunning)
+	defer engine.setStatus(constant.EngineStop)
+	engine.env.Logger.Debugf("%s worker start.", tag)
 
-	// output filename
-	fp, err := os.OpenFile(appConfig.OutputFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		logger.Fatalf("Cannot open output file to write: %s， error: %+v", appConfig.OutputFile, err)
-		os.Exit(1)
-	}
-	writer := bufio.NewWriter(fp)
 	defer func() {
-		_ = fp.Close()
+		for _, sink := range engine.sinks {
+			if err := sink.Close(); err != nil {
+				engine.env.Logger.Errorf("%s Error when closing sink %T, error: %+v", tag, sink, err)
+			}
+		}
 	}()
 
 	for {
@@ -70,12 +83,32 @@ func (engine *SaverEngine) worker() {
 		if !opened {
 			break
 		}
-		logger.Debugf("%s Get task %+v", tag, task)
+		engine.env.Logger.Debugf("%s Get task %+v", tag, task)
 
-		//
-		line := fmt.Sprintf("%s, %s, %d, %s, %s\n", task.Host, task.Protocol, task.Port, task.Service, task.Banner)
-		_, _ = writer.WriteString(line)
-		_ = writer.Flush()
+		record := OutputRecord{
+			ScanID:     engine.env.Config.ScanID,
+			PortResult: task,
+		}
+		for _, sink := range engine.sinks {
+			if err := sink.Write(&record); err != nil {
+				engine.env.Logger.Errorf("%s Error when writing result %+v to sink %T, error: %+v", tag, task, sink, err)
+			}
+		}
+		engine.stats.ResultsSaved.Add(1)
+		engine.checkpoint.ResultSaved(task.JobUUID)
 	}
-	logger.Debugf("%s worker stop.", tag)
+	engine.env.Logger.Debugf("%s worker stop.", tag)
+}
+
+func (engine *SaverEngine) setStatus(status constant.EngineStatus) {
+	engine.statusLock.Lock()
+	defer engine.statusLock.Unlock()
+	engine.Status = status
+}
+
+// GetStatus 返回引擎状态
+func (engine *SaverEngine) GetStatus() constant.EngineStatus {
+	engine.statusLock.RLock()
+	defer engine.statusLock.RUnlock()
+	return engine.Status
 }
@@ -2,31 +2,113 @@ package service
 
 import (
 	"cloud-scanner/config"
-	"cloud-scanner/logging"
+	"cloud-scanner/config/constant"
+	"go.uber.org/zap"
+	"os"
+	"time"
 )
 
-var logger = logging.GetSugar()
-var appConfig = config.GetAppConfig()
+// Env 一次扫描使用的配置和日志，引擎、后端和存储都从这里读取
+// 每个扫描有自己的 Env，同一个进程中可以同时运行多个扫描
+type Env struct {
+	Config *config.AppConfig
+	Logger *zap.SugaredLogger
+}
+
+// NewEnv 创建一个 Env，logger 为 nil 时不输出日志
+func NewEnv(appConfig *config.AppConfig, logger *zap.SugaredLogger) *Env {
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+	return &Env{Config: appConfig, Logger: logger}
+}
 
 // MasscanResult 存储 Masscan 的扫描结果
 // 这样设计是为了以后方便单独保存 Masscan 和 Nmap 的扫描结果
 type MasscanResult struct {
-	Host     string
-	Port     uint
-	Protocol string
+	Host     string `json:"host"`
+	Port     uint   `json:"port"`
+	Protocol string `json:"protocol"`
+
+	// masscan 发现这个端口的时间
+	Timestamp time.Time `json:"timestamp"`
 }
 
 // NmapJob 表示一个 nmap 任务
 type NmapJob struct {
+	// 放到 masscan 队列中的原始目标，元数据会带到每条结果中
+	Target Target
+
 	value []MasscanResult
 	UUID  string
+
+	// 是否是 tarpit host，value 中只有抽样的端口，结果的状态都是 filtered/tarpit
+	// 没有抽到的端口放在 unsampled 中，不识别服务，直接保存
+	tarpit    bool
+	unsampled []MasscanResult
+}
+
+// ScriptResult nmap 脚本的输出
+type ScriptResult struct {
+	ID     string `json:"id"`
+	Output string `json:"output"`
 }
 
+// 扫描结果的来源
+const (
+	ResultSourceNmap    = "nmap"
+	ResultSourceMasscan = "masscan"
+)
+
 // PortResult 表示一个扫描结果
 type PortResult struct {
-	Host     string
-	Port     uint
-	Protocol string
-	Service  string
-	Banner   string
+	Host     string `json:"host"`
+	Port     uint   `json:"port"`
+	Protocol string `json:"protocol"`
+	State    string `json:"state"`
+	Service  string `json:"service"`
+	Banner   string `json:"banner"`
+
+	// nmap 服务识别的详细信息
+	Product    string         `json:"product,omitempty"`
+	Version    string         `json:"version,omitempty"`
+	ExtraInfo  string         `json:"extrainfo,omitempty"`
+	CPE        []string       `json:"cpe,omitempty"`
+	OSType     string         `json:"ostype,omitempty"`
+	Confidence int            `json:"confidence,omitempty"`
+	Tunnel     string         `json:"tunnel,omitempty"`
+	Scripts    []ScriptResult `json:"scripts,omitempty"`
+
+	// 结果的来源，nmap 识别失败时只有 masscan 的发现结果
+	Source string `json:"source"`
+
+	// 产生这个结果的 masscan 任务的 UUID
+	JobUUID string `json:"job_uuid"`
+
+	// 资产清单中的元数据：云厂商、账号、地域、实例 ID 和标签
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// 得到结果的时间
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// removeTempFile 删除引擎的中间文件，如果开了 debug 选项，则不删除
+func (env *Env) removeTempFile(tag string, filename string) {
+	if env.Config.Debug {
+		return
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		env.Logger.Warnf("%s Error when delete temp file. filename: %s, error: %+v", tag, filename, err)
+	}
+}
+
+// countStatus 统计处于某个状态的 worker 数量
+func countStatus(statuses []constant.EngineStatus, status constant.EngineStatus) int {
+	count := 0
+	for _, s := range statuses {
+		if s == status {
+			count += 1
+		}
+	}
+	return count
 }
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bytes"
+	"cloud-scanner/config/constant"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ResultSink 扫描结果的存储后端，SaverEngine 会把每条结果写到所有的后端中
+type ResultSink interface {
+	// Write 写入一条记录
+	Write(record *OutputRecord) error
+
+	// Close 写入收尾的内容并关闭后端
+	Close() error
+}
+
+// NewFileSink 创建一个写文件的后端，文件格式由 format 决定
+// 继续扫描时 resumeState 不为 nil，在原来的文件后面追加，而不是清空文件
+// 重新放回 nmap 队列的任务会把结果再写一遍，所以追加之前先去掉这些任务已经写入的结果，
+// 这样继续扫描之后的文件和一次扫完的文件一样，每个端口只有一条结果
+func NewFileSink(env *Env, filename string, format string, resumeState *ResumeState) (ResultSink, error) {
+	resume := resumeState != nil
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		// 整个文件是一个 JSON 文档，没办法追加
+		if format == constant.OutputFormatJSON {
+			return nil, fmt.Errorf("output format %s cannot be resumed, use %s instead", format, constant.OutputFormatJSONL)
+		}
+		removed, err := removeRequeuedResults(filename, format, resumeState.requeuedFilter())
+		if err != nil {
+			return nil, fmt.Errorf("cannot remove unfinished results from output file %s: %w", filename, err)
+		}
+		if removed > 0 {
+			env.Logger.Infof("Resume: %d results of unfinished nmap jobs are removed from %s, they will be scanned again.", removed, filename)
+		}
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	fp, err := os.OpenFile(filename, flag, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open output file %s: %w", filename, err)
+	}
+	sink, err := NewResultWriter(env, format, fp)
+	if err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+
+	// 追加到已有的 CSV 文件时不需要再写表头
+	if info, err := fp.Stat(); err == nil && resume && info.Size() > 0 {
+		if csvSink, ok := sink.(*csvResultWriter); ok {
+			csvSink.headerWritten = true
+		}
+	}
+	return sink, nil
+}
+
+// removeRequeuedResults 重写结果文件，去掉 requeued 返回 true 的结果，返回去掉的数量
+// 先写到临时文件再替换，重写到一半时出错不会丢掉已有的结果
+// 进程崩溃时最后一条记录可能只写了一半，这样的记录也会去掉，不然后面追加的结果会接在它后面
+func removeRequeuedResults(filename string, format string, requeued func(jobUUID string, host string) bool) (int, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var buffer bytes.Buffer
+	removed := 0
+	// 最后一个换行之后的内容是只写了一半的记录
+	if i := bytes.LastIndexByte(data, '\n'); i+1 < len(data) {
+		data = data[:i+1]
+		removed += 1
+	}
+	switch format {
+	case constant.OutputFormatCSV:
+		// banner 和脚本输出中可能有换行，需要按照 CSV 解析
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.FieldsPerRecord = -1
+		writer := csv.NewWriter(&buffer)
+		writer.UseCRLF = true
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// 只写了一半的记录中有换行
+				removed += 1
+				break
+			}
+			// 表头和 csvHeader 一样，job_uuid 是第三列，host 是第四列
+			if len(row) >= len(csvHeader) && row[0] != csvHeader[0] && requeued(row[2], row[3]) {
+				removed += 1
+				continue
+			}
+			_ = writer.Write(row)
+		}
+		writer.Flush()
+	default:
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var record struct {
+				JobUUID string `json:"job_uuid"`
+				Host    string `json:"host"`
+			}
+			if format == constant.OutputFormatJSONL {
+				if err := json.Unmarshal(line, &record); err != nil {
+					removed += 1
+					continue
+				}
+			} else {
+				// 文本格式没有 job_uuid，第一列是 host
+				host, _, _ := bytes.Cut(line, []byte(", "))
+				record.Host = string(host)
+			}
+			if requeued(record.JobUUID, record.Host) {
+				removed += 1
+				continue
+			}
+			buffer.Write(line)
+			buffer.WriteByte('\n')
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	tmpFile := filename + ".tmp"
+	if err := os.WriteFile(tmpFile, buffer.Bytes(), 0666); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpFile, filename); err != nil {
+		_ = os.Remove(tmpFile)
+		return 0, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"cloud-scanner/config"
+	"cloud-scanner/config/constant"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSinkResume(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "results.state")
+	// 1.2.3.4 已经完成，1.2.3.5 的 nmap 任务在中断之前只写了一部分结果
+	state := `{"type":"scan","scan_id":"scan"}
+{"type":"masscan_done","target":"1.2.3.4","job_uuid":"done","results":[{"host":"1.2.3.4","port":22,"protocol":"tcp"}]}
+{"type":"masscan_done","target":"1.2.3.5","job_uuid":"unfinished","results":[{"host":"1.2.3.5","port":22,"protocol":"tcp"},{"host":"1.2.3.5","port":80,"protocol":"tcp"}]}
+{"type":"nmap_done","target":"1.2.3.4","job_uuid":"done"}
+`
+	if err := os.WriteFile(stateFile, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resumeState, err := LoadResumeState(zap.NewNop().Sugar(), stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := &OutputRecord{ScanID: "scan", PortResult: PortResult{Host: "1.2.3.4", Port: 22, Protocol: "tcp", Service: "ssh", JobUUID: "done"}}
+	partial := &OutputRecord{ScanID: "scan", PortResult: PortResult{Host: "1.2.3.5", Port: 22, Protocol: "tcp", Service: "ssh", JobUUID: "unfinished"}}
+	retried := []*OutputRecord{
+		partial,
+		{ScanID: "scan", PortResult: PortResult{Host: "1.2.3.5", Port: 80, Protocol: "tcp", Service: "http", JobUUID: "unfinished"}},
+	}
+
+	for _, format := range []string{constant.OutputFormatJSONL, constant.OutputFormatCSV, constant.OutputFormatText} {
+		filename := filepath.Join(dir, "results."+format)
+		env := NewEnv(&config.AppConfig{ScanID: "scan"}, nil)
+
+		// 第一次扫描在写到一半时崩溃了，最后一条记录不完整
+		sink, err := NewFileSink(env, filename, format, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range []*OutputRecord{done, partial} {
+			if err := sink.Write(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = sink.Close()
+		fp, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+		_, _ = fp.WriteString("1.2.3.5, tc")
+		_ = fp.Close()
+
+		sink, err = NewFileSink(env, filename, format, resumeState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range retried {
+			if err := sink.Write(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = sink.Close()
+
+		records, err := loadFileResults(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		var got []string
+		for _, record := range records {
+			got = append(got, record.Host+"/"+record.Service)
+		}
+		if want := "1.2.3.4/ssh 1.2.3.5/ssh 1.2.3.5/http"; strings.Join(got, " ") != want {
+			t.Errorf("%s: got results %v, want %s", format, got, want)
+		}
+	}
+}
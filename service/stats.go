@@ -0,0 +1,82 @@
+package service
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// ScanStats 记录整个扫描过程的统计数据，由各个引擎共同更新
+// 扫描结束后用来输出哪些目标扫描完成了，哪些没有扫描
+type ScanStats struct {
+	env *Env
+
+	// TaskBuilder 放入队列的目标数量
+	TargetsQueued atomic.Uint64
+
+	// masscan 扫描完成和失败的目标数量
+	MasscanDone   atomic.Uint64
+	MasscanFailed atomic.Uint64
+
+	// 放入 nmap 队列的任务数量，以及 nmap 扫描完成和失败的任务数量
+	NmapQueued atomic.Uint64
+	NmapDone   atomic.Uint64
+	NmapFailed atomic.Uint64
+
+	// 发现的开放端口数量和保存的结果数量
+	OpenPorts    atomic.Uint64
+	ResultsSaved atomic.Uint64
+
+	// 识别为 tarpit 的 host 数量
+	Tarpits atomic.Uint64
+
+	lock sync.Mutex
+
+	// 没有经过 masscan 扫描的目标
+	notScanned skipRecorder
+
+	// masscan 扫描完了但是没有经过 nmap 识别的目标
+	notFingerprinted skipRecorder
+}
+
+// NewScanStats 创建一个新的 ScanStats
+func NewScanStats(env *Env) *ScanStats {
+	return &ScanStats{env: env}
+}
+
+// AddNotScanned 记录一个没有经过 masscan 扫描的目标
+func (s *ScanStats) AddNotScanned(host string, reason string) {
+	s.add(&s.notScanned, host, reason)
+}
+
+// AddNotFingerprinted 记录一个没有经过 nmap 识别的目标
+func (s *ScanStats) AddNotFingerprinted(host string, reason string) {
+	s.add(&s.notFingerprinted, host, reason)
+}
+
+func (s *ScanStats) add(recorder *skipRecorder, host string, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// TaskBuilder 放进队列的都是展开后的 IP，这里不会解析失败
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		s.env.Logger.Warnf("Unexpected host %q in scan stats, error: %+v", host, err)
+		return
+	}
+	recorder.add(addr, reason)
+}
+
+// NotScanned 返回没有经过 masscan 扫描的目标
+func (s *ScanStats) NotScanned() []SkippedRange {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]SkippedRange{}, s.notScanned.ranges...)
+}
+
+// NotFingerprinted 返回没有经过 nmap 识别的目标
+func (s *ScanStats) NotFingerprinted() []SkippedRange {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]SkippedRange{}, s.notFingerprinted.ranges...)
+}
@@ -0,0 +1,368 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// targetKind 表示目标表达式的类型
+type targetKind int8
+
+const (
+	targetKindRange    targetKind = 0
+	targetKindOctet    targetKind = 1
+	targetKindHostname targetKind = 2
+)
+
+// TargetExpr 表示一个解析后的扫描目标表达式
+// 支持以下几种写法：
+//   - 单个 IP：1.2.3.4 / 2001:db8::1
+//   - CIDR：10.0.0.0/24
+//   - IP 段：1.2.3.4-1.2.3.80
+//   - 八位组范围：10.0.1-3.1-254 / 10.0.0.*
+//   - 域名：example.com，展开时才会通过 DNS 解析
+//
+// 表达式只记录边界，展开时逐个生成 IP，所以一个 /8 也不会占用大量内存
+type TargetExpr struct {
+	// 原始的表达式
+	Raw string
+
+	kind targetKind
+
+	// 连续地址段的首尾（都包含在内），单 IP、CIDR、IP 段都会转成这种形式
+	start netip.Addr
+	end   netip.Addr
+
+	// 八位组范围，每一位都是一个闭区间
+	octets [4][2]int
+
+	// 需要解析的域名
+	hostname string
+}
+
+// ParseTargetExpr 解析一个目标表达式
+func ParseTargetExpr(raw string) (*TargetExpr, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, fmt.Errorf("empty target")
+	}
+	expr := &TargetExpr{Raw: raw}
+
+	// 单个 IP
+	if addr, err := netip.ParseAddr(raw); err == nil {
+		addr, err = normalizeAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		expr.start, expr.end = addr, addr
+		return expr, nil
+	}
+
+	// CIDR
+	if strings.Contains(raw, "/") {
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %w", err)
+		}
+		if prefix.Addr().Is4In6() {
+			return nil, fmt.Errorf("IPv4-mapped IPv6 CIDR is not supported")
+		}
+		expr.start, expr.end = prefixBounds(prefix)
+		return expr, nil
+	}
+
+	// IP 段，两边都必须是完整的 IP
+	if parts := strings.Split(raw, "-"); len(parts) == 2 {
+		start, err1 := netip.ParseAddr(strings.TrimSpace(parts[0]))
+		end, err2 := netip.ParseAddr(strings.TrimSpace(parts[1]))
+		if err1 == nil && err2 == nil {
+			if start, err1 = normalizeAddr(start); err1 != nil {
+				return nil, err1
+			}
+			if end, err2 = normalizeAddr(end); err2 != nil {
+				return nil, err2
+			}
+			if start.BitLen() != end.BitLen() {
+				return nil, fmt.Errorf("range mixes IPv4 and IPv6 addresses")
+			}
+			if end.Less(start) {
+				return nil, fmt.Errorf("range start %s is greater than end %s", start, end)
+			}
+			expr.start, expr.end = start, end
+			return expr, nil
+		}
+	}
+
+	// 八位组范围，只支持 IPv4
+	if octets, ok, err := parseOctetRange(raw); ok {
+		if err != nil {
+			return nil, err
+		}
+		expr.kind = targetKindOctet
+		expr.octets = octets
+		return expr, nil
+	}
+
+	// 剩下的只能是域名了
+	if !isValidHostname(raw) {
+		return nil, fmt.Errorf("not an IP, CIDR, range or hostname")
+	}
+	expr.kind = targetKindHostname
+	expr.hostname = strings.TrimSuffix(raw, ".")
+	return expr, nil
+}
+
+// Expand 逐个展开表达式中的 IP，回调返回 false 时停止展开
+func (expr *TargetExpr) Expand(ctx context.Context, fn func(addr netip.Addr) bool) error {
+	switch expr.kind {
+	case targetKindRange:
+		expandRange(expr.start, expr.end, fn)
+	case targetKindOctet:
+		o := expr.octets
+		for a := o[0][0]; a <= o[0][1]; a++ {
+			for b := o[1][0]; b <= o[1][1]; b++ {
+				for c := o[2][0]; c <= o[2][1]; c++ {
+					for d := o[3][0]; d <= o[3][1]; d++ {
+						if !fn(netip.AddrFrom4([4]byte{byte(a), byte(b), byte(c), byte(d)})) {
+							return nil
+						}
+					}
+				}
+			}
+		}
+	case targetKindHostname:
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", expr.hostname)
+		if err != nil {
+			return fmt.Errorf("resolve %s failed: %w", expr.hostname, err)
+		}
+		seen := make(map[netip.Addr]struct{}, len(addrs))
+		for _, addr := range addrs {
+			addr = addr.Unmap().WithZone("")
+			if _, ok := seen[addr]; ok {
+				continue
+			}
+			seen[addr] = struct{}{}
+			if !fn(addr) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// expandRange 按顺序遍历 [start, end] 之间的所有地址
+func expandRange(start netip.Addr, end netip.Addr, fn func(addr netip.Addr) bool) {
+	for addr := start; addr.IsValid(); addr = addr.Next() {
+		if !fn(addr) || addr == end {
+			return
+		}
+	}
+}
+
+// normalizeAddr 把 IPv4-mapped 的 IPv6 地址还原成 IPv4，并拒绝带 zone 的地址
+func normalizeAddr(addr netip.Addr) (netip.Addr, error) {
+	if addr.Zone() != "" {
+		return addr, fmt.Errorf("IPv6 zone is not supported")
+	}
+	return addr.Unmap(), nil
+}
+
+// prefixBounds 计算 CIDR 的第一个和最后一个地址
+func prefixBounds(prefix netip.Prefix) (netip.Addr, netip.Addr) {
+	start := prefix.Masked().Addr()
+	bytes := start.AsSlice()
+	for i := prefix.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 1 << (7 - uint(i%8))
+	}
+	end, _ := netip.AddrFromSlice(bytes)
+	return start, end
+}
+
+// parseOctetRange 解析 10.0.1-3.* 这种写法
+// 第二个返回值表示输入看起来是否是一个八位组范围，是的话 error 才有意义
+func parseOctetRange(raw string) ([4][2]int, bool, error) {
+	var octets [4][2]int
+	parts := strings.Split(raw, ".")
+	if len(parts) != 4 || !strings.ContainsAny(raw, "-*") {
+		return octets, false, nil
+	}
+	for i, part := range parts {
+		if part == "*" {
+			octets[i] = [2]int{0, 255}
+			continue
+		}
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return octets, true, fmt.Errorf("invalid octet range %q", part)
+		}
+		for j, bound := range bounds {
+			v, err := strconv.Atoi(bound)
+			if err != nil {
+				// 数字都不是，那应该是一个带横线的域名
+				return octets, false, nil
+			}
+			if v < 0 || v > 255 {
+				return octets, true, fmt.Errorf("octet %d out of range", v)
+			}
+			octets[i][j] = v
+		}
+		if len(bounds) == 1 {
+			octets[i][1] = octets[i][0]
+		}
+		if octets[i][0] > octets[i][1] {
+			return octets, true, fmt.Errorf("invalid octet range %q", part)
+		}
+	}
+	return octets, true, nil
+}
+
+// isValidHostname 检查是否为合法的域名
+func isValidHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	labels := strings.Split(host, ".")
+
+	// 顶级域名不会是纯数字，这种情况一般是写错了的 IP
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Target 放到 masscan 队列中的一个扫描目标以及它的元数据
+// 元数据会跟着 NmapJob 一直带到 PortResult 中，用来找到资产的负责人
+type Target struct {
+	Host   string
+	Labels map[string]string
+}
+
+func (t Target) String() string {
+	return t.Host
+}
+
+// 输入中的目标在元数据中记录的来源，文件名和行号
+const LabelInput = "input"
+
+// ParseTargetLine 解析输入文件中的一行，目标表达式后面可以跟着 key=value 形式的元数据
+// 包含空白或者 # 的值可以用双引号括起来，引号中的转义和 Go 的字符串一样
+//
+//	10.0.0.0/24 owner=alice env=prod
+//	1.2.3.4 - 1.2.3.80 team=web
+//	1.2.3.4 note="web server #2"
+func ParseTargetLine(line string) (string, map[string]string, error) {
+	var exprParts []string
+	var labels map[string]string
+	for rest := strings.TrimLeft(line, " \t"); rest != ""; rest = strings.TrimLeft(rest, " \t") {
+		field := rest
+		if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			field = rest[:i]
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			exprParts = append(exprParts, field)
+			rest = rest[len(field):]
+			continue
+		}
+		if key == "" {
+			return "", nil, fmt.Errorf("invalid label %q", field)
+		}
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest[len(key)+1:])
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid quoted value of label %q", key)
+			}
+			field = rest[:len(key)+1+len(quoted)]
+			if tail := rest[len(field):]; tail != "" && tail[0] != ' ' && tail[0] != '\t' {
+				return "", nil, fmt.Errorf("invalid quoted value of label %q", key)
+			}
+			value, _ = strconv.Unquote(quoted)
+		}
+		rest = rest[len(field):]
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[key] = value
+	}
+	return strings.Join(exprParts, " "), labels, nil
+}
+
+// FormatTargetLine 把一个目标写成 ParseTargetLine 可以解析的一行，元数据按 key 排序
+// 包含空白、引号或者 # 的值使用双引号括起来
+func FormatTargetLine(host string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	builder.WriteString(host)
+	for _, key := range keys {
+		value := labels[key]
+		if strings.ContainsAny(value, " \t\r\n\"#") || strconv.Quote(value) != `"`+value+`"` {
+			value = strconv.Quote(value)
+		}
+		builder.WriteString(" " + key + "=" + value)
+	}
+	return builder.String()
+}
+
+// stripInputComment 去掉输入文件中一行的注释
+// 只有行首或者空白后面的 # 才是注释，元数据的值中可以包含 #，例如 ticket=OPS#123，双引号中的 # 也不是注释
+func stripInputComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '"' && i > 0 && line[i-1] == '=':
+			if quoted, err := strconv.QuotedPrefix(line[i:]); err == nil {
+				i += len(quoted) - 1
+			}
+		case line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// ParseLabels 解析 --label 的参数，每一项都是 key=value
+func ParseLabels(items []string) (map[string]string, error) {
+	labels := make(map[string]string, len(items))
+	for _, item := range items {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q, expect key=value", item)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// mergeLabels 合并多组元数据，后面的优先，都为空时返回 nil
+func mergeLabels(groups ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, labels := range groups {
+		for key, value := range labels {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+			merged[key] = value
+		}
+	}
+	return merged
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInputLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		target string
+		labels map[string]string
+	}{
+		{"# comment", "", nil},
+		{"10.0.0.0/24", "10.0.0.0/24", nil},
+		{"10.0.0.0/24 # owner=alice", "10.0.0.0/24", nil},
+		{"10.0.0.0/24\t# comment", "10.0.0.0/24", nil},
+		{"1.2.3.4 - 1.2.3.80 team=web env=prod", "1.2.3.4 - 1.2.3.80", map[string]string{"team": "web", "env": "prod"}},
+		{"1.2.3.4 ticket=OPS#123 # owner=alice", "1.2.3.4", map[string]string{"ticket": "OPS#123"}},
+		{"1.2.3.4 url=http://example.com/#top", "1.2.3.4", map[string]string{"url": "http://example.com/#top"}},
+		{"1.2.3.4 note=", "1.2.3.4", map[string]string{"note": ""}},
+		{`1.2.3.4 note="web server #2" owner=alice # stage=nmap`, "1.2.3.4", map[string]string{"note": "web server #2", "owner": "alice"}},
+		{`1.2.3.4 note="say \"hi\""`, "1.2.3.4", map[string]string{"note": `say "hi"`}},
+	}
+	for _, test := range tests {
+		target, labels, err := ParseTargetLine(stripInputComment(test.line))
+		if err != nil {
+			t.Errorf("ParseTargetLine(%q) error: %v", test.line, err)
+			continue
+		}
+		if target != test.target || !reflect.DeepEqual(labels, test.labels) {
+			t.Errorf("ParseTargetLine(%q) = %q, %v, want %q, %v", test.line, target, labels, test.target, test.labels)
+		}
+	}
+
+	if _, _, err := ParseTargetLine("1.2.3.4 =prod"); err == nil {
+		t.Errorf("a label without key should fail")
+	}
+	for _, line := range []string{`1.2.3.4 note="unterminated`, `1.2.3.4 note="a"b`} {
+		if _, _, err := ParseTargetLine(line); err == nil {
+			t.Errorf("ParseTargetLine(%q) should fail", line)
+		}
+	}
+}
+
+func TestFormatTargetLine(t *testing.T) {
+	labels := map[string]string{
+		"owner":  "alice",
+		"note":   "web server #2",
+		"quote":  `say "hi"`,
+		"tab":    "a\tb",
+		"ticket": "OPS#123",
+		"empty":  "",
+	}
+	line := FormatTargetLine("1.2.3.4", labels)
+	want := `1.2.3.4 empty= note="web server #2" owner=alice quote="say \"hi\"" tab="a\tb" ticket="OPS#123"`
+	if line != want {
+		t.Errorf("FormatTargetLine() = %s, want %s", line, want)
+	}
+
+	// 写出来的一行后面加上注释，仍然能解析出原来的目标和元数据
+	target, parsed, err := ParseTargetLine(stripInputComment(line + " # stage=masscan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "1.2.3.4" || !reflect.DeepEqual(parsed, labels) {
+		t.Errorf("ParseTargetLine(FormatTargetLine()) = %q, %v, want 1.2.3.4, %v", target, parsed, labels)
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StateTarpit tarpit host 上的端口结果使用的状态
+// 这类 host 对所有端口的 SYN 都会响应，端口实际上是被防火墙或者负载均衡拦截了
+const StateTarpit = "filtered/tarpit"
+
+// TarpitDetector 在 masscan 阶段识别 tarpit host，避免 nmap 在上千个假的开放端口上浪费时间
+//   - 开放端口数量没有达到阈值的 host 不做处理
+//   - 达到阈值后，连接几个没有被报告为开放的随机端口，大部分都能连上说明所有端口都会响应
+//   - 确认是 tarpit 之后，只抽样一部分端口交给 nmap，其他端口不识别服务，所有结果的状态都标记为 filtered/tarpit
+type TarpitDetector struct {
+	env       *Env
+	threshold uint
+	probes    uint
+	sample    uint
+	timeout   time.Duration
+}
+
+// NewTarpitDetector 创建 tarpit 检测器，阈值为 0 时返回 nil，表示不检测
+func NewTarpitDetector(env *Env) *TarpitDetector {
+	appConfig := env.Config
+	if appConfig.TarpitThreshold == 0 {
+		return nil
+	}
+	timeout := appConfig.ConnectTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &TarpitDetector{
+		env:       env,
+		threshold: appConfig.TarpitThreshold,
+		probes:    appConfig.TarpitProbes,
+		sample:    appConfig.TarpitSample,
+		timeout:   timeout,
+	}
+}
+
+// Check 检查一个 host 的扫描结果，是 tarpit 时返回抽样后的端口、没有抽到的端口和 true，否则原样返回
+func (d *TarpitDetector) Check(ctx context.Context, tag string, host string, results []MasscanResult) ([]MasscanResult, []MasscanResult, bool) {
+	if d == nil || uint(len(results)) < d.threshold {
+		return results, nil, false
+	}
+
+	answered, probed := d.probeClosed(ctx, host, results)
+	if ctx.Err() != nil {
+		return results, nil, false
+	}
+	// 随机端口大部分都连不上，说明这个 host 确实开放了很多端口
+	if probed > 0 && answered*2 <= probed {
+		d.env.Logger.Infof("%s %s has %d open ports but only %d/%d random closed ports answered, not a tarpit.", tag, host, len(results), answered, probed)
+		return results, nil, false
+	}
+
+	sampled, unsampled := sampleResults(host, results, int(d.sample))
+	d.env.Logger.Warnf("%s %s looks like a tarpit: %d open ports, %d/%d random closed ports answered, only %d ports are sent to nmap.", tag, host, len(results), answered, probed, len(sampled))
+	return sampled, unsampled, true
+}
+
+// probeClosed 连接没有被报告为开放的随机 TCP 端口，返回连接成功的数量和实际尝试的数量
+// 只有 UDP 结果的 host 没有办法这样确认，尝试的数量为 0
+func (d *TarpitDetector) probeClosed(ctx context.Context, host string, results []MasscanResult) (int, int) {
+	open := make(map[uint]struct{}, len(results))
+	for _, r := range results {
+		if r.Protocol == ProtocolTCP {
+			open[r.Port] = struct{}{}
+		}
+	}
+	if len(open) == 0 || d.probes == 0 {
+		return 0, 0
+	}
+
+	ports := make([]uint, 0, d.probes)
+	picked := make(map[uint]struct{}, d.probes)
+	for attempts := 0; uint(len(ports)) < d.probes && attempts < 1000; attempts++ {
+		port := uint(rand.Intn(65535) + 1)
+		if _, ok := open[port]; ok {
+			continue
+		}
+		if _, ok := picked[port]; ok {
+			continue
+		}
+		picked[port] = struct{}{}
+		ports = append(ports, port)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	answered := 0
+	dialer := net.Dialer{Timeout: d.timeout}
+	for _, port := range ports {
+		wg.Add(1)
+		go func(port uint) {
+			defer wg.Done()
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+			if err != nil {
+				if !errors.Is(err, syscall.ECONNREFUSED) {
+					d.env.Logger.Debugf("tarpit probe of %s:%d failed: %v", host, port, err)
+				}
+				return
+			}
+			_ = conn.Close()
+			lock.Lock()
+			answered += 1
+			lock.Unlock()
+		}(port)
+	}
+	wg.Wait()
+	return answered, len(ports)
+}
+
+// sampleResults 抽取 n 个端口，返回按端口排序的抽样结果和剩下的端口
+// 按照 host 和端口的哈希值抽样，同一个 host 每次扫描抽到的端口都一样，和基线对比时不会因为抽样出现变化
+func sampleResults(host string, results []MasscanResult, n int) ([]MasscanResult, []MasscanResult) {
+	if n >= len(results) {
+		return results, nil
+	}
+	type ranked struct {
+		result MasscanResult
+		hash   uint64
+	}
+	ranking := make([]ranked, 0, len(results))
+	for _, r := range results {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", host, r.Protocol, r.Port)))
+		ranking = append(ranking, ranked{result: r, hash: binary.BigEndian.Uint64(sum[:8])})
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		return ranking[i].hash < ranking[j].hash
+	})
+
+	sampled := make([]MasscanResult, 0, n)
+	unsampled := make([]MasscanResult, 0, len(results)-n)
+	for i, r := range ranking {
+		if i < n {
+			sampled = append(sampled, r.result)
+		} else {
+			unsampled = append(unsampled, r.result)
+		}
+	}
+	for _, list := range [][]MasscanResult{sampled, unsampled} {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Port != list[j].Port {
+				return list[i].Port < list[j].Port
+			}
+			return list[i].Protocol < list[j].Protocol
+		})
+	}
+	return sampled, unsampled
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSampleResults(t *testing.T) {
+	results := make([]MasscanResult, 0, 1000)
+	for port := uint(1); port <= 1000; port++ {
+		results = append(results, MasscanResult{Host: "1.2.3.4", Port: port, Protocol: ProtocolTCP})
+	}
+	sampled, unsampled := sampleResults("1.2.3.4", results, 10)
+	if len(sampled) != 10 || len(unsampled) != 990 {
+		t.Fatalf("got %d sampled and %d unsampled ports, want 10 and 990", len(sampled), len(unsampled))
+	}
+	seen := make(map[uint]struct{})
+	for _, list := range [][]MasscanResult{sampled, unsampled} {
+		for i, r := range list {
+			if i > 0 && list[i-1].Port >= r.Port {
+				t.Errorf("ports are not sorted: %d after %d", r.Port, list[i-1].Port)
+			}
+			seen[r.Port] = struct{}{}
+		}
+	}
+	if len(seen) != len(results) {
+		t.Errorf("got %d ports after sampling, want %d", len(seen), len(results))
+	}
+
+	// 同一个 host 每次扫描抽到的端口都一样，和结果的顺序以及少量端口的变化无关
+	shuffled := make([]MasscanResult, 0, len(results))
+	for _, r := range results {
+		if r.Port != unsampled[0].Port {
+			shuffled = append(shuffled, r)
+		}
+	}
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	again, _ := sampleResults("1.2.3.4", shuffled, 10)
+	if !reflect.DeepEqual(again, sampled) {
+		t.Errorf("sampleResults() = %v on rescan, want %v", again, sampled)
+	}
+
+	// 端口数量没有超过 n 时全部交给 nmap
+	if all, rest := sampleResults("1.2.3.4", results[:5], 10); len(all) != 5 || len(rest) != 0 {
+		t.Errorf("got %d sampled and %d unsampled ports, want 5 and 0", len(all), len(rest))
+	}
+}
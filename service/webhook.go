@@ -0,0 +1,240 @@
+package service
+
+import (
+	"bytes"
+	"cloud-scanner/config"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 支持的 webhook 类型
+const (
+	WebhookGeneric  = "generic"
+	WebhookSlack    = "slack"
+	WebhookFeishu   = "feishu"
+	WebhookDingTalk = "dingtalk"
+)
+
+// 每次请求的超时时间，以及第一次重试前等待的时间，之后每次翻倍
+const (
+	webhookTimeout      = 10 * time.Second
+	webhookRetryBackoff = time.Second
+)
+
+// 读取响应体的最大长度，只用于检查错误码和记录日志
+const maxWebhookResponse = 4096
+
+// notifier 把一批告警发送到一个 webhook
+type notifier interface {
+	// Name 用于日志的名字，不包含 URL 中的 token
+	Name() string
+
+	// Send 发送一批告警，返回的错误可以重试时 retryable 为 true
+	Send(alerts []Alert) (retryable bool, err error)
+}
+
+// ParseWebhookSpec 解析命令行上的 webhook，格式为 [type:]url，没有指定类型时是 generic
+func ParseWebhookSpec(spec string) config.AlertWebhook {
+	for _, webhookType := range []string{WebhookGeneric, WebhookSlack, WebhookFeishu, WebhookDingTalk} {
+		if value, ok := strings.CutPrefix(spec, webhookType+":"); ok {
+			return config.AlertWebhook{Type: webhookType, URL: value}
+		}
+	}
+	return config.AlertWebhook{Type: WebhookGeneric, URL: spec}
+}
+
+// newNotifier 根据 webhook 的类型创建对应的 notifier
+func newNotifier(webhook config.AlertWebhook) (notifier, error) {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid alert webhook url %q", redactWebhookURL(webhook.URL))
+	}
+	webhookType := webhook.Type
+	if webhookType == "" {
+		webhookType = WebhookGeneric
+	}
+	switch webhookType {
+	case WebhookGeneric, WebhookSlack, WebhookFeishu, WebhookDingTalk:
+	default:
+		return nil, fmt.Errorf("unknown alert webhook type: %s", webhook.Type)
+	}
+	return &webhookNotifier{
+		webhookType: webhookType,
+		url:         webhook.URL,
+		secret:      webhook.Secret,
+		client:      &http.Client{Timeout: webhookTimeout},
+	}, nil
+}
+
+// sendWithRetry 发送一批告警，网络错误、5xx 和 429 按指数退避重试
+// ctx 被取消后不再等待重试，返回最后一次的错误
+func sendWithRetry(ctx context.Context, logger *zap.SugaredLogger, n notifier, alerts []Alert, retries uint, backoff time.Duration) error {
+	for attempt := uint(1); ; attempt++ {
+		retryable, err := n.Send(alerts)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt > retries {
+			return err
+		}
+		logger.Warnf("[AlertSink] Sending alerts to %s attempt %d failed, retry in %s. error: %v", n.Name(), attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// webhookNotifier 通过 HTTP POST 发送告警，不同类型的 webhook 只是请求体和签名不一样
+type webhookNotifier struct {
+	webhookType string
+	url         string
+	secret      string
+	client      *http.Client
+}
+
+func (n *webhookNotifier) Name() string {
+	return fmt.Sprintf("%s webhook %s", n.webhookType, redactWebhookURL(n.url))
+}
+
+func (n *webhookNotifier) Send(alerts []Alert) (bool, error) {
+	target := n.url
+	var payload any
+	headers := make(map[string]string)
+	now := time.Now()
+
+	switch n.webhookType {
+	case WebhookSlack:
+		payload = map[string]any{"text": alertText(alerts)}
+	case WebhookFeishu:
+		message := map[string]any{
+			"msg_type": "text",
+			"content":  map[string]string{"text": alertText(alerts)},
+		}
+		// 飞书的签名：以 timestamp + "\n" + secret 为密钥计算空字符串的 HMAC-SHA256
+		if n.secret != "" {
+			timestamp := strconv.FormatInt(now.Unix(), 10)
+			mac := hmac.New(sha256.New, []byte(timestamp+"\n"+n.secret))
+			message["timestamp"] = timestamp
+			message["sign"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		}
+		payload = message
+	case WebhookDingTalk:
+		payload = map[string]any{
+			"msgtype": "text",
+			"text":    map[string]string{"content": alertText(alerts)},
+		}
+		// 钉钉的签名：以 secret 为密钥计算 timestamp + "\n" + secret 的 HMAC-SHA256，放在 URL 参数中
+		if n.secret != "" {
+			timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+			mac := hmac.New(sha256.New, []byte(n.secret))
+			mac.Write([]byte(timestamp + "\n" + n.secret))
+			separator := "?"
+			if strings.Contains(target, "?") {
+				separator = "&"
+			}
+			target += separator + "timestamp=" + timestamp + "&sign=" + url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+		}
+	default:
+		payload = map[string]any{
+			"scan_id": alerts[0].ScanID,
+			"count":   len(alerts),
+			"alerts":  alerts,
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+	// 通用的 webhook 用 secret 对请求体签名，接收方可以用来校验来源
+	if n.webhookType == WebhookGeneric && n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		headers["X-Scanner-Signature"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	request, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "cloud-scanner")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		// 错误信息中带着完整的 URL，去掉之后再返回
+		return true, fmt.Errorf("post failed: %s", strings.ReplaceAll(err.Error(), n.url, redactWebhookURL(n.url)))
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, maxWebhookResponse))
+
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return true, fmt.Errorf("server returned %s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+	}
+	if response.StatusCode >= 300 {
+		return false, fmt.Errorf("server returned %s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+	}
+	return false, checkChatResponse(n.webhookType, responseBody)
+}
+
+// checkChatResponse 飞书和钉钉出错时 HTTP 状态码也是 200，错误码在响应体中
+func checkChatResponse(webhookType string, body []byte) error {
+	var result struct {
+		Code    *int   `json:"code"`
+		Msg     string `json:"msg"`
+		ErrCode *int   `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	switch webhookType {
+	case WebhookFeishu:
+		if json.Unmarshal(body, &result) == nil && result.Code != nil && *result.Code != 0 {
+			return fmt.Errorf("feishu returned code %d: %s", *result.Code, result.Msg)
+		}
+	case WebhookDingTalk:
+		if json.Unmarshal(body, &result) == nil && result.ErrCode != nil && *result.ErrCode != 0 {
+			return fmt.Errorf("dingtalk returned errcode %d: %s", *result.ErrCode, result.ErrMsg)
+		}
+	}
+	return nil
+}
+
+// alertText 聊天工具中的消息内容，每个告警一行
+func alertText(alerts []Alert) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("cloud-scanner: %d alerts from scan %s\n", len(alerts), alerts[0].ScanID))
+	for i := range alerts {
+		builder.WriteString(alerts[i].String() + "\n")
+	}
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// redactWebhookURL webhook 的 URL 中通常带着 token，日志中只保留协议和主机
+func redactWebhookURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "<invalid url>"
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"bufio"
+	"cloud-scanner/config/constant"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OutputRecord 写入结果文件的一条记录，包含完整的 PortResult 以及本次扫描的元数据
+type OutputRecord struct {
+	ScanID string `json:"scan_id"`
+	PortResult
+}
+
+// NewResultWriter 根据输出格式创建对应的 ResultSink，每条记录写完之后都会立即刷新到输出中
+func NewResultWriter(env *Env, format string, output io.WriteCloser) (ResultSink, error) {
+	switch format {
+	case constant.OutputFormatText:
+		return &textResultWriter{output: output, writer: bufio.NewWriter(output)}, nil
+	case constant.OutputFormatJSONL:
+		return &jsonlResultWriter{output: output, writer: bufio.NewWriter(output)}, nil
+	case constant.OutputFormatJSON:
+		return &jsonResultWriter{env: env, output: output, writer: bufio.NewWriter(output)}, nil
+	case constant.OutputFormatCSV:
+		writer := csv.NewWriter(output)
+		writer.UseCRLF = true
+		return &csvResultWriter{output: output, writer: writer}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// textResultWriter 最早的文本格式，一行一个结果，字段之间用逗号分隔，没有转义
+type textResultWriter struct {
+	output io.WriteCloser
+	writer *bufio.Writer
+}
+
+func (w *textResultWriter) Write(record *OutputRecord) error {
+	line := fmt.Sprintf("%s, %s, %d, %s, %s\n", record.Host, record.Protocol, record.Port, record.Service, record.Banner)
+	if _, err := w.writer.WriteString(line); err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+func (w *textResultWriter) Close() error {
+	_ = w.writer.Flush()
+	return w.output.Close()
+}
+
+// jsonlResultWriter JSON Lines 格式，一行一个 JSON 对象
+type jsonlResultWriter struct {
+	output io.WriteCloser
+	writer *bufio.Writer
+}
+
+func (w *jsonlResultWriter) Write(record *OutputRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, _ = w.writer.Write(data)
+	_ = w.writer.WriteByte('\n')
+	return w.writer.Flush()
+}
+
+func (w *jsonlResultWriter) Close() error {
+	_ = w.writer.Flush()
+	return w.output.Close()
+}
+
+// jsonResultWriter 整个文件是一个 JSON 文档，结果放在 results 数组中
+// 结果是边扫边写的，所以文档头在第一次写入时输出，文档尾在 Close 时输出
+type jsonResultWriter struct {
+	env    *Env
+	output io.WriteCloser
+	writer *bufio.Writer
+
+	// 已经写入的记录数
+	count int
+}
+
+func (w *jsonResultWriter) writeHeader() error {
+	header, err := json.Marshal(map[string]interface{}{
+		"scan_id":    w.env.Config.ScanID,
+		"started_at": w.env.Config.StartedAt,
+	})
+	if err != nil {
+		return err
+	}
+	// 去掉最后的 }，后面接着写 results 数组
+	_, _ = w.writer.Write(header[:len(header)-1])
+	_, err = w.writer.WriteString(",\"results\":[")
+	return err
+}
+
+func (w *jsonResultWriter) Write(record *OutputRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if w.count == 0 {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	} else {
+		_ = w.writer.WriteByte(',')
+	}
+	_ = w.writer.WriteByte('\n')
+	_, _ = w.writer.Write(data)
+	w.count += 1
+	return w.writer.Flush()
+}
+
+func (w *jsonResultWriter) Close() error {
+	defer func() {
+		_ = w.output.Close()
+	}()
+	if w.count == 0 {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	finishedAt, _ := json.Marshal(time.Now())
+	_, _ = w.writer.WriteString(fmt.Sprintf("\n],\"finished_at\":%s}\n", finishedAt))
+	return w.writer.Flush()
+}
+
+// csvHeader CSV 格式的表头
+var csvHeader = []string{
+	"scan_id", "timestamp", "job_uuid", "host", "protocol", "port", "state", "source", "service", "banner",
+	"product", "version", "extrainfo", "cpe", "ostype", "confidence", "tunnel", "scripts", "labels",
+}
+
+// csvResultWriter RFC 4180 格式的 CSV，第一行是表头
+type csvResultWriter struct {
+	output io.WriteCloser
+	writer *csv.Writer
+
+	headerWritten bool
+}
+
+func (w *csvResultWriter) writeHeader() error {
+	w.headerWritten = true
+	return w.writer.Write(csvHeader)
+}
+
+func (w *csvResultWriter) Write(record *OutputRecord) error {
+	if !w.headerWritten {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	// 脚本输出可能有多行，直接用 JSON 保存
+	scripts := ""
+	if len(record.Scripts) > 0 {
+		data, _ := json.Marshal(record.Scripts)
+		scripts = string(data)
+	}
+	labels := ""
+	if len(record.Labels) > 0 {
+		data, _ := json.Marshal(record.Labels)
+		labels = string(data)
+	}
+	err := w.writer.Write([]string{
+		record.ScanID,
+		record.Timestamp.Format(time.RFC3339Nano),
+		record.JobUUID,
+		record.Host,
+		record.Protocol,
+		strconv.FormatUint(uint64(record.Port), 10),
+		record.State,
+		record.Source,
+		record.Service,
+		record.Banner,
+		record.Product,
+		record.Version,
+		record.ExtraInfo,
+		strings.Join(record.CPE, " "),
+		record.OSType,
+		strconv.Itoa(record.Confidence),
+		record.Tunnel,
+		scripts,
+		labels,
+	})
+	if err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *csvResultWriter) Close() error {
+	defer func() {
+		_ = w.output.Close()
+	}()
+	// 没有任何结果时也要有表头
+	if !w.headerWritten {
+		_ = w.writeHeader()
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}